@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// AcceptanceConfig contains the parameters of the acceptance criterion of the annealing
+type AcceptanceConfig struct {
+	Criterion        string  // name of the acceptance criterion
+	RainSpeed        float64 // fraction of the water level lowered at each iteration by the great deluge
+	Deviation        float64 // relative deviation from the record allowed by the record-to-record travel
+	HistoryLength    int     // length of the cost history of the late-acceptance hill climbing
+	SigmoidSteepness float64 // steepness of the sigmoid criterion
+}
+
+// AcceptanceCriterion decides whether a candidate solution can replace the current one.
+//
+// Accept and Record are called exactly once per iteration, so stateful criteria can advance their state in them
+type AcceptanceCriterion interface {
+	// Name returns the name of the criterion, as selected from the CLI
+	Name() string
+
+	// Accept decides whether the candidate cost is acceptable, given the cost of the current solution,
+	// the best cost found so far, and the current control temperature
+	Accept(current float64, candidate float64, best float64, temperature float64) bool
+
+	// Record is given the cost of the solution kept at the end of the iteration,
+	// once the annealing has decided whether to restart from the best solution
+	Record(cost float64)
+
+	// State returns the current state of the criterion, to be saved in the checkpoints
+	State() AcceptanceState
+
+	// Restore brings the criterion back to a state saved in a checkpoint
+	Restore(state AcceptanceState)
+}
+
+// AcceptanceState is the state of an acceptance criterion, saved in the checkpoints (empty for the stateless criteria)
+type AcceptanceState struct {
+	Level     float64   `json:"level,omitempty"`     // water level of the great deluge
+	History   []float64 `json:"history,omitempty"`   // cost history of the late-acceptance hill climbing
+	Iteration int       `json:"iteration,omitempty"` // iterations performed by the late-acceptance hill climbing
+}
+
+// scaled returns the state with the costs it holds (the water level of the great deluge, the cost history of the late acceptance)
+// multiplied by the given ratio, to carry it over to costs on a different scale
+func (s AcceptanceState) scaled(ratio float64) AcceptanceState {
+	scaled := s
+	scaled.Level *= ratio
+	if s.History != nil {
+		scaled.History = make([]float64, len(s.History))
+		for i, cost := range s.History {
+			scaled.History[i] = cost * ratio
+		}
+	}
+	return scaled
+}
+
+// statelessCriterion implements the state methods of the criteria whose decisions don't depend on the previous iterations
+type statelessCriterion struct{}
+
+func (statelessCriterion) State() AcceptanceState        { return AcceptanceState{} }
+func (statelessCriterion) Restore(state AcceptanceState) {}
+func (statelessCriterion) Record(cost float64)           {}
+
+// NewAcceptanceCriterion creates the acceptance criterion described by the config
+func NewAcceptanceCriterion(config AcceptanceConfig, r *rand.Rand) (AcceptanceCriterion, error) {
+	switch config.Criterion {
+	case "metropolis":
+		return &metropolisCriterion{r: r}, nil
+	case "threshold":
+		return &thresholdCriterion{}, nil
+	case "greatDeluge":
+		if config.RainSpeed <= 0 || config.RainSpeed >= 1 {
+			return nil, fmt.Errorf("Rain speed must be in the interval (0,1), got %g", config.RainSpeed)
+		}
+		return &greatDelugeCriterion{rainSpeed: config.RainSpeed}, nil
+	case "recordToRecord":
+		if config.Deviation < 0 {
+			return nil, fmt.Errorf("Deviation cannot be negative, got %g", config.Deviation)
+		}
+		return &recordToRecordCriterion{deviation: config.Deviation}, nil
+	case "lateAcceptance":
+		if config.HistoryLength <= 0 {
+			return nil, fmt.Errorf("History length must be positive, got %d", config.HistoryLength)
+		}
+		return &lateAcceptanceCriterion{historyLength: config.HistoryLength}, nil
+	case "hillClimbing":
+		return &hillClimbingCriterion{}, nil
+	case "sigmoid":
+		if config.SigmoidSteepness <= 0 {
+			return nil, fmt.Errorf("Sigmoid steepness must be positive, got %g", config.SigmoidSteepness)
+		}
+		return &sigmoidCriterion{r: r, steepness: config.SigmoidSteepness}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown acceptance criterion '%s'", config.Criterion)
+}
+
+// usesTemperature reports whether the acceptance criterion with the given name is driven by the control temperature
+func usesTemperature(criterion string) bool {
+	return criterion == "metropolis" || criterion == "threshold"
+}
+
+// metropolisCriterion always accepts improvements, and accepts worse solutions with probability exp(-delta/T).
+// The probability decreases as the cost difference grows and as the control temperature lowers
+type metropolisCriterion struct {
+	statelessCriterion
+	r *rand.Rand
+}
+
+func (c *metropolisCriterion) Name() string { return "metropolis" }
+
+func (c *metropolisCriterion) Accept(current float64, candidate float64, best float64, temperature float64) bool {
+	if candidate <= current {
+		return true
+	}
+	if temperature <= 0 {
+		return false
+	}
+	return c.r.Float64() < math.Exp(-(candidate-current)/temperature)
+}
+
+// thresholdCriterion deterministically accepts any solution that is not worse than the current one
+// by more than a threshold. The control temperature is used as threshold, so it shrinks following the cooling schedule
+type thresholdCriterion struct {
+	statelessCriterion
+}
+
+func (c *thresholdCriterion) Name() string { return "threshold" }
+
+func (c *thresholdCriterion) Accept(current float64, candidate float64, best float64, temperature float64) bool {
+	return candidate-current <= temperature
+}
+
+// greatDelugeCriterion accepts any solution whose cost is below a water level.
+// The level starts at the cost of the initial solution, and gets lowered at each iteration
+type greatDelugeCriterion struct {
+	rainSpeed float64
+	level     float64
+}
+
+func (c *greatDelugeCriterion) Name() string                  { return "greatDeluge" }
+func (c *greatDelugeCriterion) State() AcceptanceState        { return AcceptanceState{Level: c.level} }
+func (c *greatDelugeCriterion) Restore(state AcceptanceState) { c.level = state.Level }
+func (c *greatDelugeCriterion) Record(cost float64)           {}
+
+func (c *greatDelugeCriterion) Accept(current float64, candidate float64, best float64, temperature float64) bool {
+	if c.level == 0 {
+		c.level = current
+	}
+	c.level -= c.rainSpeed * c.level
+
+	return candidate <= current || candidate <= c.level
+}
+
+// recordToRecordCriterion accepts any solution whose cost is within a relative deviation from the best cost found so far (the record)
+type recordToRecordCriterion struct {
+	statelessCriterion
+	deviation float64
+}
+
+func (c *recordToRecordCriterion) Name() string { return "recordToRecord" }
+
+func (c *recordToRecordCriterion) Accept(current float64, candidate float64, best float64, temperature float64) bool {
+	return candidate <= current || candidate <= best*(1+c.deviation)
+}
+
+// lateAcceptanceCriterion compares the candidate with the cost the solution had a fixed number of iterations ago,
+// accepting it if it is not worse than that one (or than the current one)
+type lateAcceptanceCriterion struct {
+	historyLength int
+	history       []float64 // circular buffer of the costs of the last iterations
+	iteration     int
+}
+
+func (c *lateAcceptanceCriterion) Name() string { return "lateAcceptance" }
+
+func (c *lateAcceptanceCriterion) State() AcceptanceState {
+	return AcceptanceState{History: append([]float64{}, c.history...), Iteration: c.iteration}
+}
+
+func (c *lateAcceptanceCriterion) Restore(state AcceptanceState) {
+	// an empty history is filled again by the next iteration
+	c.history = append([]float64(nil), state.History...)
+	c.iteration = state.Iteration
+}
+
+func (c *lateAcceptanceCriterion) Accept(current float64, candidate float64, best float64, temperature float64) bool {
+
+	// the history is initially filled with the cost of the initial solution
+	if c.history == nil {
+		c.history = make([]float64, c.historyLength)
+		for i := range c.history {
+			c.history[i] = current
+		}
+	}
+
+	return candidate <= current || candidate <= c.history[c.iteration%c.historyLength]
+}
+
+// Record stores the cost of the solution resulting from this iteration, in place of the one it was compared with
+func (c *lateAcceptanceCriterion) Record(cost float64) {
+	c.history[c.iteration%c.historyLength] = cost
+	c.iteration++
+}
+
+// hillClimbingCriterion only accepts solutions that are not worse than the current one
+type hillClimbingCriterion struct {
+	statelessCriterion
+}
+
+func (c *hillClimbingCriterion) Name() string { return "hillClimbing" }
+
+func (c *hillClimbingCriterion) Accept(current float64, candidate float64, best float64, temperature float64) bool {
+	return candidate <= current
+}
+
+// sigmoidCriterion accepts worse solutions by comparing a random number with a sigmoid function
+// (https://en.wikipedia.org/wiki/Sigmoid_function) of the percentage cost difference,
+// that enhances the probability of accepting lower differences.
+//
+// It is independent from the control temperature
+type sigmoidCriterion struct {
+	statelessCriterion
+	r         *rand.Rand
+	steepness float64
+}
+
+func (c *sigmoidCriterion) Name() string { return "sigmoid" }
+
+func (c *sigmoidCriterion) Accept(current float64, candidate float64, best float64, temperature float64) bool {
+	if candidate <= current {
+		return true
+	}
+
+	percDiff := (candidate - current) * 100 / current
+	sigmoid := (2 / (1 + math.Exp(-c.steepness*percDiff))) - 1 // sigmoid function variation
+	return c.r.Float64() > sigmoid
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AnimationConfig contains the parameters of the time-lapse animations of the simulation
+type AnimationConfig struct {
+	Format    string        // format of the animation: gif, apng or avi (MJPEG)
+	FrameRate float64       // frames shown per second
+	Loops     int           // number of times the animation is played, or 0 to loop forever (not supported by avi)
+	Scale     float64       // scaling factor of the frames, with respect to the size of the target image
+	Hold      time.Duration // how long the final frame is shown
+}
+
+// AnimationWriter encodes the frames of a time-lapse into a file, as they are added.
+//
+// The frames are written right away, so that long simulations don't keep them in memory, and the file is finalized by Close
+type AnimationWriter interface {
+	// AddFrame appends a frame to the animation, shown for the given time. All the frames must have the same size
+	AddFrame(i image.Image, duration time.Duration) error
+
+	// Close finalizes the animation and closes its file
+	Close() error
+}
+
+// NewAnimationWriter creates the file of an animation at the given path, with the format and the options of the configuration
+func NewAnimationWriter(path string, config AnimationConfig) (AnimationWriter, error) {
+	if config.FrameRate <= 0 {
+		return nil, fmt.Errorf("Frame rate of the animation must be positive, got %g", config.FrameRate)
+	}
+	if config.Scale <= 0 {
+		return nil, fmt.Errorf("Scale of the animation must be positive, got %g", config.Scale)
+	}
+	if config.Loops < 0 {
+		return nil, fmt.Errorf("Loops of the animation cannot be negative, got %d", config.Loops)
+	}
+	if _, err := animationExtension(config.Format); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Format {
+	case "gif":
+		return &gifWriter{file: file, config: config}, nil
+	case "apng":
+		return &apngWriter{file: file, config: config}, nil
+	default:
+		return &aviWriter{file: file, config: config}, nil
+	}
+}
+
+// animationExtension returns the extension of the files of the given animation format
+func animationExtension(format string) (string, error) {
+	switch format {
+	case "gif":
+		return ".gif", nil
+	case "apng":
+		return ".png", nil
+	case "avi":
+		return ".avi", nil
+	}
+
+	return "", fmt.Errorf("Unknown animation format '%s'", format)
+}
+
+// animationPath returns the default path of the time-lapse of the run with the given target image and number of seeds
+func animationPath(imageName string, numSeeds int, format string) (string, error) {
+	extension, err := animationExtension(format)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("./res/%s_%d-seeds%s", imageName, numSeeds, extension), nil
+}
+
+// frameDuration returns how long each frame is shown, at the frame rate of the configuration
+func (c AnimationConfig) frameDuration() time.Duration {
+	return time.Duration(float64(time.Second) / c.FrameRate)
+}
+
+// finalFrameDuration returns how long the final frame is shown: it's held for longer than the others, if requested
+func (c AnimationConfig) finalFrameDuration() time.Duration {
+	if c.Hold > c.frameDuration() {
+		return c.Hold
+	}
+	return c.frameDuration()
+}
+
+// scaleFrame converts a frame to 8-bit pixels with straight alpha, resized by the given factor.
+// The nearest neighbor interpolation keeps the edges of the cells sharp
+func scaleFrame(i image.Image, scale float64) *image.NRGBA {
+	bounds := i.Bounds()
+	width := int(math.Max(1, math.Round(float64(bounds.Dx())*scale)))
+	height := int(math.Max(1, math.Round(float64(bounds.Dy())*scale)))
+
+	frame := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy := bounds.Min.Y + y*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			sx := bounds.Min.X + x*bounds.Dx()/width
+			frame.SetNRGBA(x, y, color.NRGBAModel.Convert(i.At(sx, sy)).(color.NRGBA))
+		}
+	}
+
+	return frame
+}
+
+// runAnimate builds the time-lapse of a previous run from the snapshots it saved, in chronological order.
+// The best solution, if saved, is held as the final frame
+func runAnimate(imageName string, numSeeds int, outputPath string, config AnimationConfig) error {
+	prefix := fmt.Sprintf("./res/%s_%d-seeds_", imageName, numSeeds)
+
+	// the snapshots are named after the seconds elapsed since the beginning of the simulation
+	paths, err := filepath.Glob(prefix + "*.png")
+	if err != nil {
+		return err
+	}
+	type snapshot struct {
+		path    string
+		elapsed int
+	}
+	snapshots := []snapshot{}
+	for _, path := range paths {
+		elapsed, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), filepath.Base(prefix)), ".png"))
+		if err == nil {
+			snapshots = append(snapshots, snapshot{path: path, elapsed: elapsed})
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].elapsed < snapshots[j].elapsed })
+
+	frames := []string{}
+	for _, s := range snapshots {
+		frames = append(frames, s.path)
+	}
+	if _, err := os.Stat(prefix + "best.png"); err == nil {
+		frames = append(frames, prefix+"best.png")
+	}
+	if len(frames) == 0 {
+		return fmt.Errorf("No snapshots found for the target image '%s' with %d seeds", imageName, numSeeds)
+	}
+
+	animation, err := NewAnimationWriter(outputPath, config)
+	if err != nil {
+		return err
+	}
+	for i, path := range frames {
+		frame, err := decodeImage(path)
+		if err != nil {
+			animation.Close()
+			return err
+		}
+
+		duration := config.frameDuration()
+		if i == len(frames)-1 {
+			duration = config.finalFrameDuration()
+		}
+		if err := animation.AddFrame(frame, duration); err != nil {
+			animation.Close()
+			return err
+		}
+	}
+
+	return animation.Close()
+}
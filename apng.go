@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// apngWriter writes an animated PNG (https://wiki.mozilla.org/APNG_Specification), with 8-bit RGBA frames.
+//
+// The number of frames is only known once the animation is over, so the animation control chunk
+// is written with no frames at the beginning of the file, and rewritten when the file is closed
+type apngWriter struct {
+	file     *os.File
+	out      *bufio.Writer
+	config   AnimationConfig
+	width    int
+	height   int
+	frames   int    // number of frames written so far
+	sequence uint32 // sequence number of the next frame control or frame data chunk
+}
+
+// apngSignature is the signature at the beginning of every PNG file
+const apngSignature = "\x89PNG\r\n\x1a\n"
+
+// AddFrame appends a frame to the APNG, writing the header of the file along with the first one
+func (a *apngWriter) AddFrame(i image.Image, duration time.Duration) error {
+	frame := scaleFrame(i, a.config.Scale)
+	if a.out == nil {
+		a.out = bufio.NewWriter(a.file)
+		a.width, a.height = frame.Rect.Dx(), frame.Rect.Dy()
+		a.writeHeader()
+	} else if frame.Rect.Dx() != a.width || frame.Rect.Dy() != a.height {
+		return errors.New("All the frames of the animation must have the same size")
+	}
+
+	// frame control: the frames cover the whole canvas, replacing the previous ones
+	delayNum, delayDen := apngDelay(duration)
+	control := make([]byte, 26)
+	binary.BigEndian.PutUint32(control[0:], a.sequence)
+	binary.BigEndian.PutUint32(control[4:], uint32(a.width))
+	binary.BigEndian.PutUint32(control[8:], uint32(a.height))
+	binary.BigEndian.PutUint16(control[20:], delayNum)
+	binary.BigEndian.PutUint16(control[22:], delayDen)
+	writePNGChunk(a.out, "fcTL", control)
+	a.sequence++
+
+	data, err := compressPNGFrame(frame)
+	if err != nil {
+		return err
+	}
+
+	// the first frame is the default image of the file, shown by the viewers not supporting the animations
+	if a.frames == 0 {
+		writePNGChunk(a.out, "IDAT", data)
+	} else {
+		sequence := make([]byte, 4)
+		binary.BigEndian.PutUint32(sequence, a.sequence)
+		writePNGChunk(a.out, "fdAT", append(sequence, data...))
+		a.sequence++
+	}
+	a.frames++
+
+	return nil
+}
+
+// writeHeader writes the signature, the image header and the animation control chunk of the APNG
+func (a *apngWriter) writeHeader() {
+	a.out.WriteString(apngSignature)
+
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header[0:], uint32(a.width))
+	binary.BigEndian.PutUint32(header[4:], uint32(a.height))
+	header[8] = 8 // bit depth
+	header[9] = 6 // truecolor with alpha
+	writePNGChunk(a.out, "IHDR", header)
+
+	writePNGChunk(a.out, "acTL", a.animationControl())
+}
+
+// animationControl returns the data of the animation control chunk, with the number of frames written so far
+func (a *apngWriter) animationControl() []byte {
+	control := make([]byte, 8)
+	binary.BigEndian.PutUint32(control[0:], uint32(a.frames))
+	binary.BigEndian.PutUint32(control[4:], uint32(a.config.Loops))
+	return control
+}
+
+// Close writes the trailer of the APNG, rewrites its animation control chunk with the number of frames, and closes its file
+func (a *apngWriter) Close() error {
+	if a.out == nil {
+		return a.file.Close()
+	}
+
+	writePNGChunk(a.out, "IEND", nil)
+	err := a.out.Flush()
+
+	// the animation control chunk follows the signature and the image header (8 + 25 bytes)
+	if err == nil {
+		_, err = a.file.Seek(int64(len(apngSignature))+25, io.SeekStart)
+	}
+	if err == nil {
+		out := bufio.NewWriter(a.file)
+		writePNGChunk(out, "acTL", a.animationControl())
+		err = out.Flush()
+	}
+
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// apngDelay returns the fraction of a second a frame is shown for, with the finest denominator that fits its duration
+func apngDelay(duration time.Duration) (uint16, uint16) {
+	for _, den := range []time.Duration{1000, 100, 10, 1} {
+		num := math.Round(float64(duration) * float64(den) / float64(time.Second))
+		if num <= math.MaxUint16 {
+			return uint16(num), uint16(den)
+		}
+	}
+	return math.MaxUint16, 1
+}
+
+// writePNGChunk writes a chunk of a PNG file, with its length and its checksum
+func writePNGChunk(w io.Writer, chunkType string, data []byte) {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	copy(header[4:], chunkType)
+	w.Write(header)
+	w.Write(data)
+
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[4:])
+	checksum.Write(data)
+	binary.Write(w, binary.BigEndian, checksum.Sum32())
+}
+
+// compressPNGFrame filters and compresses the rows of a frame, as the data of a PNG image.
+//
+// Each row gets the filter whose output has the smallest sum of absolute values, the usual heuristic of the PNG encoders
+func compressPNGFrame(frame *image.NRGBA) ([]byte, error) {
+	var buffer bytes.Buffer
+	compressor := zlib.NewWriter(&buffer)
+
+	rowLength := frame.Rect.Dx() * 4
+	previous := make([]byte, rowLength)
+	candidates := [5][]byte{}
+	for f := range candidates {
+		candidates[f] = make([]byte, rowLength+1)
+		candidates[f][0] = byte(f)
+	}
+
+	for y := 0; y < frame.Rect.Dy(); y++ {
+		row := frame.Pix[y*frame.Stride : y*frame.Stride+rowLength]
+
+		best, bestScore := 0, math.MaxInt
+		for f := range candidates {
+			filtered := candidates[f][1:]
+			score := 0
+			for x := range row {
+				var left, upLeft byte
+				if x >= 4 {
+					left, upLeft = row[x-4], previous[x-4]
+				}
+				up := previous[x]
+
+				switch f {
+				case 0: // none
+					filtered[x] = row[x]
+				case 1: // sub
+					filtered[x] = row[x] - left
+				case 2: // up
+					filtered[x] = row[x] - up
+				case 3: // average
+					filtered[x] = row[x] - byte((int(left)+int(up))/2)
+				case 4: // paeth
+					filtered[x] = row[x] - paethPredictor(left, up, upLeft)
+				}
+				score += abs(int(int8(filtered[x])))
+			}
+			if score < bestScore {
+				best, bestScore = f, score
+			}
+		}
+
+		if _, err := compressor.Write(candidates[best]); err != nil {
+			return nil, err
+		}
+		copy(previous, row)
+	}
+
+	if err := compressor.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// paethPredictor returns the neighbor of a byte closest to the linear prediction from the left, upper and upper left ones
+func paethPredictor(left byte, up byte, upLeft byte) byte {
+	p := int(left) + int(up) - int(upLeft)
+	pa, pb, pc := abs(p-int(left)), abs(p-int(up)), abs(p-int(upLeft))
+	if pa <= pb && pa <= pc {
+		return left
+	}
+	if pb <= pc {
+		return up
+	}
+	return upLeft
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// aviQuality is the quality of the JPEG frames of the AVI videos
+const aviQuality = 90
+
+// aviHeaderSize is the size of the headers of the AVI file, up to the beginning of the frames
+const aviHeaderSize = 224
+
+// aviWriter writes an AVI video (https://learn.microsoft.com/en-us/windows/win32/directshow/avi-riff-file-reference)
+// whose frames are JPEG images (MJPEG), at a constant frame rate: the frames shown for longer are repeated.
+//
+// The sizes and the number of frames are only known once the video is over, so the headers are written empty
+// at the beginning of the file, and rewritten when the file is closed. The videos have no transparency and cannot loop
+type aviWriter struct {
+	file      *os.File
+	out       *bufio.Writer
+	config    AnimationConfig
+	width     int
+	height    int
+	index     []aviIndexEntry // position and size of each frame, for the index at the end of the file
+	moviSize  int             // size of the frames written so far, with their chunk headers
+	maxFrame  int             // size of the largest frame
+	remainder float64         // fraction of a frame not shown yet, to keep the durations of the frames on track
+}
+
+// aviIndexEntry is an entry of the index of the frames of an AVI file
+type aviIndexEntry struct {
+	offset int // offset of the chunk of the frame, from the beginning of the frames list
+	size   int // size of the frame
+}
+
+// AddFrame appends a frame to the AVI, as many times as needed to show it for the given time (at least once).
+// The headers of the file are written along with the first frame
+func (a *aviWriter) AddFrame(i image.Image, duration time.Duration) error {
+	frame := scaleFrame(i, a.config.Scale)
+	if a.out == nil {
+		a.out = bufio.NewWriter(a.file)
+		a.width, a.height = frame.Rect.Dx(), frame.Rect.Dy()
+		a.writeHeader()
+	} else if frame.Rect.Dx() != a.width || frame.Rect.Dy() != a.height {
+		return errors.New("All the frames of the animation must have the same size")
+	}
+
+	var buffer bytes.Buffer
+	if err := jpeg.Encode(&buffer, frame, &jpeg.Options{Quality: aviQuality}); err != nil {
+		return err
+	}
+	data := buffer.Bytes()
+	if len(data) > a.maxFrame {
+		a.maxFrame = len(data)
+	}
+
+	repeats := duration.Seconds()*a.config.FrameRate + a.remainder
+	count := int(math.Max(1, math.Round(repeats)))
+	a.remainder = repeats - float64(count)
+
+	for r := 0; r < count; r++ {
+		// the offsets of the index start from the type of the frames list, that precedes the frames
+		a.index = append(a.index, aviIndexEntry{offset: 4 + a.moviSize, size: len(data)})
+		a.out.WriteString("00dc")
+		binary.Write(a.out, binary.LittleEndian, uint32(len(data)))
+		a.out.Write(data)
+		a.moviSize += 8 + len(data)
+
+		// the chunks are aligned to 2 bytes
+		if len(data)%2 == 1 {
+			a.out.WriteByte(0)
+			a.moviSize++
+		}
+	}
+
+	return nil
+}
+
+// writeHeader writes the headers of the AVI file, with the frames written so far
+func (a *aviWriter) writeHeader() {
+	le := func(values ...interface{}) {
+		for _, v := range values {
+			binary.Write(a.out, binary.LittleEndian, v)
+		}
+	}
+	frames := uint32(len(a.index))
+	bufferSize := uint32(a.maxFrame + 8)
+	microsecondsPerFrame := uint32(math.Round(1e6 / a.config.FrameRate))
+	rate := uint32(math.Round(a.config.FrameRate * 1000))
+
+	// the size of the file excludes the header of its chunk, and the frames are followed by their index
+	a.out.WriteString("RIFF")
+	le(uint32(aviHeaderSize - 8 + a.moviSize + 8 + 16*len(a.index)))
+	a.out.WriteString("AVI ")
+
+	// headers list
+	a.out.WriteString("LIST")
+	le(uint32(192))
+	a.out.WriteString("hdrl")
+
+	// main header: frame rate, flags (the file has an index), number of frames and streams, size of the buffers and of the frames
+	a.out.WriteString("avih")
+	le(uint32(56), microsecondsPerFrame, uint32(float64(bufferSize)*a.config.FrameRate), uint32(0), uint32(0x10), frames, uint32(0), uint32(1), bufferSize)
+	le(uint32(a.width), uint32(a.height), [4]uint32{})
+
+	// stream list, with the header and the format of the video stream
+	a.out.WriteString("LIST")
+	le(uint32(116))
+	a.out.WriteString("strl")
+
+	a.out.WriteString("strh")
+	le(uint32(56))
+	a.out.WriteString("vidsMJPG")
+	le(uint32(0), uint16(0), uint16(0), uint32(0), uint32(1000), rate, uint32(0), frames, bufferSize, int32(-1), uint32(0))
+	le([4]int16{0, 0, int16(a.width), int16(a.height)})
+
+	a.out.WriteString("strf")
+	le(uint32(40), uint32(40), int32(a.width), int32(a.height), uint16(1), uint16(24))
+	a.out.WriteString("MJPG")
+	le(uint32(a.width*a.height*3), [4]int32{})
+
+	// frames list
+	a.out.WriteString("LIST")
+	le(uint32(4 + a.moviSize))
+	a.out.WriteString("movi")
+}
+
+// Close writes the index of the frames at the end of the AVI, rewrites its headers with the final sizes, and closes its file
+func (a *aviWriter) Close() error {
+	if a.out == nil {
+		return a.file.Close()
+	}
+
+	// index of the frames, all of them key frames
+	a.out.WriteString("idx1")
+	binary.Write(a.out, binary.LittleEndian, uint32(16*len(a.index)))
+	for _, entry := range a.index {
+		a.out.WriteString("00dc")
+		binary.Write(a.out, binary.LittleEndian, []uint32{0x10, uint32(entry.offset), uint32(entry.size)})
+	}
+	err := a.out.Flush()
+
+	if err == nil {
+		_, err = a.file.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		a.out = bufio.NewWriter(a.file)
+		a.writeHeader()
+		err = a.out.Flush()
+	}
+
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -1,10 +1,13 @@
+//go:build !headless
+
 package main
 
 import (
+	"context"
 	"errors"
-	"fmt"
-	"image/png"
-	"os"
+	"image"
+	"image/draw"
+	"sync/atomic"
 	"time"
 
 	ebiten "github.com/hajimehoshi/ebiten/v2"
@@ -14,119 +17,124 @@ import (
 // SimulationCompleted is the error returned when the simulation ends by timeout
 var SimulationCompleted = errors.New("Simulation completed")
 
-// Canvas handles the canvas visualization
+// bestRefreshInterval is how often the best solution gets re-rendered while it is being displayed
+const bestRefreshInterval = 1 * time.Second
+
+// Canvas handles the canvas visualization.
+//
+// The canvas is only a viewer of the simulation: the annealing runs at full speed in its own goroutine,
+// and the canvas samples its current (or best) solution at display rate
 type Canvas struct {
-	imageName string
-	numSeeds  int
 
 	// resolution of the canvas
 	width  int
 	height int
 
-	gameRunning bool
-
 	// simulated annealing info
 	simulatedAnnealing SimulatedAnnealingEngine
-	simulationDuration time.Duration
-	simulationStart    time.Time
+	paused             atomic.Bool // suspends the iterations of the simulation goroutine
 
-	// snapshots logic timers
-	lastSnapshot      time.Time
-	snapshotsInterval time.Duration
+	// simulation goroutine lifecycle
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the simulation goroutine returns
+	result error         // outcome of the simulation goroutine, readable once done is closed
+
+	// rendering of the best solution
+	showBest        bool
+	bestPixels      []byte
+	lastBestRefresh time.Time
 }
 
-// NewCanvas creates a canvas with the simulated annealing ready to start
+// NewCanvas creates a canvas and starts the simulated annealing in the background
 func NewCanvas(
-	imageName string,
-	numSeeds int,
 	width int,
 	height int,
 	simulatedAnnealing SimulatedAnnealingEngine,
 	simulationDuration time.Duration,
-	snapshotsInterval time.Duration,
+	snapshots *Snapshotter,
 ) (*Canvas, error) {
 
+	ctx, cancel := context.WithCancel(context.Background())
 	g := &Canvas{
-		imageName:          imageName,
-		numSeeds:           numSeeds,
 		width:              width,
 		height:             height,
-		gameRunning:        true,
 		simulatedAnnealing: simulatedAnnealing,
-		simulationDuration: simulationDuration,
-		snapshotsInterval:  snapshotsInterval,
-		simulationStart:    time.Now(),
-		lastSnapshot:       time.Now(),
+		cancel:             cancel,
+		done:               make(chan struct{}),
 	}
+
+	// run the simulation independently from the game loop
+	go func() {
+		defer close(g.done)
+		g.result = runSimulation(
+			ctx,
+			simulatedAnnealing,
+			simulationDuration,
+			snapshots,
+			&g.paused,
+		)
+	}()
+
 	return g, nil
 }
 
-// Update computes a new frame
+// Stop terminates the simulation goroutine and waits for it to return
+func (g *Canvas) Stop() error {
+	g.cancel()
+	<-g.done
+	return g.result
+}
+
+// Update handles the user input, and ends the game once the simulation is over
 func (g *Canvas) Update() error {
 
-	// end the simulation if the timeout has been reached
-	if time.Since(g.simulationStart) > g.simulationDuration {
+	// end the game if the simulation is over (either by timeout or by error)
+	select {
+	case <-g.done:
+		if g.result != nil {
+			return g.result
+		}
 		return SimulationCompleted
+	default:
 	}
 
 	// intercept the Space key and start/stop the execution
 	if inpututil.IsKeyJustPressed(ebiten.KeySpace) {
-		g.gameRunning = !g.gameRunning
-	}
-	if !g.gameRunning {
-		return nil
+		g.paused.Store(!g.paused.Load())
 	}
 
-	// take periodic snapshots of the canvas
-	err := g.savePNG()
-	if err != nil {
-		panic(err)
+	// intercept the B key and switch between the current and the best solution
+	if inpututil.IsKeyJustPressed(ebiten.KeyB) {
+		g.showBest = !g.showBest
+		g.bestPixels = nil
 	}
 
-	// compute the next simulated annealing iteration
-	return g.simulatedAnnealing.Iterate()
+	return nil
 }
 
-// Draw writes the computed frame as a byte sequence
+// Draw writes a sample of the solution as a byte sequence
 func (g *Canvas) Draw(screen *ebiten.Image) {
-	screen.WritePixels(g.simulatedAnnealing.ToPixels())
+	if !g.showBest {
+		screen.WritePixels(g.simulatedAnnealing.ToPixels())
+		return
+	}
+
+	// rendering the best solution requires a full tessellation, so it is refreshed only periodically
+	if g.bestPixels == nil || time.Since(g.lastBestRefresh) > bestRefreshInterval {
+		i, err := g.simulatedAnnealing.GetBestSnapshot()
+		if err != nil {
+			panic(err)
+		}
+
+		rgba := image.NewRGBA(image.Rect(0, 0, g.width, g.height))
+		draw.Draw(rgba, rgba.Bounds(), i, i.Bounds().Min, draw.Src)
+		g.bestPixels = rgba.Pix
+		g.lastBestRefresh = time.Now()
+	}
+	screen.WritePixels(g.bestPixels)
 }
 
 // Layout returns the resolution of the canvas
 func (g *Canvas) Layout(outsideWidth, outsideHeight int) (screenWidth, screenHeight int) {
 	return g.width, g.height
 }
-
-// savePNG saves periodic snapshots of the canvas
-func (g *Canvas) savePNG() error {
-
-	// skip the saving if the last snapshot is still too recent
-	if !(time.Since(g.lastSnapshot) > g.snapshotsInterval) {
-		return nil
-	}
-
-	// get the image data
-	i := g.simulatedAnnealing.GetSnapshot()
-
-	// create a png file for the snapshot
-	pngFile, err := os.Create(
-		fmt.Sprintf("./res/%s_%d-seeds_%d.png",
-			g.imageName,
-			g.numSeeds,
-			int(time.Since(g.simulationStart).Seconds()),
-		))
-	if err != nil {
-		return err
-	}
-
-	// save the data into the png file
-	err = png.Encode(pngFile, i)
-	if err != nil {
-		return err
-	}
-
-	// reset the snapshot interval timer
-	g.lastSnapshot = time.Now()
-
-	return nil
-}
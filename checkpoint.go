@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// checkpointVersion is the version of the format of the checkpoints, increased at every incompatible change of the format
+const checkpointVersion = 1
+
+// Checkpoint is the persisted state of a run of the annealing, from which the run can be resumed.
+//
+// Besides the state of the engine, it contains all the parameters of the run and a hash of the target image,
+// so the run is resumed with the same parameters and against the same target
+type Checkpoint struct {
+	Version    int            `json:"version"`
+	TargetHash string         `json:"targetHash"` // SHA-256 of the size and of the pixels of the target image
+	SavedAt    time.Time      `json:"savedAt"`
+	Config     RunConfig      `json:"config"`
+	State      AnnealingState `json:"state"`
+}
+
+// AnnealingState is the state of the annealing engine, saved in the checkpoints.
+// The cost of the current solution is not saved, since it is recomputed from its seeds
+type AnnealingState struct {
+	Elapsed            time.Duration   `json:"elapsed"` // time elapsed since the beginning of the simulation, in nanoseconds
+	Iterations         int             `json:"iterations"`
+	InitialTemperature float64         `json:"initialTemperature"`         // initial control temperature, possibly calibrated
+	FinalTemperature   float64         `json:"finalTemperature,omitempty"` // final control temperature, if provided (rescaled along with the initial one by the pyramid)
+	Seeds              []SolutionSeed  `json:"seeds"`                      // seeds of the current solution
+	BestSeeds          []SolutionSeed  `json:"bestSeeds"`                  // seeds of the best solution found so far
+	Diagram            DiagramState    `json:"diagram"`                    // diagram of the current solution
+	BestCost           float64         `json:"bestCost"`
+	Cooling            ScheduleState   `json:"cooling"`
+	Acceptance         AcceptanceState `json:"acceptance"`
+	Random             RandomState     `json:"random"`              // state of the random numbers of the annealing
+	VoronoiRandom      RandomState     `json:"voronoiRandom"`       // state of the random numbers of the perturbations
+	Tempering          *TemperingState `json:"tempering,omitempty"` // state of the other replicas, with parallel tempering
+}
+
+// DiagramState is the diagram computed from the seeds of a solution, saved in the checkpoints.
+// The tessellation from scratch may assign a few pixels differently than the incremental one,
+// so the diagram of a resumed run is restored rather than recomputed
+type DiagramState struct {
+	Owners []int        // index of the seed owning each pixel
+	Bounds []cellBounds // bounding box of the cell of each seed
+}
+
+// diagramStateJSON is the persisted form of a diagram.
+// The owners are packed as 32-bit integers and compressed, since the cells are made of long runs of pixels with the same owner
+type diagramStateJSON struct {
+	Owners []byte   `json:"owners"`
+	Bounds [][4]int `json:"bounds"` // minX, minY, maxX, maxY
+}
+
+// MarshalJSON encodes the diagram in its persisted form
+func (d DiagramState) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	compressor := zlib.NewWriter(&buffer)
+	packed := make([]byte, 4*len(d.Owners))
+	for p, owner := range d.Owners {
+		binary.LittleEndian.PutUint32(packed[4*p:], uint32(int32(owner)))
+	}
+	if _, err := compressor.Write(packed); err != nil {
+		return nil, err
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, err
+	}
+
+	persisted := diagramStateJSON{Owners: buffer.Bytes(), Bounds: make([][4]int, len(d.Bounds))}
+	for i, b := range d.Bounds {
+		persisted.Bounds[i] = [4]int{b.minX, b.minY, b.maxX, b.maxY}
+	}
+	return json.Marshal(persisted)
+}
+
+// UnmarshalJSON decodes the diagram from its persisted form
+func (d *DiagramState) UnmarshalJSON(data []byte) error {
+	var persisted diagramStateJSON
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return err
+	}
+
+	decompressor, err := zlib.NewReader(bytes.NewReader(persisted.Owners))
+	if err != nil {
+		return err
+	}
+	packed, err := io.ReadAll(decompressor)
+	if err != nil {
+		return err
+	}
+	if len(packed)%4 != 0 {
+		return errors.New("the owners of the diagram are truncated")
+	}
+
+	d.Owners = make([]int, len(packed)/4)
+	for p := range d.Owners {
+		d.Owners[p] = int(int32(binary.LittleEndian.Uint32(packed[4*p:])))
+	}
+	d.Bounds = make([]cellBounds, len(persisted.Bounds))
+	for i, b := range persisted.Bounds {
+		d.Bounds[i] = cellBounds{minX: b[0], minY: b[1], maxX: b[2], maxY: b[3]}
+	}
+	return nil
+}
+
+// checkpointPath returns the path of the checkpoint of the run with the given target image and number of seeds
+func checkpointPath(imageName string, numSeeds int) string {
+	return fmt.Sprintf("./res/%s_%d-seeds_checkpoint.json", imageName, numSeeds)
+}
+
+// targetHash returns the SHA-256 of the size and of the pixels of the target image, as a hex string.
+// The decoded pixels are hashed rather than the file, so the hash doesn't depend on how the image is encoded
+func targetHash(targetImage TargetImage) string {
+	hash := sha256.New()
+	binary.Write(hash, binary.LittleEndian, []uint32{uint32(targetImage.Width), uint32(targetImage.Height)})
+	hash.Write(targetImage.Bytes)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// CheckTarget checks that the checkpoint has been taken on a run against the given target image
+func (c Checkpoint) CheckTarget(targetImage TargetImage) error {
+	if c.TargetHash != targetHash(targetImage) {
+		return fmt.Errorf("The target image '%s' differs from the one of the checkpointed run", c.Config.TargetImage)
+	}
+	return nil
+}
+
+// saveCheckpoint encodes the checkpoint into a json file at the given path.
+// The file is written next to the destination and then renamed, so the previous checkpoint survives a crash during the writing
+func saveCheckpoint(path string, checkpoint Checkpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	temporaryPath := path + ".tmp"
+	if err := os.WriteFile(temporaryPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, path)
+}
+
+// loadCheckpoint reads the checkpoint stored in the json file at the given path, checking its version and its seeds
+func loadCheckpoint(path string) (Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return Checkpoint{}, fmt.Errorf("Invalid checkpoint file '%s': %w", path, err)
+	}
+	if checkpoint.Version != checkpointVersion {
+		return Checkpoint{}, fmt.Errorf("Unsupported checkpoint file '%s': version %d, expected %d", path, checkpoint.Version, checkpointVersion)
+	}
+
+	state := checkpoint.State
+	numSeeds := checkpoint.Config.NumSeeds
+	if len(state.Seeds) != numSeeds || len(state.BestSeeds) != numSeeds {
+		return Checkpoint{}, fmt.Errorf("Invalid checkpoint file '%s': expected %d seeds", path, numSeeds)
+	}
+	if state.InitialTemperature <= 0 {
+		return Checkpoint{}, fmt.Errorf("Invalid checkpoint file '%s': the initial temperature must be positive", path)
+	}
+	if state.Random == (RandomState{}) || state.VoronoiRandom == (RandomState{}) {
+		return Checkpoint{}, fmt.Errorf("Invalid checkpoint file '%s': missing random state", path)
+	}
+	if replicas := checkpoint.Config.Tempering.Replicas; replicas > 1 {
+		if state.Tempering == nil || len(state.Tempering.Replicas) != replicas-1 {
+			return Checkpoint{}, fmt.Errorf("Invalid checkpoint file '%s': expected %d replicas", path, replicas)
+		}
+		for _, replica := range state.Tempering.Replicas {
+			if len(replica.Seeds) != numSeeds || len(replica.BestSeeds) != numSeeds {
+				return Checkpoint{}, fmt.Errorf("Invalid checkpoint file '%s': expected %d seeds", path, numSeeds)
+			}
+		}
+	}
+
+	return checkpoint, nil
+}
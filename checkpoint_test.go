@@ -0,0 +1,99 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	tests := []struct {
+		name        string
+		checkpoint  int // iteration of the checkpoint the run is resumed from
+		cooling     CoolingConfig
+		acceptance  AcceptanceConfig
+		colors      ColorConfig
+		transparent bool
+	}{
+		{
+			"exponential, metropolis", 150,
+			CoolingConfig{Schedule: "exponential", InitialAcceptance: 0.5, CalibrationSamples: 50, FinalTemperature: 1e-3},
+			AcceptanceConfig{Criterion: "metropolis"},
+			ColorConfig{Estimator: "random"}, false,
+		},
+		{
+			"adaptive, late acceptance, recolored", 97,
+			CoolingConfig{Schedule: "adaptive", InitialAcceptance: 0.5, CalibrationSamples: 50, TargetAcceptance: 0.44},
+			AcceptanceConfig{Criterion: "lateAcceptance", HistoryLength: 50},
+			ColorConfig{Estimator: "mean", RecolorInterval: 10}, false,
+		},
+		{
+			"exponential, metropolis, mean colors, transparent", 150,
+			CoolingConfig{Schedule: "exponential", InitialAcceptance: 0.5, CalibrationSamples: 50, FinalTemperature: 1e-3},
+			AcceptanceConfig{Criterion: "metropolis"},
+			ColorConfig{Estimator: "mean"}, true,
+		},
+		{
+			"logarithmic, great deluge, at the first iteration", 0,
+			CoolingConfig{Schedule: "logarithmic", InitialAcceptance: 0.5, CalibrationSamples: 50},
+			AcceptanceConfig{Criterion: "greatDeluge", RainSpeed: 1e-4},
+			ColorConfig{Estimator: "median"}, true,
+		},
+		{
+			"linear, record-to-record, at the last iteration", 299,
+			CoolingConfig{Schedule: "linear", InitialAcceptance: 0.5, CalibrationSamples: 50},
+			AcceptanceConfig{Criterion: "recordToRecord", Deviation: 0.01},
+			ColorConfig{Estimator: "random"}, false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := testTarget(64, 48, test.transparent)
+			config := testRunConfig()
+			config.Iterations = 300
+			config.Cooling = test.cooling
+			config.Acceptance = test.acceptance
+			config.Colors = test.colors
+
+			// the uninterrupted run goes through all its iterations
+			uninterrupted := newTestAnnealing(t, target, config)
+			iterate(t, uninterrupted, config.Iterations)
+
+			// the interrupted one saves a checkpoint along the way
+			interrupted := newTestAnnealing(t, target, config)
+			iterate(t, interrupted, test.checkpoint)
+			path := filepath.Join(t.TempDir(), "checkpoint.json")
+			if err := saveCheckpoint(path, Checkpoint{
+				Version:    checkpointVersion,
+				TargetHash: targetHash(target),
+				Config:     config,
+				State:      interrupted.GetState(),
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// and the resumed one continues from it with the parameters of the run, as the resume command does
+			checkpoint, err := loadCheckpoint(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checkpoint.CheckTarget(target); err != nil {
+				t.Fatal(err)
+			}
+			resumedConfig := checkpoint.Config
+			resumedConfig.Cooling.InitialTemperature = checkpoint.State.InitialTemperature
+			resumed := newTestAnnealing(t, target, resumedConfig)
+			if err := resumed.Restore(checkpoint.State); err != nil {
+				t.Fatal(err)
+			}
+			for !resumed.Completed() {
+				iterate(t, resumed, 1)
+			}
+
+			if resumed.iterations != uninterrupted.iterations {
+				t.Fatalf("resumed run stopped at iteration %d, expected %d", resumed.iterations, uninterrupted.iterations)
+			}
+			assertSameAnnealing(t, resumed, uninterrupted)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+)
+
+// ColorConfig contains the parameters driving the colors of the cells
+type ColorConfig struct {
+	Estimator       string // how the colors of the cells are chosen: random (perturbated by the annealing), mean or median
+	RecolorInterval int    // every how many iterations the cells get recolored. If not positive, they are recolored after every move
+}
+
+// colorHistogram counts the values of each RGBA channel of a set of pixels, each one with its own weight
+type colorHistogram struct {
+	count int
+	bins  [4][256]int
+}
+
+// reset empties the histogram
+func (h *colorHistogram) reset() {
+	*h = colorHistogram{}
+}
+
+// add counts the RGBA values of a pixel, as many times as its weight
+func (h *colorHistogram) add(rgba []byte, weight int) {
+	h.count += weight
+	for c := 0; c < 4; c++ {
+		h.bins[c][rgba[c]] += weight
+	}
+}
+
+// ColorEstimator computes the flat color that best approximates a set of pixels.
+//
+// Given the positions of the seeds, the best color of each cell only depends on the target pixels it covers,
+// so it can be computed directly instead of being searched by the annealing
+type ColorEstimator interface {
+	// Name returns the name of the estimator, as selected from the CLI
+	Name() string
+
+	// Estimate returns the color for the pixels counted in the (non empty) histogram
+	Estimate(h *colorHistogram) color.RGBA
+}
+
+// NewColorEstimator creates the color estimator with the given name
+func NewColorEstimator(name string) (ColorEstimator, error) {
+	switch name {
+	case "mean":
+		return &meanEstimator{}, nil
+	case "median":
+		return &medianEstimator{}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown cell colors estimator '%s'", name)
+}
+
+// meanEstimator uses the per-channel mean of the pixels, that minimizes the squared (L2) distance from them
+type meanEstimator struct{}
+
+func (e *meanEstimator) Name() string { return "mean" }
+
+func (e *meanEstimator) Estimate(h *colorHistogram) color.RGBA {
+	var channels [4]uint8
+	for c := range channels {
+		sum := 0
+		for value, n := range h.bins[c] {
+			sum += value * n
+		}
+		channels[c] = uint8((sum + h.count/2) / h.count)
+	}
+
+	return color.RGBA{R: channels[0], G: channels[1], B: channels[2], A: channels[3]}
+}
+
+// medianEstimator uses the per-channel median of the pixels, that minimizes the absolute (L1) distance from them
+type medianEstimator struct{}
+
+func (e *medianEstimator) Name() string { return "median" }
+
+func (e *medianEstimator) Estimate(h *colorHistogram) color.RGBA {
+	var channels [4]uint8
+	for c := range channels {
+		seen := 0
+		for value, n := range h.bins[c] {
+			seen += n
+			if 2*seen > h.count {
+				channels[c] = uint8(value)
+				break
+			}
+		}
+	}
+
+	return color.RGBA{R: channels[0], G: channels[1], B: channels[2], A: channels[3]}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// defaultCoolingRatio is the ratio between the initial and the final temperature, used when no final temperature is provided
+	defaultCoolingRatio = 1000.0
+
+	// adaptiveWindow is the number of iterations over which the adaptive schedule measures the acceptance rate
+	adaptiveWindow = 100
+
+	// adaptiveGain controls how aggressively the adaptive schedule corrects the temperature
+	adaptiveGain = 1.0
+
+	// logarithmicSteepness controls how quickly the logarithmic schedule drops at the beginning of the simulation
+	logarithmicSteepness = 10.0
+)
+
+// CoolingConfig contains the parameters of the cooling schedule of the annealing
+type CoolingConfig struct {
+	Schedule           string  // name of the cooling schedule (exponential, linear, logarithmic, adaptive)
+	InitialTemperature float64 // starting control temperature. If not positive, it is calibrated automatically
+	FinalTemperature   float64 // control temperature at the end of the simulation. If not positive, it is derived from the initial one
+	TargetAcceptance   float64 // acceptance rate targeted by the adaptive schedule
+	InitialAcceptance  float64 // probability of accepting an average uphill move at the initial temperature, used by the calibration
+	CalibrationSamples int     // number of perturbations sampled by the calibration
+}
+
+// CoolingSchedule drives the control temperature of the annealing along the simulation
+type CoolingSchedule interface {
+	// Name returns the name of the schedule, as selected from the CLI
+	Name() string
+
+	// Temperature returns the current control temperature
+	Temperature() float64
+
+	// Update advances the schedule, given the progress of the simulation (in the interval [0,1])
+	// and whether the last iteration has been accepted
+	Update(progress float64, accepted bool)
+
+	// State returns the current state of the schedule, to be saved in the checkpoints
+	State() ScheduleState
+
+	// Restore brings the schedule back to a state saved in a checkpoint
+	Restore(state ScheduleState)
+
+	// Scale multiplies all the temperatures of the schedule by the given ratio, to carry it over to costs on a different scale
+	Scale(ratio float64)
+}
+
+// ScheduleState is the state of a cooling schedule, saved in the checkpoints
+type ScheduleState struct {
+	Temperature float64 `json:"temperature"`
+	Proposed    int     `json:"proposed,omitempty"` // iterations proposed in the current window of the adaptive schedule
+	Accepted    int     `json:"accepted,omitempty"` // iterations accepted in the current window of the adaptive schedule
+}
+
+// NewCoolingSchedule creates the cooling schedule with the given name, spanning from the initial to the final temperature
+func NewCoolingSchedule(
+	name string,
+	initialTemperature float64,
+	finalTemperature float64,
+	targetAcceptance float64,
+) (CoolingSchedule, error) {
+
+	if initialTemperature <= 0 {
+		return nil, fmt.Errorf("Initial temperature must be positive, got %g", initialTemperature)
+	}
+	if finalTemperature <= 0 {
+		finalTemperature = initialTemperature / defaultCoolingRatio
+	}
+
+	switch name {
+	case "exponential":
+		return &exponentialSchedule{
+			initial:     initialTemperature,
+			final:       finalTemperature,
+			temperature: initialTemperature,
+		}, nil
+	case "linear":
+		return &linearSchedule{
+			initial:     initialTemperature,
+			final:       finalTemperature,
+			temperature: initialTemperature,
+		}, nil
+	case "logarithmic":
+		return &logarithmicSchedule{
+			initial:     initialTemperature,
+			final:       finalTemperature,
+			temperature: initialTemperature,
+		}, nil
+	case "adaptive":
+		if targetAcceptance <= 0 || targetAcceptance >= 1 {
+			return nil, fmt.Errorf("Target acceptance rate must be in the interval (0,1), got %g", targetAcceptance)
+		}
+		return &adaptiveSchedule{
+			targetAcceptance: targetAcceptance,
+			temperature:      initialTemperature,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown cooling schedule '%s'", name)
+}
+
+// exponentialSchedule decreases the temperature geometrically, from the initial to the final value
+type exponentialSchedule struct {
+	initial     float64
+	final       float64
+	temperature float64
+}
+
+func (s *exponentialSchedule) Name() string                { return "exponential" }
+func (s *exponentialSchedule) Temperature() float64        { return s.temperature }
+func (s *exponentialSchedule) State() ScheduleState        { return ScheduleState{Temperature: s.temperature} }
+func (s *exponentialSchedule) Restore(state ScheduleState) { s.temperature = state.Temperature }
+
+func (s *exponentialSchedule) Scale(ratio float64) {
+	s.initial *= ratio
+	s.final *= ratio
+	s.temperature *= ratio
+}
+
+func (s *exponentialSchedule) Update(progress float64, accepted bool) {
+	s.temperature = s.initial * math.Pow(s.final/s.initial, progress)
+}
+
+// linearSchedule decreases the temperature linearly, from the initial to the final value
+type linearSchedule struct {
+	initial     float64
+	final       float64
+	temperature float64
+}
+
+func (s *linearSchedule) Name() string                { return "linear" }
+func (s *linearSchedule) Temperature() float64        { return s.temperature }
+func (s *linearSchedule) State() ScheduleState        { return ScheduleState{Temperature: s.temperature} }
+func (s *linearSchedule) Restore(state ScheduleState) { s.temperature = state.Temperature }
+
+func (s *linearSchedule) Scale(ratio float64) {
+	s.initial *= ratio
+	s.final *= ratio
+	s.temperature *= ratio
+}
+
+func (s *linearSchedule) Update(progress float64, accepted bool) {
+	s.temperature = s.initial + (s.final-s.initial)*progress
+}
+
+// logarithmicSchedule decreases the temperature as T0 / (1 + c*ln(1 + k*p)), where p is the progress,
+// k is the steepness of the curve and c is chosen so that the final value is reached at the end of the simulation.
+//
+// The temperature drops quickly at the beginning and then very slowly, like the classic T0/log(k) schedule
+type logarithmicSchedule struct {
+	initial     float64
+	final       float64
+	temperature float64
+}
+
+func (s *logarithmicSchedule) Name() string                { return "logarithmic" }
+func (s *logarithmicSchedule) Temperature() float64        { return s.temperature }
+func (s *logarithmicSchedule) State() ScheduleState        { return ScheduleState{Temperature: s.temperature} }
+func (s *logarithmicSchedule) Restore(state ScheduleState) { s.temperature = state.Temperature }
+
+func (s *logarithmicSchedule) Scale(ratio float64) {
+	s.initial *= ratio
+	s.final *= ratio
+	s.temperature *= ratio
+}
+
+func (s *logarithmicSchedule) Update(progress float64, accepted bool) {
+
+	// c = (T0/Tf - 1) / ln(1 + k), so that T = Tf at p = 1
+	c := (s.initial/s.final - 1) / math.Log1p(logarithmicSteepness)
+	if c <= 0 || progress <= 0 {
+		s.temperature = s.initial
+		return
+	}
+	s.temperature = s.initial / (1 + c*math.Log1p(logarithmicSteepness*progress))
+}
+
+// adaptiveSchedule adjusts the temperature to keep the acceptance rate close to a target value:
+// the temperature is raised when too few moves get accepted, and lowered when too many do
+type adaptiveSchedule struct {
+	targetAcceptance float64
+	temperature      float64
+
+	// acceptance tracking of the current window
+	proposed int
+	accepted int
+}
+
+func (s *adaptiveSchedule) Name() string         { return "adaptive" }
+func (s *adaptiveSchedule) Temperature() float64 { return s.temperature }
+
+func (s *adaptiveSchedule) State() ScheduleState {
+	return ScheduleState{Temperature: s.temperature, Proposed: s.proposed, Accepted: s.accepted}
+}
+
+func (s *adaptiveSchedule) Restore(state ScheduleState) {
+	s.temperature, s.proposed, s.accepted = state.Temperature, state.Proposed, state.Accepted
+}
+
+func (s *adaptiveSchedule) Scale(ratio float64) {
+	s.temperature *= ratio
+}
+
+func (s *adaptiveSchedule) Update(progress float64, accepted bool) {
+	s.proposed++
+	if accepted {
+		s.accepted++
+	}
+	if s.proposed < adaptiveWindow {
+		return
+	}
+
+	// correct the temperature proportionally to the distance from the target rate
+	rate := float64(s.accepted) / float64(s.proposed)
+	s.temperature *= math.Exp(adaptiveGain * (s.targetAcceptance - rate))
+
+	s.proposed = 0
+	s.accepted = 0
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+)
+
+// costScale is the fixed point scale of the heat of the cost functions measuring non integer distances.
+// Keeping the heat of the pixels integer, the incremental cost never drifts away from a full recomputation
+const costScale = 1 << 16
+
+// CostFunction measures how far the color of a pixel of the diagram is from the corresponding pixel of the target image.
+//
+// The distance of each pixel is its heat, and the cost of a solution is the total heat of its pixels,
+// normalized by the maximum heat of the image so that it lies in the interval [0,1]
+type CostFunction interface {
+	// Name returns the name of the cost function, as selected from the CLI
+	Name() string
+
+	// Heat returns the distance of a color from the target pixel p (in row-major order), as a non negative integer
+	Heat(p int, c color.RGBA) int
+
+	// MaxHeat returns the maximum heat of a single pixel
+	MaxHeat() int
+}
+
+// NewCostFunction creates the cost function with the given name, measuring the distance from the given target image
+func NewCostFunction(name string, target TargetImage) (CostFunction, error) {
+	switch name {
+	case "l1":
+		return &l1Cost{target: target.Bytes}, nil
+	case "l2":
+		return &l2Cost{target: target.Bytes}, nil
+	case "luma":
+		return newLumaCost(target), nil
+	case "ciede2000":
+		return newCIEDE2000Cost(target), nil
+	}
+
+	return nil, fmt.Errorf("Unknown cost function '%s'", name)
+}
+
+// l1Cost is the sum of the absolute differences of the RGB channels
+type l1Cost struct {
+	target []byte
+}
+
+func (f *l1Cost) Name() string { return "l1" }
+
+func (f *l1Cost) Heat(p int, c color.RGBA) int {
+	t := f.target[p*4 : p*4+3]
+	return abs(int(c.R)-int(t[0])) + abs(int(c.G)-int(t[1])) + abs(int(c.B)-int(t[2]))
+}
+
+func (f *l1Cost) MaxHeat() int { return 3 * 255 }
+
+// l2Cost is the sum of the squared differences of the RGB channels, so that the cost is the mean squared error
+type l2Cost struct {
+	target []byte
+}
+
+func (f *l2Cost) Name() string { return "l2" }
+
+func (f *l2Cost) Heat(p int, c color.RGBA) int {
+	t := f.target[p*4 : p*4+3]
+	r, g, b := int(c.R)-int(t[0]), int(c.G)-int(t[1]), int(c.B)-int(t[2])
+	return r*r + g*g + b*b
+}
+
+func (f *l2Cost) MaxHeat() int { return 3 * 255 * 255 }
+
+// lumaCost is the sum of the absolute differences of the YCbCr channels, with the luma counting twice as each chroma channel:
+// the eye is more sensitive to the changes of brightness than to the changes of hue
+type lumaCost struct {
+	target []color.YCbCr
+}
+
+// newLumaCost creates the luma cost function, converting the target image to YCbCr once and for all
+func newLumaCost(target TargetImage) *lumaCost {
+	f := &lumaCost{target: make([]color.YCbCr, target.Width*target.Height)}
+	for p := range f.target {
+		t := target.Bytes[p*4 : p*4+3]
+		y, cb, cr := color.RGBToYCbCr(t[0], t[1], t[2])
+		f.target[p] = color.YCbCr{Y: y, Cb: cb, Cr: cr}
+	}
+	return f
+}
+
+func (f *lumaCost) Name() string { return "luma" }
+
+func (f *lumaCost) Heat(p int, c color.RGBA) int {
+	y, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+	t := f.target[p]
+	return 2*abs(int(y)-int(t.Y)) + abs(int(cb)-int(t.Cb)) + abs(int(cr)-int(t.Cr))
+}
+
+func (f *lumaCost) MaxHeat() int { return 4 * 255 }
+
+// ciede2000Cost is the CIEDE2000 color difference (https://en.wikipedia.org/wiki/Color_difference#CIEDE2000)
+// between the colors in the CIELAB space, the closest to the perceived difference
+type ciede2000Cost struct {
+	target []labColor
+}
+
+// ciede2000Max is the upper bound of the CIEDE2000 difference between two sRGB colors
+// (the largest one, between a dark blue and a yellowish green, is about 119.5)
+const ciede2000Max = 120
+
+// newCIEDE2000Cost creates the CIEDE2000 cost function, converting the target image to CIELAB once and for all
+func newCIEDE2000Cost(target TargetImage) *ciede2000Cost {
+	f := &ciede2000Cost{target: make([]labColor, target.Width*target.Height)}
+	for p := range f.target {
+		t := target.Bytes[p*4 : p*4+3]
+		f.target[p] = rgbToLab(t[0], t[1], t[2])
+	}
+	return f
+}
+
+func (f *ciede2000Cost) Name() string { return "ciede2000" }
+
+func (f *ciede2000Cost) Heat(p int, c color.RGBA) int {
+	d := ciede2000(rgbToLab(c.R, c.G, c.B), f.target[p])
+	return int(math.Round(math.Min(d, ciede2000Max) * costScale))
+}
+
+func (f *ciede2000Cost) MaxHeat() int { return ciede2000Max * costScale }
+
+// labColor is a color in the CIELAB space
+type labColor struct {
+	L float64
+	A float64
+	B float64
+}
+
+// srgbToLinear maps the sRGB values to the linear light intensities
+var srgbToLinear = func() [256]float64 {
+	var table [256]float64
+	for i := range table {
+		v := float64(i) / 255
+		if v <= 0.04045 {
+			table[i] = v / 12.92
+		} else {
+			table[i] = math.Pow((v+0.055)/1.055, 2.4)
+		}
+	}
+	return table
+}()
+
+// rgbToLab converts an sRGB color to the CIELAB space, under the D65 illuminant
+func rgbToLab(r uint8, g uint8, b uint8) labColor {
+	lr, lg, lb := srgbToLinear[r], srgbToLinear[g], srgbToLinear[b]
+
+	// XYZ coordinates, relative to the white point
+	x := (0.4124564*lr + 0.3575761*lg + 0.1804375*lb) / 0.95047
+	y := 0.2126729*lr + 0.7151522*lg + 0.0721750*lb
+	z := (0.0193339*lr + 0.1191920*lg + 0.9503041*lb) / 1.08883
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+
+	return labColor{L: 116*fy - 16, A: 500 * (fx - fy), B: 200 * (fy - fz)}
+}
+
+// ciede2000 computes the CIEDE2000 difference between two colors, with unit weighting factors
+func ciede2000(c1 labColor, c2 labColor) float64 {
+	const pow25to7 = 6103515625.0 // 25^7
+	rad := math.Pi / 180
+
+	// adjust the a* axis, for the colors of low chroma
+	cBar := (math.Hypot(c1.A, c1.B) + math.Hypot(c2.A, c2.B)) / 2
+	cBar7 := math.Pow(cBar, 7)
+	g := 0.5 * (1 - math.Sqrt(cBar7/(cBar7+pow25to7)))
+	a1, a2 := (1+g)*c1.A, (1+g)*c2.A
+
+	chroma1, chroma2 := math.Hypot(a1, c1.B), math.Hypot(a2, c2.B)
+	hue := func(a float64, b float64) float64 {
+		if a == 0 && b == 0 {
+			return 0
+		}
+		h := math.Atan2(b, a) / rad
+		if h < 0 {
+			h += 360
+		}
+		return h
+	}
+	hue1, hue2 := hue(a1, c1.B), hue(a2, c2.B)
+
+	// differences of lightness, chroma and hue
+	deltaL := c2.L - c1.L
+	deltaC := chroma2 - chroma1
+	deltaHue := 0.0
+	if chroma1*chroma2 != 0 {
+		deltaHue = hue2 - hue1
+		if deltaHue > 180 {
+			deltaHue -= 360
+		} else if deltaHue < -180 {
+			deltaHue += 360
+		}
+	}
+	deltaH := 2 * math.Sqrt(chroma1*chroma2) * math.Sin(deltaHue*rad/2)
+
+	// mean values of lightness, chroma and hue
+	lBar := (c1.L + c2.L) / 2
+	chromaBar := (chroma1 + chroma2) / 2
+	hueBar := hue1 + hue2
+	if chroma1*chroma2 != 0 {
+		switch {
+		case math.Abs(hue1-hue2) <= 180:
+			hueBar /= 2
+		case hueBar < 360:
+			hueBar = (hueBar + 360) / 2
+		default:
+			hueBar = (hueBar - 360) / 2
+		}
+	}
+
+	// weighting functions and rotation term
+	t := 1 - 0.17*math.Cos((hueBar-30)*rad) + 0.24*math.Cos(2*hueBar*rad) + 0.32*math.Cos((3*hueBar+6)*rad) - 0.20*math.Cos((4*hueBar-63)*rad)
+	deltaTheta := 30 * math.Exp(-math.Pow((hueBar-275)/25, 2))
+	chromaBar7 := math.Pow(chromaBar, 7)
+	rc := 2 * math.Sqrt(chromaBar7/(chromaBar7+pow25to7))
+	sl := 1 + 0.015*(lBar-50)*(lBar-50)/math.Sqrt(20+(lBar-50)*(lBar-50))
+	sc := 1 + 0.045*chromaBar
+	sh := 1 + 0.015*chromaBar*t
+	rt := -math.Sin(2*deltaTheta*rad) * rc
+
+	l, c, h := deltaL/sl, deltaC/sc, deltaH/sh
+	return math.Sqrt(l*l + c*c + h*h + rt*c*h)
+}
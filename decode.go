@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// decodeImage reads the image at the given path, in any of the supported formats (JPG, PNG, GIF, BMP, TIFF and WebP),
+// and returns its 8-bit pixels with straight (non premultiplied) alpha.
+//
+// Only the first frame of the animated GIFs is read. The JPG photos are rotated and mirrored as stated by their EXIF orientation,
+// so that the pixels are laid out as they are displayed
+func decodeImage(path string) (*image.NRGBA, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	i, format, err := image.Decode(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		return nil, fmt.Errorf("Unsupported image '%s': the supported formats are JPG, PNG, GIF, BMP, TIFF and WebP", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid image '%s': %w", path, err)
+	}
+	if i.Bounds().Empty() {
+		return nil, fmt.Errorf("Invalid image '%s': it has no pixels", path)
+	}
+
+	orientation := 1
+	if format == "jpeg" {
+		orientation = exifOrientation(data)
+	}
+
+	return toNRGBA(i, orientation), nil
+}
+
+// toNRGBA converts an image to 8-bit pixels with straight alpha, applying the given EXIF orientation (1 to 8).
+// The 16-bit channels are truncated to their most significant byte
+func toNRGBA(i image.Image, orientation int) *image.NRGBA {
+	bounds := i.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	// the orientations from 5 to 8 transpose the image
+	outW, outH := w, h
+	if orientation >= 5 && orientation <= 8 {
+		outW, outH = h, w
+	}
+
+	out := image.NewNRGBA(image.Rect(0, 0, outW, outH))
+	for y := 0; y < outH; y++ {
+		for x := 0; x < outW; x++ {
+			// coordinates of the pixel of the stored image displayed at (x,y)
+			sx, sy := x, y
+			switch orientation {
+			case 2: // mirrored horizontally
+				sx = w - 1 - x
+			case 3: // rotated by 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sy = h - 1 - y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // rotated by 90° clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotated by 90° counterclockwise
+				sx, sy = w-1-y, x
+			}
+
+			c := color.NRGBAModel.Convert(i.At(bounds.Min.X+sx, bounds.Min.Y+sy)).(color.NRGBA)
+			p := y*out.Stride + x*4
+			out.Pix[p], out.Pix[p+1], out.Pix[p+2], out.Pix[p+3] = c.R, c.G, c.B, c.A
+		}
+	}
+
+	return out
+}
+
+// exifOrientation returns the orientation stored in the EXIF metadata of a JPG file, from 1 (upright) to 8.
+// The files without metadata, or with malformed ones, are considered upright
+func exifOrientation(data []byte) int {
+	// walk the segments of the file, up to the start of the compressed data
+	for p := 2; p+4 <= len(data) && data[p] == 0xFF; {
+		marker := data[p+1]
+		length := int(binary.BigEndian.Uint16(data[p+2:]))
+		if marker == 0xDA || length < 2 || p+2+length > len(data) {
+			break
+		}
+		segment := data[p+4 : p+2+length]
+		p += 2 + length
+
+		if marker != 0xE1 || !bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			continue
+		}
+
+		// the metadata are a TIFF header, followed by the first directory of tags
+		tiff := segment[6:]
+		if len(tiff) < 8 {
+			return 1
+		}
+		var order binary.ByteOrder
+		switch string(tiff[:2]) {
+		case "II":
+			order = binary.LittleEndian
+		case "MM":
+			order = binary.BigEndian
+		default:
+			return 1
+		}
+		ifd := int(order.Uint32(tiff[4:]))
+		if ifd < 8 || ifd+2 > len(tiff) {
+			return 1
+		}
+
+		entries := int(order.Uint16(tiff[ifd:]))
+		for e := 0; e < entries; e++ {
+			entry := ifd + 2 + e*12
+			if entry+12 > len(tiff) {
+				return 1
+			}
+			// the orientation is a short, stored in the first bytes of the value of its tag
+			if order.Uint16(tiff[entry:]) == 0x0112 {
+				orientation := int(order.Uint16(tiff[entry+8:]))
+				if orientation < 1 || orientation > 8 {
+					return 1
+				}
+				return orientation
+			}
+		}
+		return 1
+	}
+
+	return 1
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// runExport renders the solution stored at the given path into a file of the given format (svg or png)
+func runExport(
+	solutionPath string,
+	format string,
+	outputPath string,
+	svgOptions SVGOptions,
+) error {
+
+	if format != "svg" && format != "png" {
+		return fmt.Errorf("Unknown export format '%s'", format)
+	}
+
+	solution, err := loadSolution(solutionPath)
+	if err != nil {
+		return err
+	}
+	seeds := solution.Points()
+
+	// the diagram is only used to render the solution, with the metric it was computed with (so its random numbers are never used)
+	metric, err := NewMetric(solution.MetricConfig())
+	if err != nil {
+		return err
+	}
+	voronoi, err := NewVoronoi(solution.Width, solution.Height, len(seeds), defaultTessellator, metric, 0)
+	if err != nil {
+		return err
+	}
+
+	// the solutions of transparent targets are rendered with the same transparency
+	alpha, err := solution.Alpha()
+	if err != nil {
+		return err
+	}
+	if alpha != nil {
+		voronoi.WithAlphaMask(alpha)
+	}
+
+	if format == "png" {
+		i, err := voronoi.SeedsToImage(seeds)
+		if err != nil {
+			return err
+		}
+		return savePNG(outputPath, i)
+	}
+
+	cells, err := voronoi.SeedsToCells(seeds)
+	if err != nil {
+		return err
+	}
+
+	svgFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer svgFile.Close()
+
+	return writeSVG(
+		svgFile,
+		solution.Width,
+		solution.Height,
+		seeds,
+		cells,
+		solution.AlphaMask,
+		svgOptions,
+	)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+)
+
+const (
+	// fortunePerturbation is the magnitude of the deterministic perturbation applied to the sites by the sweep.
+	// Integer seeds are often aligned on the same row, or cocircular, and those are the degenerate cases of Fortune's algorithm:
+	// the perturbation breaks them, without losing any edge longer than the perturbation itself
+	fortunePerturbation = 1e-3
+
+	// fortuneTolerance absorbs the rounding errors of the circle events.
+	// A site landing right below a vertex of the diagram creates an arc that collapses immediately,
+	// and its circle event can come out slightly above the sweep line
+	fortuneTolerance = 1e-6
+)
+
+// Vertex is a point of the plane, in image coordinates (a pixel with coordinates (x,y) covers the square from (x,y) to (x+1,y+1))
+type Vertex struct {
+	X float64
+	Y float64
+}
+
+// Cell is the geometry of the voronoi cell of a seed, clipped to the image rectangle.
+//
+// Each outline is a closed polygon (clockwise, or counterclockwise around a hole), and the cell is the area enclosed by an odd number of outlines:
+// the euclidean cells are made of a single convex polygon, while the cells of the other metrics may have holes or multiple parts
+type Cell struct {
+	Seed       int        // index of the seed of the cell
+	Outlines   [][]Vertex // outlines of the cell (empty if the seed is overlapped by another one)
+	Neighbours []int      // indexes of the seeds of the cells sharing an edge with this one
+}
+
+// FortuneCells computes the exact voronoi cells of the seeds (with the euclidean distance), clipped to the image rectangle.
+//
+// Fortune's sweep line (https://en.wikipedia.org/wiki/Fortune%27s_algorithm) finds the pairs of seeds whose cells share an edge,
+// and then each cell is computed as the image rectangle clipped by the bisectors between its seed and the adjacent ones.
+// The seeds lie at the center of their pixels, consistently with the rendering of the pixels.
+// Overlapped seeds follow the same rule of the tessellation: the seed with the highest index owns the cell
+func FortuneCells(seeds []Point, width int, height int) []Cell {
+	cells := make([]Cell, len(seeds))
+	for i := range cells {
+		cells[i].Seed = i
+	}
+
+	// the sweep runs on the distinct positions only, keeping the seed with the highest index for each one
+	owners := map[Point]int{}
+	for i, s := range seeds {
+		owners[Point{X: s.X, Y: s.Y}] = i
+	}
+	sites := []fortuneSite{}
+	for i, s := range seeds {
+		if owners[Point{X: s.X, Y: s.Y}] != i {
+			continue
+		}
+		n := float64(len(sites) + 1)
+		sites = append(sites, fortuneSite{
+			seed: i,
+			x:    float64(s.X) + 0.5 + fortunePerturbation*math.Mod(n*0.6180339887, 1),
+			y:    float64(s.Y) + 0.5 + fortunePerturbation*n/float64(len(seeds)+1),
+		})
+	}
+
+	adjacencies := sweep(sites)
+
+	// clip the image rectangle with the bisectors of the adjacent seeds
+	for i, site := range sites {
+		center := seedCenter(seeds[site.seed])
+		polygon := []Vertex{{0, 0}, {float64(width), 0}, {float64(width), float64(height)}, {0, float64(height)}}
+		labels := []int{-1, -1, -1, -1}
+
+		for neighbour := range adjacencies[i] {
+			polygon, labels = clipToBisector(polygon, labels, center, seedCenter(seeds[sites[neighbour].seed]), sites[neighbour].seed)
+		}
+
+		// the neighbours are the seeds whose bisectors survived the clipping
+		cell := &cells[site.seed]
+		if len(polygon) >= 3 {
+			cell.Outlines = [][]Vertex{polygon}
+		}
+		found := map[int]bool{}
+		for j, label := range labels {
+			next := polygon[(j+1)%len(polygon)]
+			if label == -1 || found[label] || math.Hypot(next.X-polygon[j].X, next.Y-polygon[j].Y) < fortunePerturbation {
+				continue
+			}
+			found[label] = true
+			cell.Neighbours = append(cell.Neighbours, label)
+		}
+	}
+
+	return cells
+}
+
+// seedCenter returns the center of the pixel of a seed
+func seedCenter(s Point) Vertex {
+	return Vertex{X: float64(s.X) + 0.5, Y: float64(s.Y) + 0.5}
+}
+
+// clipToBisector clips a convex polygon, keeping the part closer to the center than to the other point.
+//
+// Each edge of the polygon carries a label (the seed of the bisector it lies on, or -1 for the image borders),
+// and the edge created by the clipping gets the label of the other point
+func clipToBisector(polygon []Vertex, labels []int, center Vertex, other Vertex, otherLabel int) ([]Vertex, []int) {
+	nx := other.X - center.X
+	ny := other.Y - center.Y
+	c := (other.X*other.X + other.Y*other.Y - center.X*center.X - center.Y*center.Y) / 2
+	return clipToHalfPlane(polygon, labels, nx, ny, c, otherLabel)
+}
+
+// clipToHalfPlane clips a convex polygon, keeping the part in the half-plane n·p <= c.
+// The edge created by the clipping gets the given label
+func clipToHalfPlane(polygon []Vertex, labels []int, nx float64, ny float64, c float64, label int) ([]Vertex, []int) {
+	inside := func(p Vertex) bool { return nx*p.X+ny*p.Y <= c }
+	intersection := func(p Vertex, q Vertex) Vertex {
+		t := (c - nx*p.X - ny*p.Y) / (nx*(q.X-p.X) + ny*(q.Y-p.Y))
+		return Vertex{X: p.X + t*(q.X-p.X), Y: p.Y + t*(q.Y-p.Y)}
+	}
+
+	clipped := []Vertex{}
+	clippedLabels := []int{}
+	for i, p := range polygon {
+		q := polygon[(i+1)%len(polygon)]
+		pIn, qIn := inside(p), inside(q)
+
+		switch {
+		case pIn && qIn:
+			clipped = append(clipped, p)
+			clippedLabels = append(clippedLabels, labels[i])
+		case pIn && !qIn:
+			// the edge leaves the half-plane: from the exit point on, the polygon follows its boundary
+			clipped = append(clipped, p, intersection(p, q))
+			clippedLabels = append(clippedLabels, labels[i], label)
+		case !pIn && qIn:
+			clipped = append(clipped, intersection(p, q))
+			clippedLabels = append(clippedLabels, labels[i])
+		}
+	}
+
+	return clipped, clippedLabels
+}
+
+// fortuneSite is a site of the sweep, with its (perturbated) coordinates
+type fortuneSite struct {
+	seed int
+	x    float64
+	y    float64
+}
+
+// fortuneArc is an arc of the beach line, as a node of a doubly linked list ordered from left to right
+type fortuneArc struct {
+	site  int
+	prev  *fortuneArc
+	next  *fortuneArc
+	event *fortuneEvent // circle event that would remove the arc, if any
+}
+
+// fortuneEvent is an event of the sweep: either a site event (reaching a new site)
+// or a circle event (an arc of the beach line shrinking to a point)
+type fortuneEvent struct {
+	y     float64
+	x     float64
+	site  int         // site of a site event, or -1 for circle events
+	arc   *fortuneArc // arc removed by a circle event
+	valid bool        // circle events get invalidated when their arcs change
+	index int         // position in the queue
+}
+
+// fortuneQueue is the priority queue of the events, ordered by the sweep direction (top to bottom, then left to right)
+type fortuneQueue []*fortuneEvent
+
+func (q fortuneQueue) Len() int { return len(q) }
+func (q fortuneQueue) Less(i, j int) bool {
+	if q[i].y != q[j].y {
+		return q[i].y < q[j].y
+	}
+	return q[i].x < q[j].x
+}
+func (q fortuneQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *fortuneQueue) Push(x any) {
+	e := x.(*fortuneEvent)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+func (q *fortuneQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// sweep runs Fortune's algorithm over the sites, returning for each site the set of sites whose cells share an edge with its cell.
+//
+// The beach line is kept as a linked list, which is more than enough for the number of seeds of a diagram.
+// Two arcs that become adjacent on the beach line trace an edge of the diagram, so their sites are adjacent
+func sweep(sites []fortuneSite) []map[int]bool {
+	adjacencies := make([]map[int]bool, len(sites))
+	for i := range adjacencies {
+		adjacencies[i] = map[int]bool{}
+	}
+	adjacent := func(a int, b int) {
+		adjacencies[a][b] = true
+		adjacencies[b][a] = true
+	}
+
+	queue := &fortuneQueue{}
+	for i, s := range sites {
+		heap.Push(queue, &fortuneEvent{y: s.y, x: s.x, site: i, valid: true})
+	}
+
+	var beach *fortuneArc // leftmost arc of the beach line
+	for queue.Len() > 0 {
+		e := heap.Pop(queue).(*fortuneEvent)
+		if !e.valid {
+			continue
+		}
+		sweepY := e.y
+
+		// circle event: the arc disappears, and its neighbours become adjacent
+		if e.site == -1 {
+			arc := e.arc
+			adjacent(arc.prev.site, arc.next.site)
+
+			arc.prev.next = arc.next
+			arc.next.prev = arc.prev
+			invalidateEvent(arc.prev)
+			invalidateEvent(arc.next)
+			scheduleCircleEvent(queue, sites, arc.prev, sweepY)
+			scheduleCircleEvent(queue, sites, arc.next, sweepY)
+			continue
+		}
+
+		// site event: the first site just starts the beach line
+		site := sites[e.site]
+		if beach == nil {
+			beach = &fortuneArc{site: e.site}
+			continue
+		}
+
+		// find the arc above the new site
+		arc := beach
+		for arc.next != nil && breakpoint(sites[arc.site], sites[arc.next.site], sweepY) < site.x {
+			arc = arc.next
+		}
+
+		// split the arc, inserting the new one in the middle
+		invalidateEvent(arc)
+		adjacent(arc.site, e.site)
+		right := &fortuneArc{site: arc.site, next: arc.next}
+		middle := &fortuneArc{site: e.site, prev: arc, next: right}
+		right.prev = middle
+		if right.next != nil {
+			right.next.prev = right
+		}
+		arc.next = middle
+
+		scheduleCircleEvent(queue, sites, arc, sweepY)
+		scheduleCircleEvent(queue, sites, right, sweepY)
+	}
+
+	return adjacencies
+}
+
+// invalidateEvent cancels the circle event of an arc, if any
+func invalidateEvent(arc *fortuneArc) {
+	if arc.event != nil {
+		arc.event.valid = false
+		arc.event = nil
+	}
+}
+
+// scheduleCircleEvent checks whether the arc is going to shrink to a point, and if so it queues the corresponding circle event.
+// This happens when the breakpoints at its sides converge, at the lowest point of the circle through the three sites
+func scheduleCircleEvent(queue *fortuneQueue, sites []fortuneSite, arc *fortuneArc, sweepY float64) {
+	if arc.prev == nil || arc.next == nil {
+		return
+	}
+	a, b, c := sites[arc.prev.site], sites[arc.site], sites[arc.next.site]
+
+	// the breakpoints only converge if the three sites turn clockwise (with y pointing down)
+	d := (b.x-a.x)*(c.y-a.y) - (c.x-a.x)*(b.y-a.y)
+	if d <= 0 {
+		return
+	}
+
+	// center of the circle through the three sites
+	bx, by := b.x-a.x, b.y-a.y
+	cx, cy := c.x-a.x, c.y-a.y
+	den := 2 * (bx*cy - by*cx)
+	ux := (cy*(bx*bx+by*by) - by*(cx*cx+cy*cy)) / den
+	uy := (bx*(cx*cx+cy*cy) - cx*(bx*bx+by*by)) / den
+	x := a.x + ux
+	y := a.y + uy + math.Hypot(ux, uy)
+
+	if y < sweepY-fortuneTolerance {
+		return
+	}
+
+	arc.event = &fortuneEvent{y: y, x: x, site: -1, arc: arc, valid: true}
+	heap.Push(queue, arc.event)
+}
+
+// breakpoint returns the x coordinate of the intersection between the parabolas of two sites
+// (the left one and the right one along the beach line), given the position of the sweep line
+func breakpoint(left fortuneSite, right fortuneSite, sweepY float64) float64 {
+
+	// a site lying on the sweep line is a degenerate parabola, that is a vertical line
+	if left.y == sweepY {
+		return left.x
+	}
+	if right.y == sweepY {
+		return right.x
+	}
+	if left.y == right.y {
+		return (left.x + right.x) / 2
+	}
+
+	// each parabola is y = (x - sx)² / (2·(sy - l)) + (sy + l) / 2, with l the sweep line:
+	// their difference is solved relatively to the left site, to keep it well conditioned for sites close to the sweep line
+	pl := left.y - sweepY
+	pr := right.y - sweepY
+	dx := right.x - left.x
+	a := pr - pl
+	b := 2 * pl * dx
+	c := pl*pr*(left.y-right.y) - pl*dx*dx
+
+	// the roots are computed in the numerically stable form, since sites on (almost) the same row
+	// make the quadratic term vanish, and one of the roots run away to infinity
+	disc := math.Sqrt(math.Max(b*b-4*a*c, 0))
+	q := -(b - disc) / 2
+	if b >= 0 {
+		q = -(b + disc) / 2
+	}
+	if q == 0 {
+		return (left.x + right.x) / 2
+	}
+	x1 := left.x + q/a
+	x2 := left.x + c/q
+
+	// the narrower parabola (the site closer to the sweep line) is the upper one between the two intersections
+	if left.y > right.y {
+		return math.Max(x1, x2)
+	}
+	return math.Min(x1, x2)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"compress/lzw"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// gifMaxColors is the number of colors of the palette of each frame, leaving one entry of the 256 ones for the transparent pixels
+const gifMaxColors = 255
+
+// gifWriter writes an animated GIF, with a palette of its own for each frame.
+//
+// The diagrams with fewer cells than the entries of a palette are encoded exactly, the others get the palette
+// of the median cut of their colors
+type gifWriter struct {
+	file    *os.File
+	out     *bufio.Writer
+	config  AnimationConfig
+	width   int
+	height  int
+	elapsed time.Duration // total duration of the frames written so far, to round their delays without drifting
+}
+
+// AddFrame appends a frame to the GIF, writing the header of the file along with the first one
+func (g *gifWriter) AddFrame(i image.Image, duration time.Duration) error {
+	frame := scaleFrame(i, g.config.Scale)
+	if g.out == nil {
+		g.out = bufio.NewWriter(g.file)
+		g.width, g.height = frame.Rect.Dx(), frame.Rect.Dy()
+		g.writeHeader()
+	} else if frame.Rect.Dx() != g.width || frame.Rect.Dy() != g.height {
+		return errors.New("All the frames of the animation must have the same size")
+	}
+
+	palette, indexes, transparent := quantizeFrame(frame)
+
+	// the delays are in hundredths of a second: they are rounded on the total elapsed time, so the errors don't add up
+	delay := int((g.elapsed+duration)/(10*time.Millisecond)) - int(g.elapsed/(10*time.Millisecond))
+	g.elapsed += duration
+
+	// graphic control extension: the delay of the frame and, if any, its transparent color.
+	// The transparent frames must not show the previous ones through, so they are disposed to the background
+	flags := byte(1 << 2)
+	if transparent >= 0 {
+		flags = 2<<2 | 1
+	}
+	g.out.Write([]byte{0x21, 0xF9, 4, flags})
+	binary.Write(g.out, binary.LittleEndian, uint16(delay))
+	g.out.Write([]byte{byte(clamp(transparent, 0, 255)), 0})
+
+	// image descriptor, with the local palette padded to a power of 2
+	bits := 1
+	for 1<<bits < len(palette) {
+		bits++
+	}
+	g.out.WriteByte(0x2C)
+	binary.Write(g.out, binary.LittleEndian, []uint16{0, 0, uint16(g.width), uint16(g.height)})
+	g.out.WriteByte(0x80 | byte(bits-1))
+	for e := 0; e < 1<<bits; e++ {
+		c := color.RGBA{}
+		if e < len(palette) {
+			c = palette[e].(color.RGBA)
+		}
+		g.out.Write([]byte{c.R, c.G, c.B})
+	}
+
+	// image data, compressed with LZW and split into blocks
+	literal := clamp(bits, 2, 8)
+	g.out.WriteByte(byte(literal))
+	blocks := &gifBlockWriter{out: g.out}
+	compressor := lzw.NewWriter(blocks, lzw.LSB, literal)
+	if _, err := compressor.Write(indexes); err != nil {
+		return err
+	}
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+	blocks.flush()
+	g.out.WriteByte(0)
+
+	return nil
+}
+
+// writeHeader writes the header of the GIF, with the number of loops of the animation
+func (g *gifWriter) writeHeader() {
+	g.out.WriteString("GIF89a")
+	binary.Write(g.out, binary.LittleEndian, []uint16{uint16(g.width), uint16(g.height)})
+	g.out.Write([]byte{0, 0, 0})
+
+	// the animations played once have no loop extension, the others repeat the first play as many times as needed
+	if g.config.Loops != 1 {
+		g.out.Write([]byte{0x21, 0xFF, 11})
+		g.out.WriteString("NETSCAPE2.0")
+		g.out.Write([]byte{3, 1})
+		binary.Write(g.out, binary.LittleEndian, uint16(clamp(g.config.Loops-1, 0, math.MaxUint16)))
+		g.out.WriteByte(0)
+	}
+}
+
+// Close writes the trailer of the GIF and closes its file
+func (g *gifWriter) Close() error {
+	if g.out != nil {
+		g.out.WriteByte(0x3B)
+		if err := g.out.Flush(); err != nil {
+			g.file.Close()
+			return err
+		}
+	}
+	return g.file.Close()
+}
+
+// gifBlockWriter splits the image data of a GIF into the sub-blocks of up to 255 bytes of the format
+type gifBlockWriter struct {
+	out    *bufio.Writer
+	buffer [255]byte
+	n      int
+}
+
+func (b *gifBlockWriter) Write(data []byte) (int, error) {
+	for _, d := range data {
+		b.buffer[b.n] = d
+		b.n++
+		if b.n == len(b.buffer) {
+			b.flush()
+		}
+	}
+	return len(data), nil
+}
+
+// flush writes the pending bytes as a sub-block
+func (b *gifBlockWriter) flush() {
+	if b.n == 0 {
+		return
+	}
+	b.out.WriteByte(byte(b.n))
+	b.out.Write(b.buffer[:b.n])
+	b.n = 0
+}
+
+// quantizeFrame maps the pixels of a frame to the entries of a palette of at most 256 colors.
+// The pixels whose alpha is below opaqueAlpha get the transparent entry, whose index is returned (or -1 if there is none)
+func quantizeFrame(frame *image.NRGBA) (color.Palette, []byte, int) {
+	counts := map[color.RGBA]int{}
+	transparent := false
+	for p := 0; p < len(frame.Pix); p += 4 {
+		if frame.Pix[p+3] < opaqueAlpha {
+			transparent = true
+			continue
+		}
+		counts[color.RGBA{R: frame.Pix[p], G: frame.Pix[p+1], B: frame.Pix[p+2], A: 255}]++
+	}
+
+	// the colors are sorted, so the palette of a frame doesn't depend on the order of the map
+	colors := make([]color.RGBA, 0, len(counts))
+	for c := range counts {
+		colors = append(colors, c)
+	}
+	sort.Slice(colors, func(i, j int) bool { return rgbKey(colors[i]) < rgbKey(colors[j]) })
+
+	palette := color.Palette{}
+	lookup := map[color.RGBA]byte{}
+	if len(colors) <= gifMaxColors {
+		for i, c := range colors {
+			palette = append(palette, c)
+			lookup[c] = byte(i)
+		}
+	} else {
+		for _, c := range medianCut(colors, counts, gifMaxColors) {
+			palette = append(palette, c)
+		}
+		for _, c := range colors {
+			lookup[c] = byte(palette.Index(c))
+		}
+	}
+
+	transparentIndex := -1
+	if transparent || len(palette) == 0 {
+		transparentIndex = len(palette)
+		palette = append(palette, color.RGBA{})
+	}
+
+	indexes := make([]byte, len(frame.Pix)/4)
+	for i := range indexes {
+		p := i * 4
+		if frame.Pix[p+3] < opaqueAlpha {
+			indexes[i] = byte(transparentIndex)
+			continue
+		}
+		indexes[i] = lookup[color.RGBA{R: frame.Pix[p], G: frame.Pix[p+1], B: frame.Pix[p+2], A: 255}]
+	}
+
+	return palette, indexes, transparentIndex
+}
+
+// rgbKey packs the RGB channels of a color into an integer, to sort the colors
+func rgbKey(c color.RGBA) int {
+	return int(c.R)<<16 | int(c.G)<<8 | int(c.B)
+}
+
+// medianCut reduces a set of colors, each one counted by the pixels it covers, to a palette of at most n colors.
+//
+// The colors are split into boxes: the box with the widest range of a channel is cut in two at the median pixel of that channel,
+// until there are n boxes, and each box is represented by the mean color of its pixels
+func medianCut(colors []color.RGBA, counts map[color.RGBA]int, n int) []color.RGBA {
+	channel := func(c color.RGBA, ch int) uint8 {
+		return [3]uint8{c.R, c.G, c.B}[ch]
+	}
+
+	// each box keeps the channel with its widest range, and the range
+	type box struct {
+		colors  []color.RGBA
+		channel int
+		span    int
+	}
+	newBox := func(colors []color.RGBA) box {
+		b := box{colors: colors, span: -1}
+		for ch := 0; ch < 3; ch++ {
+			lo, hi := 255, 0
+			for _, c := range colors {
+				v := int(channel(c, ch))
+				if v < lo {
+					lo = v
+				}
+				if v > hi {
+					hi = v
+				}
+			}
+			if hi-lo > b.span {
+				b.channel, b.span = ch, hi-lo
+			}
+		}
+		return b
+	}
+
+	boxes := []box{newBox(colors)}
+	for len(boxes) < n {
+		// cut the box with the widest range, unless all the boxes are made of a single color
+		cut := -1
+		for b := range boxes {
+			if boxes[b].span > 0 && (cut < 0 || boxes[b].span > boxes[cut].span) {
+				cut = b
+			}
+		}
+		if cut < 0 {
+			break
+		}
+
+		ch, colors := boxes[cut].channel, boxes[cut].colors
+		sort.SliceStable(colors, func(i, j int) bool { return channel(colors[i], ch) < channel(colors[j], ch) })
+		total := 0
+		for _, c := range colors {
+			total += counts[c]
+		}
+		median, covered := 1, counts[colors[0]]
+		for median < len(colors)-1 && covered < total/2 {
+			covered += counts[colors[median]]
+			median++
+		}
+		boxes[cut] = newBox(colors[:median])
+		boxes = append(boxes, newBox(colors[median:]))
+	}
+
+	palette := make([]color.RGBA, len(boxes))
+	for b, box := range boxes {
+		var r, g, bl, total int
+		for _, c := range box.colors {
+			w := counts[c]
+			r += int(c.R) * w
+			g += int(c.G) * w
+			bl += int(c.B) * w
+			total += w
+		}
+		palette[b] = color.RGBA{R: uint8(r / total), G: uint8(g / total), B: uint8(bl / total), A: 255}
+	}
+
+	return palette
+}
@@ -5,6 +5,7 @@ go 1.20
 require (
 	github.com/hajimehoshi/ebiten/v2 v2.4.15
 	github.com/urfave/cli/v2 v2.23.7
+	golang.org/x/image v0.18.0
 )
 
 require (
@@ -16,7 +17,6 @@ require (
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20201216005158-039620a65673 // indirect
 	golang.org/x/exp v0.0.0-20190731235908-ec7cb31e5a56 // indirect
-	golang.org/x/image v0.1.0 // indirect
 	golang.org/x/mobile v0.0.0-20220722155234-aaac322e2105 // indirect
 	golang.org/x/sys v0.0.0-20220818161305-2296e01440c6 // indirect
 )
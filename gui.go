@@ -0,0 +1,46 @@
+//go:build !headless
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	ebiten "github.com/hajimehoshi/ebiten/v2"
+)
+
+// runGUI runs the simulation inside a window, until the simulation duration expires or the window gets closed
+func runGUI(
+	targetImage TargetImage,
+	numSeeds int,
+	simulatedAnnealing SimulatedAnnealingEngine,
+	simulationDuration time.Duration,
+	snapshots *Snapshotter,
+) error {
+
+	// initialize the canvas for the GUI
+	c, cErr := NewCanvas(
+		targetImage.Width,
+		targetImage.Height,
+		simulatedAnnealing,
+		simulationDuration,
+		snapshots,
+	)
+	if cErr != nil {
+		return cErr
+	}
+
+	// initialize the system window size and title
+	ebiten.SetWindowTitle(
+		fmt.Sprintf("Voronoi Simulated Annealing (%d seeds)", numSeeds))
+	ebiten.SetWindowSize(targetImage.Width, targetImage.Height)
+
+	// show the simulation until it completes or the window gets closed
+	if err := ebiten.RunGame(c); err != nil && err != SimulationCompleted {
+		c.Stop()
+		return err
+	}
+
+	// make sure the simulation goroutine is over before returning
+	return c.Stop()
+}
@@ -0,0 +1,20 @@
+//go:build headless
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// runGUI is not available when the binary is built with the `headless` tag,
+// because Ebiten (and therefore a display server) is not linked at all
+func runGUI(
+	targetImage TargetImage,
+	numSeeds int,
+	simulatedAnnealing SimulatedAnnealingEngine,
+	simulationDuration time.Duration,
+	snapshots *Snapshotter,
+) error {
+	return errors.New("GUI support not compiled in this binary (built with the `headless` tag): run with --headless")
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// runHeadless runs the simulation in a plain loop, without any window.
+//
+// The simulation stops gracefully on interrupt, so that the best solution can still be saved
+func runHeadless(
+	simulatedAnnealing SimulatedAnnealingEngine,
+	simulationDuration time.Duration,
+	snapshots *Snapshotter,
+) error {
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return runSimulation(
+		ctx,
+		simulatedAnnealing,
+		simulationDuration,
+		snapshots,
+		nil,
+	)
+}
@@ -0,0 +1,124 @@
+package main
+
+import "math"
+
+// JumpFlooding computes approximated voronoi diagrams with the Jump Flooding Algorithm
+// (https://en.wikipedia.org/wiki/Jump_flooding_algorithm).
+//
+// Starting from the seeds alone, each pass propagates the closest seed known by each pixel to the pixels
+// at a given step, halving the step at each pass. The number of passes only depends on the size of the canvas,
+// and each pass is split across multiple goroutines, so it scales much better than the ring growth on large canvases.
+// The price is that a few pixels may end up assigned to a seed that is not the closest one
+type JumpFlooding struct {
+
+	// diagram size (in pixels)
+	width  int
+	height int
+
+	workers int    // number of goroutines used by each pass
+	metric  Metric // metric measuring the distance of the pixels from the seeds
+
+	buffer []int // scratch owner map, used to double buffer the passes
+}
+
+// NewJumpFlooding creates a jump flooding tessellator for a canvas of the given size
+func NewJumpFlooding(
+	width int,
+	height int,
+	workers int,
+	metric Metric,
+) *JumpFlooding {
+
+	return &JumpFlooding{
+		width:   width,
+		height:  height,
+		workers: workers,
+		metric:  metric,
+		buffer:  make([]int, width*height),
+	}
+}
+
+// Tessellate fills the owner map with the index of the seed owning each pixel (in row-major order),
+// and the distances with the distance of each pixel from its owner.
+// As in the ring growth, on ties the pixel goes to the seed with the highest index
+func (j *JumpFlooding) Tessellate(seeds []Point, owners []int, distances []float64) {
+
+	// initially only the pixels under the seeds are assigned
+	for p := range owners {
+		owners[p] = -1
+	}
+	for i, s := range seeds {
+		owners[s.Y*j.width+s.X] = i
+	}
+
+	// the step starts from the largest power of 2 not exceeding half the size of the canvas
+	step := 1
+	for step*2 < int(math.Max(float64(j.width), float64(j.height))) {
+		step *= 2
+	}
+
+	// the classic halving passes are followed by two more passes with small steps (JFA+2),
+	// that fix most of the errors of the algorithm
+	steps := []int{}
+	for ; step >= 1; step /= 2 {
+		steps = append(steps, step)
+	}
+	steps = append(steps, 2, 1)
+
+	src, dst := owners, j.buffer
+	for _, step := range steps {
+		j.pass(seeds, src, dst, step)
+		src, dst = dst, src
+	}
+
+	// the last pass may have written the result into the scratch buffer
+	if len(steps)%2 == 1 {
+		copy(owners, j.buffer)
+	}
+
+	forEachBand(j.height, j.workers, func(minY int, maxY int) {
+		for p := minY * j.width; p < maxY*j.width; p++ {
+			s := seeds[owners[p]]
+			distances[p] = j.metric.Distance(s, p%j.width-s.X, p/j.width-s.Y)
+		}
+	})
+}
+
+// pass propagates the seeds known by each pixel in src to the pixels at the given step, writing the result into dst
+func (j *JumpFlooding) pass(seeds []Point, src []int, dst []int, step int) {
+	forEachBand(j.height, j.workers, func(minY int, maxY int) {
+		for y := minY; y < maxY; y++ {
+			for x := 0; x < j.width; x++ {
+				p := y*j.width + x
+
+				owner := src[p]
+				ownerDistance := math.Inf(1)
+				if owner != -1 {
+					ownerDistance = j.metric.Distance(seeds[owner], x-seeds[owner].X, y-seeds[owner].Y)
+				}
+
+				// look for a closer seed among the ones known by the neighbours at the given step
+				for dy := -step; dy <= step; dy += step {
+					for dx := -step; dx <= step; dx += step {
+						if x+dx < 0 || x+dx >= j.width || y+dy < 0 || y+dy >= j.height {
+							continue
+						}
+
+						candidate := src[p+dy*j.width+dx]
+						if candidate == -1 || candidate == owner {
+							continue
+						}
+
+						d := j.metric.Distance(seeds[candidate], x-seeds[candidate].X, y-seeds[candidate].Y)
+						if d < ownerDistance || (d == ownerDistance && candidate > owner) {
+							owner = candidate
+							ownerDistance = d
+						}
+					}
+				}
+
+				dst[p] = owner
+			}
+		}
+	})
+}
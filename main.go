@@ -1,15 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"image"
-	_ "image/jpeg"
+	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"time"
 
-	ebiten "github.com/hajimehoshi/ebiten/v2"
 	"github.com/urfave/cli/v2"
 )
 
@@ -18,18 +19,107 @@ var (
 	defaultNumSeeds           = 50
 	defaultSimulationDuration = 3 * time.Hour
 	defaultSnapshotsInterval  = 1 * time.Minute
+	defaultCheckpointInterval = 5 * time.Minute
 	defaultImageName          = "homer"
+	defaultTessellator        = "ring"
+	defaultMetric             = "euclidean"
+	defaultMinkowskiP         = 3.0
+	defaultMaxStretch         = 3.0
+	defaultMaxWeight          = 0.0
+	defaultCostFunction       = "l1"
+	defaultStructure          = "none"
+	defaultStructureWeight    = 0.5
+	defaultWorkers            = 1
+
+	// defaults argument values for the cooling schedule
+	defaultCoolingSchedule    = "exponential"
+	defaultTargetAcceptance   = 0.44
+	defaultInitialAcceptance  = 0.8
+	defaultCalibrationSamples = 100
+
+	// defaults argument values for the parallel tempering
+	defaultReplicas     = 1
+	defaultLadderRatio  = 0.7
+	defaultSwapInterval = 100
+
+	// defaults argument values for the coarse-to-fine annealing
+	defaultLevels     = 1
+	defaultLevelShare = 0.1
+
+	// defaults argument values for the acceptance criterion
+	defaultAcceptanceCriterion = "sigmoid"
+	defaultRainSpeed           = 1e-4
+	defaultDeviation           = 0.01
+	defaultHistoryLength       = 50
+	defaultSigmoidSteepness    = 10.0
+
+	// defaults argument values for the colors of the cells
+	defaultCellColors = "random"
+
+	// defaults argument values for the time-lapse animations
+	defaultFrameInterval  = 10 * time.Second
+	defaultFrameRate      = 10.0
+	defaultAnimationScale = 1.0
+	defaultHold           = 2 * time.Second
+	defaultAnimateFormat  = "gif"
+
+	// defaults argument values for the `replay` command
+	defaultReplayFormat       = "png"
+	defaultReplayScale        = 1
+	defaultIterationsPerFrame = 1000
+
+	// defaults argument values for the `export` command
+	defaultExportFormat = "svg"
+	defaultStrokeColor  = "#000000"
+	defaultSeedRadius   = 1.0
+	defaultSeedColor    = "#000000"
 )
 
+// RunConfig contains all the parameters of a run of the simulated annealing, as set from the CLI.
+// It is saved in the checkpoints, so that a run can be resumed with the same parameters
+type RunConfig struct {
+	TargetImage        string           // path to the target image
+	WeightMap          string           // path to the weight map, auto for the saliency of the target, or empty
+	NumSeeds           int              // number of seeds of the diagram
+	SimulationDuration time.Duration    // duration of the simulation
+	Iterations         int              // number of iterations of the simulation, driving the cooling instead of the clock (0 to follow the clock)
+	SnapshotsInterval  time.Duration    // time interval between the snapshots
+	CheckpointInterval time.Duration    // time interval between the checkpoints (0 if disabled)
+	Cooling            CoolingConfig    // cooling schedule of the control temperature
+	Acceptance         AcceptanceConfig // acceptance criterion of the worse solutions
+	Tempering          TemperingConfig  // replicas of the parallel tempering (a single annealing if there is only one)
+	Pyramid            PyramidConfig    // coarse levels annealed before the native resolution (none if there is only one level)
+	Colors             ColorConfig      // how the colors of the cells are chosen
+	DebugCostInterval  int              // every how many iterations the incremental cost is cross-checked (0 if disabled)
+	Tessellator        string           // algorithm computing the whole diagram
+	Workers            int              // number of goroutines sharing the work of each iteration
+	Metric             MetricConfig     // distance metric of the diagram
+	CostFunction       string           // distance of the pixels from the target
+	Structure          StructureConfig  // structural cost blended with the pixel cost
+	Animation          AnimationConfig  // time-lapse of the simulation (not recorded if the format is empty)
+	FrameInterval      time.Duration    // time interval between the frames of the time-lapse
+	RandomSeed         int64            // seed of all the random numbers of the run
+	MoveLog            bool             // whether the accepted moves are recorded, to replay the run
+}
+
 func main() {
 
 	//
 	// CLI initialization
 	//
-	var numSeeds int
-	var inputImageFilePath string
-	var simulationDuration time.Duration
-	var snapshotsInterval time.Duration
+	var runConfig RunConfig
+	var headless bool
+	var exportFormat string
+	var solutionFilePath string
+	var outputFilePath string
+	var svgOptions SVGOptions
+	var animateFormat string
+	var checkpointFilePath string
+	var moveLogFilePath string
+	var replayFormat string
+	var replayIteration int
+	var replayScale int
+	var iterationsPerFrame int
 
 	app := &cli.App{
 
@@ -45,30 +135,253 @@ func main() {
 			&cli.StringFlag{
 				Name:        "targetImage",
 				Aliases:     []string{"i"},
-				Usage:       "Path to the input image `FILE` to be used as target image for the annealing. Only JPG images are supported",
+				Usage:       "Path to the input image `FILE` to be used as target image for the annealing. Supported formats are JPG (with EXIF orientation), PNG, GIF (first frame), BMP, TIFF and WebP",
 				Value:       "./res/" + defaultImageName + ".jpg",
-				Destination: &inputImageFilePath,
+				Destination: &runConfig.TargetImage,
+			},
+			&cli.StringFlag{
+				Name:        "weightMap",
+				Usage:       "Path to a grayscale image `FILE` of the same size of the target, whose brighter pixels count more in the cost and attract more perturbations, or auto to estimate it from the saliency of the target",
+				Destination: &runConfig.WeightMap,
 			},
 			&cli.IntFlag{
 				Name:        "seedsNumber",
 				Aliases:     []string{"n"},
 				Usage:       "Number of seeds (cells) used in the voronoi diagram",
 				Value:       defaultNumSeeds,
-				Destination: &numSeeds,
+				Destination: &runConfig.NumSeeds,
 			},
 			&cli.DurationFlag{
 				Name:        "simulationDuration",
 				Aliases:     []string{"d"},
 				Usage:       "Duration of the simulation",
 				Value:       defaultSimulationDuration,
-				Destination: &simulationDuration,
+				Destination: &runConfig.SimulationDuration,
+			},
+			&cli.IntFlag{
+				Name:        "iterations",
+				Usage:       "Number of iterations of the simulation (still capped by its duration): the cooling follows the iterations instead of the clock, so the runs with the same random seed are reproducible. 0 follows the clock",
+				Destination: &runConfig.Iterations,
 			},
 			&cli.DurationFlag{
 				Name:        "snapshotsInterval",
 				Aliases:     []string{"s"},
 				Usage:       "Time interval between the snapshots taken during the simulation (to track the progresses)",
 				Value:       defaultSnapshotsInterval,
-				Destination: &snapshotsInterval,
+				Destination: &runConfig.SnapshotsInterval,
+			},
+			&cli.DurationFlag{
+				Name:        "checkpointInterval",
+				Usage:       "Time interval between the checkpoints of the run, from which it can be resumed with the resume command (0 disables the checkpoints)",
+				Value:       defaultCheckpointInterval,
+				Destination: &runConfig.CheckpointInterval,
+			},
+			&cli.BoolFlag{
+				Name:        "headless",
+				Usage:       "Run the simulation without opening any window. On machines without a display server, the binary must also be built with the headless tag (make headless)",
+				Value:       false,
+				Destination: &headless,
+			},
+			&cli.StringFlag{
+				Name:        "schedule",
+				Usage:       "Cooling schedule of the control temperature: exponential, linear, logarithmic or adaptive",
+				Value:       defaultCoolingSchedule,
+				Destination: &runConfig.Cooling.Schedule,
+			},
+			&cli.Float64Flag{
+				Name:        "initialTemperature",
+				Usage:       "Initial control temperature. If not set, it is calibrated by sampling uphill moves from the initial solution",
+				Destination: &runConfig.Cooling.InitialTemperature,
+			},
+			&cli.Float64Flag{
+				Name:        "finalTemperature",
+				Usage:       "Control temperature reached at the end of the simulation (not used by the adaptive schedule). If not set, it is 1/1000 of the initial one",
+				Destination: &runConfig.Cooling.FinalTemperature,
+			},
+			&cli.Float64Flag{
+				Name:        "targetAcceptance",
+				Usage:       "Acceptance rate targeted by the adaptive schedule, in the interval (0,1)",
+				Value:       defaultTargetAcceptance,
+				Destination: &runConfig.Cooling.TargetAcceptance,
+			},
+			&cli.Float64Flag{
+				Name:        "initialAcceptance",
+				Usage:       "Probability of accepting an average uphill move at the calibrated initial temperature, in the interval (0,1)",
+				Value:       defaultInitialAcceptance,
+				Destination: &runConfig.Cooling.InitialAcceptance,
+			},
+			&cli.IntFlag{
+				Name:        "replicas",
+				Usage:       "Number of replicas of the annealing run in parallel on a ladder of temperatures, exchanging their solutions (parallel tempering). 1 runs a single annealing",
+				Value:       defaultReplicas,
+				Destination: &runConfig.Tempering.Replicas,
+			},
+			&cli.Float64Flag{
+				Name:        "ladderRatio",
+				Usage:       "Ratio between the temperatures of two consecutive replicas of the parallel tempering, in the interval (0,1)",
+				Value:       defaultLadderRatio,
+				Destination: &runConfig.Tempering.LadderRatio,
+			},
+			&cli.IntFlag{
+				Name:        "swapInterval",
+				Usage:       "Number of iterations of each replica of the parallel tempering between two rounds of exchanges",
+				Value:       defaultSwapInterval,
+				Destination: &runConfig.Tempering.SwapInterval,
+			},
+			&cli.IntFlag{
+				Name:        "levels",
+				Usage:       "Number of levels of the coarse-to-fine annealing, each one at half the resolution of the next one: the coarsest level is annealed first, and its solution is scaled up to seed the next one. 1 anneals at the native resolution only",
+				Value:       defaultLevels,
+				Destination: &runConfig.Pyramid.Levels,
+			},
+			&cli.Float64SliceFlag{
+				Name:  "levelShare",
+				Usage: "Fraction of the simulation (of its iterations, if limited, or else of its duration) spent on each coarse level of the coarse-to-fine annealing, the rest going to the native resolution. Either a single share for all the coarse levels, or one share for each of them from the coarsest one (comma-separated)",
+				Value: cli.NewFloat64Slice(defaultLevelShare),
+			},
+			&cli.StringFlag{
+				Name:        "acceptance",
+				Usage:       "Acceptance criterion for worse solutions: metropolis, threshold, greatDeluge, recordToRecord, lateAcceptance, hillClimbing or sigmoid",
+				Value:       defaultAcceptanceCriterion,
+				Destination: &runConfig.Acceptance.Criterion,
+			},
+			&cli.Float64Flag{
+				Name:        "rainSpeed",
+				Usage:       "Fraction of the water level lowered at each iteration by the greatDeluge criterion",
+				Value:       defaultRainSpeed,
+				Destination: &runConfig.Acceptance.RainSpeed,
+			},
+			&cli.Float64Flag{
+				Name:        "deviation",
+				Usage:       "Relative deviation from the best cost allowed by the recordToRecord criterion",
+				Value:       defaultDeviation,
+				Destination: &runConfig.Acceptance.Deviation,
+			},
+			&cli.IntFlag{
+				Name:        "historyLength",
+				Usage:       "Number of past iterations remembered by the lateAcceptance criterion",
+				Value:       defaultHistoryLength,
+				Destination: &runConfig.Acceptance.HistoryLength,
+			},
+			&cli.Float64Flag{
+				Name:        "sigmoidSteepness",
+				Usage:       "Steepness of the sigmoid criterion",
+				Value:       defaultSigmoidSteepness,
+				Destination: &runConfig.Acceptance.SigmoidSteepness,
+			},
+			&cli.StringFlag{
+				Name:        "cost",
+				Usage:       "Cost function measuring the distance from the target image: l1 (absolute RGB errors), l2 (squared RGB errors), luma (absolute YCbCr errors, weighting the luma twice) or ciede2000 (perceptual CIELAB difference)",
+				Value:       defaultCostFunction,
+				Destination: &runConfig.CostFunction,
+			},
+			&cli.StringFlag{
+				Name:        "structure",
+				Usage:       "Structural cost blended with the pixel cost: none, ssim (structural similarity of the luma, on sliding 8x8 windows) or msssim (multi-scale structural similarity)",
+				Value:       defaultStructure,
+				Destination: &runConfig.Structure.Name,
+			},
+			&cli.Float64Flag{
+				Name:        "structureWeight",
+				Usage:       "Weight of the structural cost in the blend with the pixel cost, in the interval [0,1] (1 for the structural cost alone)",
+				Value:       defaultStructureWeight,
+				Destination: &runConfig.Structure.Weight,
+			},
+			&cli.StringFlag{
+				Name:        "cellColors",
+				Usage:       "How the colors of the cells are chosen: random (searched by the annealing), mean (optimal for squared errors) or median (optimal for absolute errors)",
+				Value:       defaultCellColors,
+				Destination: &runConfig.Colors.Estimator,
+			},
+			&cli.IntFlag{
+				Name:        "recolorInterval",
+				Usage:       "Recolor the cells every `N` iterations, instead of after every move (not used by the random colors)",
+				Destination: &runConfig.Colors.RecolorInterval,
+			},
+			&cli.StringFlag{
+				Name:        "tessellator",
+				Usage:       "Algorithm used to compute the whole diagram: ring (exact ring growth) or jfa (approximated jump flooding, faster on large images)",
+				Value:       defaultTessellator,
+				Destination: &runConfig.Tessellator,
+			},
+			&cli.IntFlag{
+				Name:        "workers",
+				Usage:       "Number of goroutines sharing the tessellation and the cost evaluation of each iteration, on horizontal bands of the canvas. The results are the same with any number of workers",
+				Value:       defaultWorkers,
+				Destination: &runConfig.Workers,
+			},
+			&cli.StringFlag{
+				Name:        "metric",
+				Usage:       "Distance metric of the diagram: euclidean, manhattan, chebyshev, minkowski, anisotropic (each seed with its own elliptical metric), power or additive (each seed with its own weight)",
+				Value:       defaultMetric,
+				Destination: &runConfig.Metric.Name,
+			},
+			&cli.Float64Flag{
+				Name:        "minkowskiP",
+				Usage:       "Exponent of the minkowski metric, at least 1",
+				Value:       defaultMinkowskiP,
+				Destination: &runConfig.Metric.P,
+			},
+			&cli.Float64Flag{
+				Name:        "maxStretch",
+				Usage:       "Maximum elongation of the cells with the anisotropic metric, at least 1",
+				Value:       defaultMaxStretch,
+				Destination: &runConfig.Metric.MaxStretch,
+			},
+			&cli.Float64Flag{
+				Name:        "maxWeight",
+				Usage:       "Maximum weight of the seeds with the power and additive metrics, in pixels (0 for the radius of a cell of average size)",
+				Value:       defaultMaxWeight,
+				Destination: &runConfig.Metric.MaxWeight,
+			},
+			&cli.StringFlag{
+				Name:        "animation",
+				Usage:       "Record a time-lapse of the simulation in the given `FORMAT`: gif, apng or avi (MJPEG video). If not set, no time-lapse is recorded",
+				Destination: &runConfig.Animation.Format,
+			},
+			&cli.DurationFlag{
+				Name:        "frameInterval",
+				Usage:       "Time interval between the frames of the time-lapse recorded during the simulation",
+				Value:       defaultFrameInterval,
+				Destination: &runConfig.FrameInterval,
+			},
+			&cli.Float64Flag{
+				Name:        "frameRate",
+				Usage:       "Frames per second of the time-lapse",
+				Value:       defaultFrameRate,
+				Destination: &runConfig.Animation.FrameRate,
+			},
+			&cli.IntFlag{
+				Name:        "loops",
+				Usage:       "Number of times the time-lapse is played, or 0 to loop forever (gif and apng only)",
+				Destination: &runConfig.Animation.Loops,
+			},
+			&cli.Float64Flag{
+				Name:        "animationScale",
+				Usage:       "Scaling factor of the frames of the time-lapse, with respect to the size of the target image",
+				Value:       defaultAnimationScale,
+				Destination: &runConfig.Animation.Scale,
+			},
+			&cli.DurationFlag{
+				Name:        "hold",
+				Usage:       "How long the best solution is shown at the end of the time-lapse",
+				Value:       defaultHold,
+				Destination: &runConfig.Animation.Hold,
+			},
+			&cli.Int64Flag{
+				Name:        "randomSeed",
+				Usage:       "Seed of all the random numbers of the run, to reproduce it. If not set, a random one is chosen (and saved in the manifest of the run)",
+				Destination: &runConfig.RandomSeed,
+			},
+			&cli.BoolFlag{
+				Name:        "moveLog",
+				Usage:       "Record every accepted move of the simulation, to replay it later with the replay command",
+				Destination: &runConfig.MoveLog,
+			},
+			&cli.IntFlag{
+				Name:        "debugCost",
+				Usage:       "Cross-check the incremental cost against a full recomputation every `N` iterations, stopping at the first mismatch (0 disables the check)",
+				Destination: &runConfig.DebugCostInterval,
 			},
 		},
 
@@ -78,133 +391,594 @@ func main() {
 				Aliases: []string{"r"},
 				Usage:   "Runs the simulated annealing",
 				Action: func(cCtx *cli.Context) error {
-					targetImage := getTargetImage(inputImageFilePath)
+					targetImage, err := loadTarget(runConfig)
+					if err != nil {
+						return err
+					}
+					runConfig.Cooling.CalibrationSamples = defaultCalibrationSamples
+					if runConfig.MoveLog && runConfig.Tempering.Replicas > 1 {
+						return errors.New("The move log cannot be recorded with parallel tempering, since the replicas exchange their solutions")
+					}
+					if runConfig.Tempering.Replicas > 1 && !usesTemperature(runConfig.Acceptance.Criterion) {
+						return fmt.Errorf(
+							"Parallel tempering needs an acceptance criterion driven by the temperature (metropolis or threshold), got '%s'",
+							runConfig.Acceptance.Criterion,
+						)
+					}
+					runConfig.Pyramid.LevelShares = cCtx.Float64Slice("levelShare")
+					if runConfig.Pyramid.Levels < 1 {
+						return fmt.Errorf("Number of levels of the pyramid must be positive, got %d", runConfig.Pyramid.Levels)
+					}
+					if runConfig.Pyramid.Levels > 1 && runConfig.Tempering.Replicas > 1 {
+						return errors.New("The coarse-to-fine annealing cannot be combined with parallel tempering, since the replicas have their own cooling")
+					}
+					// any seed can be set, 0 included
+					if !cCtx.IsSet("randomSeed") {
+						runConfig.RandomSeed = time.Now().UnixNano()
+					}
 
-					runSimulatedAnnealing(
-						targetImage,
-						numSeeds,
-						simulationDuration,
-						snapshotsInterval,
+					runSimulatedAnnealing(targetImage, runConfig, headless, nil)
+					return nil
+				},
+			},
+			{
+				Name:  "resume",
+				Usage: "Resumes a run of the simulated annealing from its checkpoint, with the parameters of the run",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "checkpoint",
+						Usage:       "Path to the checkpoint `FILE` to resume. If not set, it is the checkpoint saved by the run with the same target image and number of seeds",
+						Destination: &checkpointFilePath,
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					if checkpointFilePath == "" {
+						checkpointFilePath = checkpointPath(getImageName(runConfig.TargetImage), runConfig.NumSeeds)
+					}
+					checkpoint, err := loadCheckpoint(checkpointFilePath)
+					if err != nil {
+						return err
+					}
+
+					// the run is resumed against the same target, with the same parameters
+					targetImage, err := loadTarget(checkpoint.Config)
+					if err != nil {
+						return err
+					}
+					if err := checkpoint.CheckTarget(targetImage); err != nil {
+						return err
+					}
+					fmt.Printf("Resuming the run from '%s', after %s and %d iterations\n",
+						checkpointFilePath,
+						checkpoint.State.Elapsed.Round(time.Second),
+						checkpoint.State.Iterations,
 					)
+
+					runSimulatedAnnealing(targetImage, checkpoint.Config, headless, &checkpoint)
 					return nil
 				},
 			},
+			{
+				Name:    "export",
+				Aliases: []string{"e"},
+				Usage:   "Exports the best solution saved by a previous run",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "format",
+						Aliases:     []string{"f"},
+						Usage:       "Format of the exported file: svg (vector, scalable to any size) or png (at the size of the target image)",
+						Value:       defaultExportFormat,
+						Destination: &exportFormat,
+					},
+					&cli.StringFlag{
+						Name:        "solution",
+						Usage:       "Path to the solution `FILE` to export. If not set, it is the best solution saved by the run with the same target image and number of seeds",
+						Destination: &solutionFilePath,
+					},
+					&cli.StringFlag{
+						Name:        "output",
+						Aliases:     []string{"o"},
+						Usage:       "Path to the exported `FILE`. If not set, it is placed next to the solution, with the extension of the format",
+						Destination: &outputFilePath,
+					},
+					&cli.StringFlag{
+						Name:        "strokeColor",
+						Usage:       "Color of the borders of the cells (svg only)",
+						Value:       defaultStrokeColor,
+						Destination: &svgOptions.StrokeColor,
+					},
+					&cli.Float64Flag{
+						Name:        "strokeWidth",
+						Usage:       "Width of the borders of the cells, in pixels of the target image (svg only). If not set, the borders are not drawn",
+						Destination: &svgOptions.StrokeWidth,
+					},
+					&cli.BoolFlag{
+						Name:        "seedDots",
+						Usage:       "Draw a dot on each seed, in a separate layer (svg only)",
+						Destination: &svgOptions.SeedDots,
+					},
+					&cli.Float64Flag{
+						Name:        "seedRadius",
+						Usage:       "Radius of the seed dots, in pixels of the target image (svg only)",
+						Value:       defaultSeedRadius,
+						Destination: &svgOptions.SeedRadius,
+					},
+					&cli.StringFlag{
+						Name:        "seedColor",
+						Usage:       "Color of the seed dots (svg only)",
+						Value:       defaultSeedColor,
+						Destination: &svgOptions.SeedColor,
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					if solutionFilePath == "" {
+						solutionFilePath = fmt.Sprintf("./res/%s_%d-seeds_best.json",
+							getImageName(runConfig.TargetImage),
+							runConfig.NumSeeds,
+						)
+					}
+					if outputFilePath == "" {
+						outputFilePath = strings.TrimSuffix(solutionFilePath, filepath.Ext(solutionFilePath)) + "." + exportFormat
+					}
+
+					return runExport(
+						solutionFilePath,
+						exportFormat,
+						outputFilePath,
+						svgOptions,
+					)
+				},
+			},
+			{
+				Name:  "replay",
+				Usage: "Rebuilds an intermediate solution of a previous run, or its time-lapse, from the log of its moves",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "log",
+						Usage:       "Path to the move log `FILE`. If not set, it is the log recorded by the run with the same target image and number of seeds",
+						Destination: &moveLogFilePath,
+					},
+					&cli.StringFlag{
+						Name:        "format",
+						Aliases:     []string{"f"},
+						Usage:       "Format of the output: png (image of the solution), json (solution, to be exported), or gif, apng or avi (time-lapse of the run)",
+						Value:       defaultReplayFormat,
+						Destination: &replayFormat,
+					},
+					&cli.IntFlag{
+						Name:        "iteration",
+						Usage:       "Iteration of the solution to rebuild: the last solution accepted up to it. If not set, it is the final solution of the log",
+						Value:       -1,
+						Destination: &replayIteration,
+					},
+					&cli.IntFlag{
+						Name:        "scale",
+						Usage:       "Scaling factor of the rebuilt diagrams with respect to the size of the target image, tessellated at the higher resolution (png and time-lapses only)",
+						Value:       defaultReplayScale,
+						Destination: &replayScale,
+					},
+					&cli.IntFlag{
+						Name:        "every",
+						Usage:       "Number of iterations between the frames of the time-lapse",
+						Value:       defaultIterationsPerFrame,
+						Destination: &iterationsPerFrame,
+					},
+					&cli.StringFlag{
+						Name:        "output",
+						Aliases:     []string{"o"},
+						Usage:       "Path to the output `FILE`. If not set, it is placed next to the log, named after the iteration or as a replay",
+						Destination: &outputFilePath,
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					imageName := getImageName(runConfig.TargetImage)
+					if moveLogFilePath == "" {
+						moveLogFilePath = moveLogPath(imageName, runConfig.NumSeeds)
+					}
+
+					if replayFormat == "png" || replayFormat == "json" {
+						return runReplay(
+							moveLogFilePath,
+							replayIteration,
+							replayFormat,
+							replayScale,
+							outputFilePath,
+						)
+					}
+
+					runConfig.Animation.Format = replayFormat
+					if outputFilePath == "" {
+						extension, err := animationExtension(replayFormat)
+						if err != nil {
+							return err
+						}
+						outputFilePath = fmt.Sprintf("./res/%s_%d-seeds_replay%s", imageName, runConfig.NumSeeds, extension)
+					}
+					return runReplayAnimation(
+						moveLogFilePath,
+						replayIteration,
+						iterationsPerFrame,
+						replayScale,
+						outputFilePath,
+						runConfig.Animation,
+					)
+				},
+			},
+			{
+				Name:    "animate",
+				Aliases: []string{"a"},
+				Usage:   "Builds the time-lapse of a previous run from the snapshots it saved",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "format",
+						Aliases:     []string{"f"},
+						Usage:       "Format of the time-lapse: gif, apng or avi (MJPEG video)",
+						Value:       defaultAnimateFormat,
+						Destination: &animateFormat,
+					},
+					&cli.StringFlag{
+						Name:        "output",
+						Aliases:     []string{"o"},
+						Usage:       "Path to the time-lapse `FILE`. If not set, it is placed next to the snapshots, with the extension of the format",
+						Destination: &outputFilePath,
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					runConfig.Animation.Format = animateFormat
+					imageName := getImageName(runConfig.TargetImage)
+					if outputFilePath == "" {
+						path, err := animationPath(imageName, runConfig.NumSeeds, animateFormat)
+						if err != nil {
+							return err
+						}
+						outputFilePath = path
+					}
+
+					return runAnimate(
+						imageName,
+						runConfig.NumSeeds,
+						outputFilePath,
+						runConfig.Animation,
+					)
+				},
+			},
 		},
 	}
 
 	// run the cli
 	if err := app.Run(os.Args); err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
 
-// getTargetImage reads the target image at the specified path, and extracts the RGB values of each pixel
-func getTargetImage(inputImageFilePath string) TargetImage {
-
-	// get file name stripped from path and extension
+// getImageName returns the name of the image at the specified path, stripped from path and extension.
+// It is used to name all the files produced for a target image
+func getImageName(inputImageFilePath string) string {
 	fileNameWithExt := filepath.Base(inputImageFilePath)
 	fileExtension := filepath.Ext(inputImageFilePath)
-	fileName := strings.Replace(fileNameWithExt, fileExtension, "", 1)
+	return strings.Replace(fileNameWithExt, fileExtension, "", 1)
+}
 
-	// open the image file
-	reader, openErr := os.Open(inputImageFilePath)
-	if openErr != nil {
-		panic(openErr)
+// getTargetImage reads the target image at the specified path, and extracts the RGBA values of each pixel
+func getTargetImage(inputImageFilePath string) (TargetImage, error) {
+	i, err := decodeImage(inputImageFilePath)
+	if err != nil {
+		return TargetImage{}, err
 	}
-	defer reader.Close()
 
-	// decode the image using the JPG decoder
-	image, _, decodeErr := image.Decode(reader)
-	if decodeErr != nil {
-		panic(decodeErr)
-	}
-	bounds := image.Bounds()
+	return TargetImage{
+		Name:   getImageName(inputImageFilePath),
+		Bytes:  i.Pix,
+		Width:  i.Rect.Dx(),
+		Height: i.Rect.Dy(),
+	}, nil
+}
 
-	// extract the 8-bit RGBA values of the pixels
-	imageBytes := []byte{}
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, a := image.At(x, y).RGBA()
-			imageBytes = append(
-				imageBytes,
-				byte(r/256),
-				byte(g/256),
-				byte(b/256),
-				byte(a/256),
-			)
+// loadTarget reads the target image of a run, together with its weight map if any.
+// The transparent pixels of the target get no weight, so they are left out of the cost
+func loadTarget(config RunConfig) (TargetImage, error) {
+	targetImage, err := getTargetImage(config.TargetImage)
+	if err != nil {
+		return TargetImage{}, err
+	}
+	if config.WeightMap == "auto" {
+		// estimate the weight map from the saliency of the target, saving it for inspection
+		targetImage.Weights = saliencyMap(targetImage)
+		err = savePNG(
+			fmt.Sprintf("./res/%s_saliency.png", targetImage.Name),
+			weightMapImage(targetImage.Weights, targetImage.Width, targetImage.Height),
+		)
+		if err != nil {
+			return TargetImage{}, err
+		}
+	} else if config.WeightMap != "" {
+		weights, err := loadWeightMap(config.WeightMap, targetImage.Width, targetImage.Height)
+		if err != nil {
+			return TargetImage{}, err
 		}
+		targetImage.Weights = weights
 	}
-
-	return TargetImage{
-		Name:   fileName,
-		Bytes:  imageBytes,
-		Width:  bounds.Max.X - bounds.Min.X,
-		Height: bounds.Max.Y - bounds.Min.Y,
+	if targetImage.alphaMask() != nil {
+		targetImage.Weights, err = targetImage.maskTransparentPixels()
+		if err != nil {
+			return TargetImage{}, err
+		}
 	}
+
+	return targetImage, nil
 }
 
-// runSimulatedAnnealing initializes the structs needed to run the simulation, and starts it
+// runSimulatedAnnealing initializes the structs needed to run the simulation, and starts it.
+// If a checkpoint is given, the simulation continues from its state rather than from a random solution
 func runSimulatedAnnealing(
 	targetImage TargetImage,
-	numSeeds int,
-	simulationDuration time.Duration,
-	snapshotsInterval time.Duration,
+	config RunConfig,
+	headless bool,
+	checkpoint *Checkpoint,
 ) {
 
-	// create a file that logs the temperature progresses in function of time since the start of the simulation, for further analysis
-	statFile, err := os.Create(
-		fmt.Sprintf("./res/%s_%d-seeds.csv",
-			targetImage.Name,
-			numSeeds,
-		))
+	// create a file that logs the cost and temperature progresses in function of time since the start of the simulation, for further analysis.
+	// A resumed run appends to the file of the original one
+	statFilePath := fmt.Sprintf("./res/%s_%d-seeds.csv",
+		targetImage.Name,
+		config.NumSeeds,
+	)
+	var statFile *os.File
+	var err error
+	if checkpoint != nil {
+		statFile, err = os.OpenFile(statFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	} else {
+		statFile, err = os.Create(statFilePath)
+	}
 	if err != nil {
 		panic(err)
 	}
+	defer statFile.Close()
+	statFiles := []*os.File{}
+	defer func() {
+		for _, f := range statFiles {
+			f.Close()
+		}
+	}()
 
-	// initialize the Voronoi diagram
-	voronoi, vErr := NewVoronoi(
-		targetImage.Width,
-		targetImage.Height,
-		numSeeds,
-	)
-	if vErr != nil {
-		panic(vErr)
+	// the random seed of the run drives the random numbers of both the diagram and the annealing
+	randomSeeds := newRandomSource(config.RandomSeed)
+
+	// the metric is shared by the diagrams of all the replicas
+	metricConfig := config.Metric
+	if metricConfig.MaxWeight == 0 {
+		metricConfig.MaxWeight = math.Sqrt(float64(targetImage.Width*targetImage.Height) / (math.Pi * float64(config.NumSeeds)))
+	}
+	metric, mErr := NewMetric(metricConfig)
+	if mErr != nil {
+		panic(mErr)
+	}
+	costFunction, cErr := NewCostFunction(config.CostFunction, targetImage)
+	if cErr != nil {
+		panic(cErr)
 	}
 
-	// initialize the simulated annealing
-	simulatedAnnealing, saErr := NewSimulatedAnnealing(
-		voronoi,
-		targetImage,
-		statFile,
-	)
+	// newAnnealing creates an annealing engine, with its own Voronoi diagram.
+	// The replicas of the parallel tempering, besides the first one, log their stats in files of their own
+	newAnnealing := func(coolingConfig CoolingConfig, replica int) (*SimulatedAnnealing, error) {
+		voronoi, err := NewVoronoi(
+			targetImage.Width,
+			targetImage.Height,
+			config.NumSeeds,
+			config.Tessellator,
+			metric,
+			randomSeeds.Int63(),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		replicaStatFile := statFile
+		if replica > 0 {
+			path := fmt.Sprintf("./res/%s_%d-seeds_replica-%d.csv", targetImage.Name, config.NumSeeds, replica)
+			if checkpoint != nil {
+				replicaStatFile, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			} else {
+				replicaStatFile, err = os.Create(path)
+			}
+			if err != nil {
+				return nil, err
+			}
+			statFiles = append(statFiles, replicaStatFile)
+		}
+
+		annealing, err := NewSimulatedAnnealing(
+			voronoi,
+			targetImage,
+			costFunction,
+			config.Structure,
+			replicaStatFile,
+			config.SimulationDuration,
+			coolingConfig,
+			config.Acceptance,
+			config.Colors,
+			config.DebugCostInterval,
+			randomSeeds.Int63(),
+			config.Workers,
+		)
+		if err != nil {
+			return nil, err
+		}
+		annealing.WithIterations(config.Iterations)
+		return annealing, nil
+	}
+
+	// anneal the coarse levels of the pyramid first, if requested, unless the run is resumed from a checkpoint of the native resolution.
+	// If they get interrupted, their best solution is still carried over to the native resolution, and saved right away
+	var coarse *AnnealingState
+	var coarseSeeds []Point
+	interrupted := false
+	if config.Pyramid.Levels > 1 && checkpoint == nil {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		state, seeds, err := annealPyramid(ctx, targetImage, config, metricConfig, statFile, randomSeeds)
+		interrupted = ctx.Err() != nil
+		stop()
+		if err != nil {
+			panic(err)
+		}
+		coarse, coarseSeeds = &state, seeds
+		if interrupted {
+			fmt.Println("Interrupted while annealing the coarse levels of the pyramid, saving their best solution")
+		}
+	}
+
+	// initialize the simulated annealing, or its replicas.
+	// A resumed run keeps the initial temperature of the original one, so it is not calibrated again, as does the native level of the pyramid
+	coolingConfig := config.Cooling
+	if checkpoint != nil {
+		coolingConfig.InitialTemperature = checkpoint.State.InitialTemperature
+		if checkpoint.State.FinalTemperature > 0 {
+			coolingConfig.FinalTemperature = checkpoint.State.FinalTemperature
+		}
+	} else if coarse != nil {
+		coolingConfig.InitialTemperature = coarse.InitialTemperature
+		coolingConfig.FinalTemperature = coarse.FinalTemperature
+	}
+	var simulatedAnnealing SimulatedAnnealingEngine
+	var singleAnnealing *SimulatedAnnealing
+	var parallelTempering *ParallelTempering
+	var saErr error
+	if config.Tempering.Replicas > 1 {
+		parallelTempering, saErr = NewParallelTempering(config.Tempering, coolingConfig, newAnnealing, randomSeeds.Int63())
+		simulatedAnnealing = parallelTempering
+	} else {
+		singleAnnealing, saErr = newAnnealing(coolingConfig, 0)
+		simulatedAnnealing = singleAnnealing
+	}
 	if saErr != nil {
 		panic(saErr)
 	}
 
-	// initialize the canvas for the GUI
-	c, cErr := NewCanvas(
+	// run the simulation, either in a window or in a plain loop
+	snapshots := NewSnapshotter(
 		targetImage.Name,
-		numSeeds,
-		targetImage.Width,
-		targetImage.Height,
-		simulatedAnnealing,
-		simulationDuration,
-		snapshotsInterval,
+		config.NumSeeds,
+		config.SnapshotsInterval,
+		metricConfig,
+		targetImage.alphaMask(),
 	)
-	if cErr != nil {
-		panic(cErr)
+
+	// save the checkpoints of the run, if requested
+	if config.CheckpointInterval > 0 {
+		snapshots.WithCheckpoints(
+			checkpointPath(targetImage.Name, config.NumSeeds),
+			config.CheckpointInterval,
+			config,
+			targetImage,
+		)
+	}
+
+	// continue from the checkpoint, for the time left to the simulation
+	simulationDuration := config.SimulationDuration
+	if checkpoint != nil {
+		if err := simulatedAnnealing.Restore(checkpoint.State); err != nil {
+			panic(err)
+		}
+		snapshots.Resume(checkpoint.State.Elapsed)
+		simulationDuration -= checkpoint.State.Elapsed
+	}
+
+	// or from the solution of the coarse levels of the pyramid, for the time they left to the native resolution
+	if coarse != nil {
+		if err := singleAnnealing.Refine(*coarse, coarseSeeds); err != nil {
+			panic(err)
+		}
+		snapshots.Resume(coarse.Elapsed)
+		simulationDuration -= coarse.Elapsed
+	}
+
+	// record the time-lapse of the simulation, if requested
+	if config.Animation.Format != "" {
+		path, err := animationPath(targetImage.Name, config.NumSeeds, config.Animation.Format)
+		if err != nil {
+			panic(err)
+		}
+		animation, err := NewAnimationWriter(path, config.Animation)
+		if err != nil {
+			panic(err)
+		}
+		snapshots.WithAnimation(animation, config.Animation, config.FrameInterval)
 	}
 
-	// initialize the system window size and title
-	ebiten.SetWindowTitle(
-		fmt.Sprintf("Voronoi Simulated Annealing (%d seeds)", numSeeds))
-	ebiten.SetWindowSize(targetImage.Width, targetImage.Height)
+	// record the accepted moves of the simulation, if requested. A resumed run appends to the log of the original one, past the moves up to the checkpoint
+	var moves *MoveLog
+	if config.MoveLog {
+		header, err := NewSolution(targetImage.Width, targetImage.Height, metricConfig, nil, targetImage.alphaMask())
+		if err != nil {
+			panic(err)
+		}
+		if checkpoint != nil {
+			moves, err = ResumeMoveLog(moveLogPath(targetImage.Name, config.NumSeeds), header, checkpoint.State.Iterations)
+		} else {
+			moves, err = NewMoveLog(moveLogPath(targetImage.Name, config.NumSeeds), header)
+		}
+		if err != nil {
+			panic(err)
+		}
+		if err := singleAnnealing.WithMoveLog(moves); err != nil {
+			panic(err)
+		}
+	}
 
-	// run the simulation
-	if err := ebiten.RunGame(c); err != nil {
-		if err == SimulationCompleted {
-			return
+	// describe the run in its manifest, next to its stats. A resumed run updates the manifest of the original one
+	manifestFilePath := manifestPath(targetImage.Name, config.NumSeeds)
+	manifest := NewManifest(config, targetImage)
+	if checkpoint != nil {
+		if original, err := loadManifest(manifestFilePath); err == nil && original.TargetHash == manifest.TargetHash {
+			manifest = original
 		}
+		manifest.ResumedAt = append(manifest.ResumedAt, time.Now())
+		manifest.EndedAt = nil
+	}
+	if err := saveManifest(manifestFilePath, manifest); err != nil {
+		panic(err)
+	}
+
+	// an interrupted pyramid skips the native resolution, straight to the saving of its solution (and of the checkpoint to resume it from)
+	var runErr error
+	switch {
+	case interrupted:
+	case headless:
+		runErr = runHeadless(
+			simulatedAnnealing,
+			simulationDuration,
+			snapshots,
+		)
+	default:
+		runErr = runGUI(
+			targetImage,
+			config.NumSeeds,
+			simulatedAnnealing,
+			simulationDuration,
+			snapshots,
+		)
+	}
+	if runErr != nil {
+		panic(runErr)
+	}
+	if moves != nil {
+		if err := moves.Close(); err != nil {
+			panic(err)
+		}
+	}
+	if parallelTempering != nil {
+		fmt.Printf("Accepted %.1f%% of the exchanges between the replicas\n", 100*parallelTempering.ExchangeRate())
+	}
+
+	// save the best solution found during the simulation
+	if err := snapshots.SaveBest(simulatedAnnealing); err != nil {
+		panic(err)
+	}
+
+	endedAt := time.Now()
+	manifest.EndedAt = &endedAt
+	if err := saveManifest(manifestFilePath, manifest); err != nil {
 		panic(err)
 	}
 }
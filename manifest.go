@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Manifest describes a run of the annealing, so that it can be reproduced: how the tool was invoked, with which parameters
+// and random seed, against which target, and when the run started and ended
+type Manifest struct {
+	ToolVersion string      `json:"toolVersion"`
+	Arguments   []string    `json:"arguments"` // command line of the run
+	RandomSeed  int64       `json:"randomSeed"`
+	TargetHash  string      `json:"targetHash"` // SHA-256 of the size and of the pixels of the target image
+	StartedAt   time.Time   `json:"startedAt"`
+	ResumedAt   []time.Time `json:"resumedAt,omitempty"` // times at which the run has been resumed from a checkpoint
+	EndedAt     *time.Time  `json:"endedAt,omitempty"`   // missing while the run is in progress, or if it didn't complete
+	Config      RunConfig   `json:"config"`
+}
+
+// NewManifest creates the manifest of a run starting now, with the command line of the current process
+func NewManifest(config RunConfig, targetImage TargetImage) Manifest {
+	return Manifest{
+		ToolVersion: toolVersion(),
+		Arguments:   os.Args[1:],
+		RandomSeed:  config.RandomSeed,
+		TargetHash:  targetHash(targetImage),
+		StartedAt:   time.Now(),
+		Config:      config,
+	}
+}
+
+// manifestPath returns the path of the manifest of the run with the given target image and number of seeds, next to its stats
+func manifestPath(imageName string, numSeeds int) string {
+	return fmt.Sprintf("./res/%s_%d-seeds_manifest.json", imageName, numSeeds)
+}
+
+// toolVersion returns the version of the tool, as recorded by the go toolchain in the binary:
+// the version of the module and, if it has been built from a git checkout, the commit it has been built from
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	details := []string{}
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision":
+			details = append(details, setting.Value)
+		case setting.Key == "vcs.modified" && setting.Value == "true":
+			details = append(details, "modified")
+		}
+	}
+	if len(details) == 0 {
+		return info.Main.Version
+	}
+	return fmt.Sprintf("%s (%s)", info.Main.Version, strings.Join(details, ", "))
+}
+
+// saveManifest encodes the manifest into an indented json file at the given path
+func saveManifest(path string, manifest Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// loadManifest reads the manifest stored in the json file at the given path
+func loadManifest(path string) (Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return Manifest{}, fmt.Errorf("Invalid manifest file '%s': %w", path, err)
+	}
+	return manifest, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// MetricConfig contains the parameters of the distance metric of the diagram
+type MetricConfig struct {
+	Name       string  // name of the metric (euclidean, manhattan, chebyshev, minkowski, anisotropic, power, additive)
+	P          float64 // exponent of the minkowski metric
+	MaxStretch float64 // maximum elongation of the cells of the anisotropic metric
+	MaxWeight  float64 // maximum weight of the seeds of the weighted metrics (power, additive), in pixels
+}
+
+// Metric measures how far a point is from a seed, to assign each pixel to the cell of the closest seed
+type Metric interface {
+	// Name returns the name of the metric, as selected from the CLI
+	Name() string
+
+	// Distance returns a value growing with the distance of a point from the seed, given its relative coordinates.
+	// It's not necessarily the distance itself (e.g. the euclidean metric skips the square root), but it compares the same way
+	Distance(seed Point, dx int, dy int) float64
+
+	// MinDistance returns a lower bound of the distance from the seed of the points lying at the given chebyshev distance from it
+	// (the largest between the horizontal and vertical ones), not decreasing as the radius grows
+	MinDistance(seed Point, radius int) float64
+}
+
+// perSeedMetric is a metric depending on some attributes of the seeds (e.g. their weight),
+// that are searched by the annealing together with the positions of the seeds
+type perSeedMetric interface {
+	Metric
+
+	// randomAttributes assigns random attributes to a new seed
+	randomAttributes(seed *Point, r *rand.Rand)
+
+	// perturbateAttributes assigns a variation of its current attributes to a seed
+	perturbateAttributes(seed *Point, r *rand.Rand)
+}
+
+// NewMetric creates the distance metric described by the config
+func NewMetric(config MetricConfig) (Metric, error) {
+	switch config.Name {
+	case "euclidean":
+		return &euclideanMetric{}, nil
+	case "manhattan":
+		return &manhattanMetric{}, nil
+	case "chebyshev":
+		return &chebyshevMetric{}, nil
+	case "minkowski":
+		if config.P < 1 {
+			return nil, fmt.Errorf("Minkowski exponent must be at least 1, got %g", config.P)
+		}
+		return &minkowskiMetric{p: config.P}, nil
+	case "anisotropic":
+		if config.MaxStretch < 1 {
+			return nil, fmt.Errorf("Maximum stretch must be at least 1, got %g", config.MaxStretch)
+		}
+		return &anisotropicMetric{maxStretch: config.MaxStretch}, nil
+	case "power", "additive":
+		if config.MaxWeight < 0 {
+			return nil, fmt.Errorf("Maximum weight must not be negative, got %g", config.MaxWeight)
+		}
+		if config.Name == "power" {
+			return &powerMetric{maxWeight: config.MaxWeight}, nil
+		}
+		return &additiveMetric{maxWeight: config.MaxWeight}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown metric '%s'", config.Name)
+}
+
+// euclideanMetric is the usual straight-line distance, giving convex polygonal cells
+type euclideanMetric struct{}
+
+func (m *euclideanMetric) Name() string { return "euclidean" }
+
+func (m *euclideanMetric) Distance(seed Point, dx int, dy int) float64 {
+	return float64(dx*dx + dy*dy)
+}
+
+func (m *euclideanMetric) MinDistance(seed Point, radius int) float64 {
+	return float64(radius * radius)
+}
+
+// manhattanMetric is the sum of the horizontal and vertical distances, giving cells bounded by diagonal and axis-aligned edges
+type manhattanMetric struct{}
+
+func (m *manhattanMetric) Name() string { return "manhattan" }
+
+func (m *manhattanMetric) Distance(seed Point, dx int, dy int) float64 {
+	return float64(abs(dx) + abs(dy))
+}
+
+func (m *manhattanMetric) MinDistance(seed Point, radius int) float64 {
+	return float64(radius)
+}
+
+// chebyshevMetric is the largest between the horizontal and vertical distances, giving square-looking cells
+type chebyshevMetric struct{}
+
+func (m *chebyshevMetric) Name() string { return "chebyshev" }
+
+func (m *chebyshevMetric) Distance(seed Point, dx int, dy int) float64 {
+	if abs(dx) > abs(dy) {
+		return float64(abs(dx))
+	}
+	return float64(abs(dy))
+}
+
+func (m *chebyshevMetric) MinDistance(seed Point, radius int) float64 {
+	return float64(radius)
+}
+
+// minkowskiMetric is the Lp distance, going from the manhattan metric (p=1) through the euclidean one (p=2)
+// towards the chebyshev one (as p grows)
+type minkowskiMetric struct {
+	p float64
+}
+
+func (m *minkowskiMetric) Name() string { return "minkowski" }
+
+func (m *minkowskiMetric) Distance(seed Point, dx int, dy int) float64 {
+	return math.Pow(float64(abs(dx)), m.p) + math.Pow(float64(abs(dy)), m.p)
+}
+
+func (m *minkowskiMetric) MinDistance(seed Point, radius int) float64 {
+	return math.Pow(float64(radius), m.p)
+}
+
+// anisotropicMetric gives each seed its own elliptical metric, described by the Angle and the Stretch of the seed:
+// the distance along the major axis of the ellipse is shrunk by the stretch, and the one along the minor axis is grown by it.
+//
+// Since the metric depends on the seed, the cells are not necessarily convex, and the shapes of the seeds are searched by the annealing as well
+type anisotropicMetric struct {
+	maxStretch float64
+}
+
+func (m *anisotropicMetric) Name() string { return "anisotropic" }
+
+func (m *anisotropicMetric) Distance(seed Point, dx int, dy int) float64 {
+	stretch := seed.Stretch
+	if stretch <= 0 {
+		stretch = 1
+	}
+	sin, cos := math.Sincos(seed.Angle)
+
+	major := (float64(dx)*cos + float64(dy)*sin) / stretch
+	minor := (float64(dy)*cos - float64(dx)*sin) * stretch
+	return major*major + minor*minor
+}
+
+// MinDistance bounds the distance along the axis shrunk by the stretch.
+// The bound is lowered by a tiny fraction, since the rotation of the distances is subject to rounding errors
+func (m *anisotropicMetric) MinDistance(seed Point, radius int) float64 {
+	stretch := seed.Stretch
+	if stretch <= 0 {
+		stretch = 1
+	}
+	shrunk := float64(radius) / math.Max(stretch, 1/stretch)
+	return shrunk * shrunk * (1 - 1e-9)
+}
+
+// randomAttributes generates a random shape for the metric of a seed
+func (m *anisotropicMetric) randomAttributes(seed *Point, r *rand.Rand) {
+	seed.Angle = r.Float64() * math.Pi
+	seed.Stretch = math.Pow(m.maxStretch, r.Float64())
+}
+
+// perturbateAttributes computes a variation of the shape of the metric of a seed,
+// by rotating it by up to 45 degrees and by changing its stretch by up to a quarter of its range (in logarithmic scale)
+func (m *anisotropicMetric) perturbateAttributes(seed *Point, r *rand.Rand) {
+	seed.Angle = math.Mod(seed.Angle+(r.Float64()*2-1)*math.Pi/4+math.Pi, math.Pi)
+	stretch := math.Max(seed.Stretch, 1) * math.Pow(m.maxStretch, (r.Float64()*2-1)/4)
+	seed.Stretch = math.Min(math.Max(stretch, 1), m.maxStretch)
+}
+
+// powerMetric is the power distance, the squared euclidean distance minus the squared weight of the seed,
+// giving the power diagram (also known as Laguerre diagram): the heavier seeds get larger cells, that are still convex polygons.
+//
+// A seed can be so much lighter than a neighbour that its cell does not contain it, or is even empty
+type powerMetric struct {
+	maxWeight float64
+}
+
+func (m *powerMetric) Name() string { return "power" }
+
+func (m *powerMetric) Distance(seed Point, dx int, dy int) float64 {
+	return float64(dx*dx+dy*dy) - seed.Weight*seed.Weight
+}
+
+func (m *powerMetric) MinDistance(seed Point, radius int) float64 {
+	return float64(radius*radius) - seed.Weight*seed.Weight
+}
+
+func (m *powerMetric) randomAttributes(seed *Point, r *rand.Rand) {
+	seed.Weight = randomWeight(m.maxWeight, r)
+}
+
+func (m *powerMetric) perturbateAttributes(seed *Point, r *rand.Rand) {
+	seed.Weight = perturbateWeight(seed.Weight, m.maxWeight, r)
+}
+
+// additiveMetric is the euclidean distance minus the weight of the seed, giving the additively weighted voronoi diagram:
+// the heavier seeds get larger cells, bounded by hyperbolic arcs
+type additiveMetric struct {
+	maxWeight float64
+}
+
+func (m *additiveMetric) Name() string { return "additive" }
+
+func (m *additiveMetric) Distance(seed Point, dx int, dy int) float64 {
+	return math.Sqrt(float64(dx*dx+dy*dy)) - seed.Weight
+}
+
+func (m *additiveMetric) MinDistance(seed Point, radius int) float64 {
+	return float64(radius) - seed.Weight
+}
+
+func (m *additiveMetric) randomAttributes(seed *Point, r *rand.Rand) {
+	seed.Weight = randomWeight(m.maxWeight, r)
+}
+
+func (m *additiveMetric) perturbateAttributes(seed *Point, r *rand.Rand) {
+	seed.Weight = perturbateWeight(seed.Weight, m.maxWeight, r)
+}
+
+// randomWeight generates a random weight for a seed, between 0 and the maximum weight
+func randomWeight(maxWeight float64, r *rand.Rand) float64 {
+	return r.Float64() * maxWeight
+}
+
+// perturbateWeight computes a variation of the weight of a seed, by changing it by up to a quarter of its range
+func perturbateWeight(weight float64, maxWeight float64, r *rand.Rand) float64 {
+	weight += (r.Float64()*2 - 1) * maxWeight / 4
+	return math.Min(math.Max(weight, 0), maxWeight)
+}
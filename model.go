@@ -10,6 +10,11 @@ type SimulatedAnnealingEngine interface {
 	Iterate() error
 	ToPixels() []byte
 	GetSnapshot() image.Image
+	GetBestSnapshot() (image.Image, error)
+	GetBestSolution() []Point
+	GetState() AnnealingState
+	Restore(AnnealingState) error
+	Completed() bool
 }
 
 // VoronoiDiagram is the voronoi engine used by the annealing engine
@@ -18,25 +23,69 @@ type VoronoiDiagram interface {
 	Tessellate() error
 	Perturbate() error
 	ToPixels() []byte
+	PixelColor(int) color.RGBA
+	ChangedPixels() ([]int, bool)
 	ToImage() image.Image
+	SeedsToImage([]Point) (image.Image, error)
+	SeedsToCells([]Point) ([]Cell, error)
 	GetSeeds() []Point
 	WithSeeds([]Point)
+	GetDiagram() DiagramState
+	WithDiagram([]Point, DiagramState) error
+	GetRandomState() RandomState
+	WithRandomState(RandomState)
+	Rollback()
+	WithCellColors(ColorEstimator, []byte, bool)
+	WithWeightMap([]byte)
+	WithAlphaMask([]byte)
+	WithWorkers(int)
+	Recolor()
 }
 
 // TargetImage is the struct containing info about the target image: its name, size, and the RGBA values of its pixels
 type TargetImage struct {
-	Name   string
-	Bytes  []byte
-	Width  int
-	Height int
+	Name    string
+	Bytes   []byte
+	Width   int
+	Height  int
+	Weights []byte // importance of each pixel in the cost, from 0 to 255 (nil if all the pixels are equally important)
 }
 
-// Point is the struct modeling a point of the Voronoi diagram, with its position, color, and distance from the center of the seed
+// pixelWeight returns the importance of a pixel in the cost
+func (t TargetImage) pixelWeight(p int) int {
+	if t.Weights == nil {
+		return 1
+	}
+	return int(t.Weights[p])
+}
+
+// totalWeight returns the total importance of the pixels in the cost
+func (t TargetImage) totalWeight() int64 {
+	if t.Weights == nil {
+		return int64(t.Width * t.Height)
+	}
+	total := int64(0)
+	for _, w := range t.Weights {
+		total += int64(w)
+	}
+	return total
+}
+
+// Point is the struct modeling a point of the Voronoi diagram, with its position and color
 type Point struct {
-	X        int
-	Y        int
-	Distance *int
-	Color    *color.RGBA
+	X     int
+	Y     int
+	Color *color.RGBA
+
+	// attributes of the seed only used by some metrics
+	Angle   float64 // orientation of the major axis of the ellipse of the anisotropic metric, in radians
+	Stretch float64 // elongation of the ellipse of the anisotropic metric (1, or 0, for a circle)
+	Weight  float64 // weight of the seed for the weighted metrics, as the radius (in pixels) of a disc around the seed
+}
+
+// SameSite reports whether two seeds generate the same cell, that is whether they only differ by their color
+func (p Point) SameSite(q Point) bool {
+	return p.X == q.X && p.Y == q.Y && p.Angle == q.Angle && p.Stretch == q.Stretch && p.Weight == q.Weight
 }
 
 // abs is a utility function to compute the absolute value of an int
@@ -46,3 +95,14 @@ func abs(x int) int {
 	}
 	return x
 }
+
+// clamp is a utility function to restrict an int to the interval [lo,hi]
+func clamp(x int, lo int, hi int) int {
+	if x < lo {
+		return lo
+	}
+	if x > hi {
+		return hi
+	}
+	return x
+}
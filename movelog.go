@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// moveLogMagic identifies the move logs, and it is followed by the version of their format
+const moveLogMagic = "VSAMOVES"
+
+// moveLogVersion is the version of the format of the move logs, increased at every incompatible change of the format
+const moveLogVersion = 1
+
+// moveLogFlushInterval is how often the buffered records are written to the file, so a crashed run loses at most this much of its log
+const moveLogFlushInterval = time.Second
+
+// kinds of the records of a move log
+const (
+	moveLogKeyframe byte = 'K' // all the seeds of the solution, written when a run starts or is resumed
+	moveLogMove     byte = 'M' // the seeds changed by an accepted move, with their old and new values
+)
+
+// parts of a seed changed by a move, as flags
+const (
+	changedPosition byte = 1 << iota
+	changedColor
+	changedAttributes
+)
+
+// MoveLog records the moves accepted by the annealing into a compact append-only binary file,
+// from which any intermediate solution of the run can be rebuilt.
+//
+// The file starts with a header describing the diagram (a solution without seeds, encoded as json), followed by the records:
+// each one has its kind, the iteration and the cost of the solution, and either all the seeds (keyframes)
+// or only the changed parts of the changed seeds (moves). Integers are varints and floats are little endian IEEE 754
+type MoveLog struct {
+	file      *os.File
+	out       *bufio.Writer
+	lastFlush time.Time
+	buffer    []byte // scratch buffer to encode the records
+}
+
+// NewMoveLog creates the move log at the given path, with the header describing the diagram
+func NewMoveLog(path string, header Solution) (*MoveLog, error) {
+	header.Seeds = nil
+	data, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &MoveLog{file: file, out: bufio.NewWriter(file), lastFlush: time.Now()}
+	l.out.WriteString(moveLogMagic)
+	l.buffer = binary.AppendUvarint(l.buffer[:0], moveLogVersion)
+	l.buffer = binary.AppendUvarint(l.buffer, uint64(len(data)))
+	l.out.Write(l.buffer)
+	l.out.Write(data)
+
+	return l, nil
+}
+
+// ResumeMoveLog reopens the move log of a run resumed from a checkpoint taken at the given iteration, to append the records of the resumed run.
+//
+// The records logged by the interrupted run past the checkpoint (the last one possibly truncated) are dropped, since the resumed run
+// performs those iterations again: the log keeps a single history of the run, with its iterations in order.
+// If the run has no log yet, a new one is created
+func ResumeMoveLog(path string, header Solution, iteration int) (*MoveLog, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && info.Size() == 0) {
+		return NewMoveLog(path, header)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := moveLogEnd(path, iteration)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(end); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(end, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &MoveLog{file: file, out: bufio.NewWriter(file), lastFlush: time.Now()}, nil
+}
+
+// moveLogEnd returns the offset in the move log at the given path right after its last complete record up to the given iteration
+func moveLogEnd(path string, iteration int) (int64, error) {
+	moves, err := OpenMoveLog(path)
+	if err != nil {
+		return 0, err
+	}
+	defer moves.Close()
+
+	end, err := moves.offset()
+	for err == nil {
+		record, nextErr := moves.Next()
+		if nextErr == io.EOF || (nextErr == nil && record.iteration > iteration) {
+			return end, nil
+		}
+		if nextErr != nil {
+			return 0, nextErr
+		}
+		end, err = moves.offset()
+	}
+	return 0, err
+}
+
+// Keyframe records all the seeds of the solution at the given iteration
+func (l *MoveLog) Keyframe(iteration int, cost float64, seeds []Point) error {
+	l.buffer = appendRecordHeader(l.buffer[:0], moveLogKeyframe, iteration, cost)
+	l.buffer = binary.AppendUvarint(l.buffer, uint64(len(seeds)))
+	for _, s := range seeds {
+		l.buffer = appendPosition(l.buffer, s)
+		l.buffer = appendColor(l.buffer, s)
+		l.buffer = appendAttributes(l.buffer, s)
+	}
+
+	return l.write()
+}
+
+// Move records the seeds changed from the previous solution to the current one, accepted at the given iteration.
+// Nothing is recorded if the solution didn't change
+func (l *MoveLog) Move(iteration int, cost float64, previous []Point, current []Point) error {
+	l.buffer = appendRecordHeader(l.buffer[:0], moveLogMove, iteration, cost)
+	changes := 0
+	countAt := len(l.buffer)
+	l.buffer = append(l.buffer, make([]byte, binary.MaxVarintLen64)...) // room for the number of changes, filled in below
+
+	for i := range current {
+		flags := seedChanges(previous[i], current[i])
+		if flags == 0 {
+			continue
+		}
+		changes++
+		l.buffer = binary.AppendUvarint(l.buffer, uint64(i))
+		l.buffer = append(l.buffer, flags)
+		for _, s := range []Point{previous[i], current[i]} {
+			if flags&changedPosition != 0 {
+				l.buffer = appendPosition(l.buffer, s)
+			}
+			if flags&changedColor != 0 {
+				l.buffer = appendColor(l.buffer, s)
+			}
+			if flags&changedAttributes != 0 {
+				l.buffer = appendAttributes(l.buffer, s)
+			}
+		}
+	}
+	if changes == 0 {
+		return nil
+	}
+
+	// move the changes right after the number of changes
+	count := binary.AppendUvarint(nil, uint64(changes))
+	n := copy(l.buffer[countAt:], count)
+	l.buffer = append(l.buffer[:countAt+n], l.buffer[countAt+binary.MaxVarintLen64:]...)
+
+	return l.write()
+}
+
+// write appends the encoded record to the log, flushing it to the file every flush interval
+func (l *MoveLog) write() error {
+	if _, err := l.out.Write(l.buffer); err != nil {
+		return err
+	}
+	if time.Since(l.lastFlush) > moveLogFlushInterval {
+		l.lastFlush = time.Now()
+		return l.out.Flush()
+	}
+	return nil
+}
+
+// Close writes the pending records and closes the file of the log
+func (l *MoveLog) Close() error {
+	err := l.out.Flush()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// seedChanges returns which parts of a seed differ between two versions of it, as flags
+func seedChanges(old Point, new Point) byte {
+	flags := byte(0)
+	if old.X != new.X || old.Y != new.Y {
+		flags |= changedPosition
+	}
+	if seedColor(old) != seedColor(new) {
+		flags |= changedColor
+	}
+	if old.Angle != new.Angle || old.Stretch != new.Stretch || old.Weight != new.Weight {
+		flags |= changedAttributes
+	}
+	return flags
+}
+
+// seedColor returns the color of a seed, black if it has none
+func seedColor(s Point) color.RGBA {
+	if s.Color == nil {
+		return color.RGBA{A: 255}
+	}
+	return *s.Color
+}
+
+func appendRecordHeader(buffer []byte, kind byte, iteration int, cost float64) []byte {
+	buffer = append(buffer, kind)
+	buffer = binary.AppendUvarint(buffer, uint64(iteration))
+	return binary.LittleEndian.AppendUint64(buffer, math.Float64bits(cost))
+}
+
+func appendPosition(buffer []byte, s Point) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(s.X))
+	return binary.AppendUvarint(buffer, uint64(s.Y))
+}
+
+func appendColor(buffer []byte, s Point) []byte {
+	c := seedColor(s)
+	return append(buffer, c.R, c.G, c.B)
+}
+
+func appendAttributes(buffer []byte, s Point) []byte {
+	for _, v := range []float64{s.Angle, s.Stretch, s.Weight} {
+		buffer = binary.LittleEndian.AppendUint64(buffer, math.Float64bits(v))
+	}
+	return buffer
+}
+
+// moveLogPath returns the path of the move log of the run with the given target image and number of seeds
+func moveLogPath(imageName string, numSeeds int) string {
+	return fmt.Sprintf("./res/%s_%d-seeds_moves.log", imageName, numSeeds)
+}
+
+// MoveLogReader reads the records of a move log, rebuilding the solutions of the run one record at a time
+type MoveLogReader struct {
+	file   *os.File
+	in     *bufio.Reader
+	path   string
+	Header Solution // description of the diagram, without seeds
+
+	// solution resulting from the records applied so far (no seeds before the first keyframe)
+	Seeds     []Point
+	Iteration int
+	Cost      float64
+}
+
+// moveLogRecord is a record of a move log
+type moveLogRecord struct {
+	kind      byte
+	iteration int
+	cost      float64
+	seeds     []Point      // all the seeds (keyframes only)
+	changes   []seedChange // the changed seeds (moves only)
+}
+
+// seedChange is a seed changed by a move, with only the changed parts set in its old and new versions
+type seedChange struct {
+	index int
+	flags byte
+	old   Point
+	new   Point
+}
+
+// OpenMoveLog opens the move log at the given path, reading its header
+func OpenMoveLog(path string) (*MoveLogReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &MoveLogReader{file: file, in: bufio.NewReader(file), path: path}
+
+	invalid := func(err error) (*MoveLogReader, error) {
+		file.Close()
+		return nil, fmt.Errorf("Invalid move log '%s': %w", path, err)
+	}
+	magic := make([]byte, len(moveLogMagic))
+	if _, err := io.ReadFull(r.in, magic); err != nil || string(magic) != moveLogMagic {
+		return invalid(errors.New("not a move log"))
+	}
+	version, err := binary.ReadUvarint(r.in)
+	if err != nil {
+		return invalid(err)
+	}
+	if version != moveLogVersion {
+		file.Close()
+		return nil, fmt.Errorf("Unsupported move log '%s': version %d, expected %d", path, version, moveLogVersion)
+	}
+	size, err := binary.ReadUvarint(r.in)
+	if err != nil {
+		return invalid(err)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.in, data); err != nil {
+		return invalid(err)
+	}
+	if err := json.Unmarshal(data, &r.Header); err != nil {
+		return invalid(err)
+	}
+	if _, err := r.Header.Alpha(); err != nil || r.Header.Width <= 0 || r.Header.Height <= 0 {
+		return invalid(errors.New("the header doesn't describe a diagram"))
+	}
+
+	return r, nil
+}
+
+// offset returns the position in the file of the next record to read
+func (r *MoveLogReader) offset() (int64, error) {
+	position, err := r.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	return position - int64(r.in.Buffered()), nil
+}
+
+// Next reads the next record of the log, without applying it.
+// It returns io.EOF at the end of the log: a record truncated by the end of the file (e.g. written by a killed run) counts as the end
+func (r *MoveLogReader) Next() (moveLogRecord, error) {
+	record, err := r.readRecord()
+	if err == io.ErrUnexpectedEOF {
+		return moveLogRecord{}, io.EOF
+	}
+	if err != nil && err != io.EOF {
+		return moveLogRecord{}, fmt.Errorf("Invalid move log '%s': %w", r.path, err)
+	}
+	return record, err
+}
+
+func (r *MoveLogReader) readRecord() (moveLogRecord, error) {
+	record := moveLogRecord{}
+	kind, err := r.in.ReadByte()
+	if err != nil {
+		return record, err
+	}
+	record.kind = kind
+
+	// past the kind of the record, the end of the file means that the record is truncated
+	fields := &fieldReader{in: r.in}
+	record.iteration = fields.int()
+	record.cost = fields.float()
+	count := fields.int()
+
+	switch kind {
+	case moveLogKeyframe:
+		record.seeds = make([]Point, 0, count)
+		for i := 0; i < count && fields.err == nil; i++ {
+			s := Point{}
+			fields.position(&s)
+			fields.color(&s)
+			fields.attributes(&s)
+			record.seeds = append(record.seeds, s)
+		}
+	case moveLogMove:
+		for i := 0; i < count && fields.err == nil; i++ {
+			change := seedChange{index: fields.int(), flags: fields.byte()}
+			for _, s := range []*Point{&change.old, &change.new} {
+				if change.flags&changedPosition != 0 {
+					fields.position(s)
+				}
+				if change.flags&changedColor != 0 {
+					fields.color(s)
+				}
+				if change.flags&changedAttributes != 0 {
+					fields.attributes(s)
+				}
+			}
+			record.changes = append(record.changes, change)
+		}
+	default:
+		return record, fmt.Errorf("unknown record kind %d", kind)
+	}
+
+	if fields.err == io.EOF {
+		return record, io.ErrUnexpectedEOF
+	}
+	return record, fields.err
+}
+
+// Apply applies a record to the current solution.
+// The old values of the changed seeds are checked against the current solution, to detect corrupted or mismatched logs
+func (r *MoveLogReader) Apply(record moveLogRecord) error {
+	if record.kind == moveLogKeyframe {
+		r.Seeds = record.seeds
+	} else {
+		if r.Seeds == nil {
+			return fmt.Errorf("Invalid move log '%s': moves recorded before the first keyframe", r.path)
+		}
+		seeds := append([]Point{}, r.Seeds...)
+		for _, change := range record.changes {
+			if change.index >= len(seeds) {
+				return fmt.Errorf("Invalid move log '%s': unknown seed %d at iteration %d", r.path, change.index, record.iteration)
+			}
+			s := &seeds[change.index]
+			if seedChanges(*s, mergeSeedChange(*s, change.old, change.flags))&change.flags != 0 {
+				return fmt.Errorf("Invalid move log '%s': seed %d at iteration %d doesn't match the previous moves", r.path, change.index, record.iteration)
+			}
+			*s = mergeSeedChange(*s, change.new, change.flags)
+		}
+		r.Seeds = seeds
+	}
+
+	r.Iteration = record.iteration
+	r.Cost = record.cost
+	return nil
+}
+
+// Close closes the file of the log
+func (r *MoveLogReader) Close() error {
+	return r.file.Close()
+}
+
+// mergeSeedChange returns a seed with the parts set by the flags taken from the change
+func mergeSeedChange(s Point, change Point, flags byte) Point {
+	if flags&changedPosition != 0 {
+		s.X, s.Y = change.X, change.Y
+	}
+	if flags&changedColor != 0 {
+		s.Color = change.Color
+	}
+	if flags&changedAttributes != 0 {
+		s.Angle, s.Stretch, s.Weight = change.Angle, change.Stretch, change.Weight
+	}
+	return s
+}
+
+// fieldReader decodes the fields of a record, keeping the first error so the fields can be read in a row
+type fieldReader struct {
+	in  *bufio.Reader
+	err error
+}
+
+func (f *fieldReader) int() int {
+	if f.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(f.in)
+	if err == nil && v > math.MaxInt32 {
+		err = errors.New("value out of range")
+	}
+	f.err = err
+	return int(v)
+}
+
+func (f *fieldReader) byte() byte {
+	if f.err != nil {
+		return 0
+	}
+	b, err := f.in.ReadByte()
+	f.err = err
+	return b
+}
+
+func (f *fieldReader) float() float64 {
+	if f.err != nil {
+		return 0
+	}
+	var bits uint64
+	f.err = binary.Read(f.in, binary.LittleEndian, &bits)
+	return math.Float64frombits(bits)
+}
+
+func (f *fieldReader) position(s *Point) {
+	s.X = f.int()
+	s.Y = f.int()
+}
+
+func (f *fieldReader) color(s *Point) {
+	s.Color = &color.RGBA{R: f.byte(), G: f.byte(), B: f.byte(), A: 255}
+}
+
+func (f *fieldReader) attributes(s *Point) {
+	s.Angle = f.float()
+	s.Stretch = f.float()
+	s.Weight = f.float()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeMoves logs a move of one seed per iteration, from the solution of the given iteration up to the last one,
+// returning the solution reached at each iteration
+func writeMoves(t *testing.T, moves *MoveLog, seeds []Point, from int, to int, dx int, dy int) map[int][]Point {
+	t.Helper()
+
+	solutions := map[int][]Point{from: seeds}
+	for iteration := from + 1; iteration <= to; iteration++ {
+		next := append([]Point{}, seeds...)
+		moved := &next[iteration%len(next)]
+		moved.X = (moved.X + dx) % 16
+		moved.Y = (moved.Y + dy) % 16
+		if err := moves.Move(iteration, float64(iteration), seeds, next); err != nil {
+			t.Fatal(err)
+		}
+		seeds = next
+		solutions[iteration] = seeds
+	}
+	return solutions
+}
+
+// assertSameSeeds fails the test if two solutions differ in any part of any seed
+func assertSameSeeds(t *testing.T, got []Point, expected []Point) {
+	t.Helper()
+
+	if len(got) != len(expected) {
+		t.Fatalf("got %d seeds, expected %d", len(got), len(expected))
+	}
+	for i := range got {
+		if seedChanges(got[i], expected[i]) != 0 {
+			t.Fatalf("seed %d is %+v, expected %+v", i, got[i], expected[i])
+		}
+	}
+}
+
+func TestMoveLogResume(t *testing.T) {
+	header, err := NewSolution(16, 16, MetricConfig{Name: "euclidean"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "moves.log")
+	initial := []Point{
+		{X: 1, Y: 1, Color: &color.RGBA{R: 255, A: 255}},
+		{X: 5, Y: 9, Color: &color.RGBA{G: 255, A: 255}},
+		{X: 12, Y: 3, Color: &color.RGBA{B: 255, A: 255}},
+	}
+
+	tests := []struct {
+		name       string
+		checkpoint int  // iteration of the checkpoint the run is resumed from
+		truncated  bool // whether the interrupted run left a truncated record at the end of the log
+	}{
+		{"resumed before the last move", 10, false},
+		{"resumed after a truncated record", 10, true},
+		{"resumed at the last move", 20, false},
+		{"resumed at the first keyframe", 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			// the interrupted run logs its moves past the checkpoint
+			moves, err := NewMoveLog(path, header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := moves.Keyframe(0, 0, initial); err != nil {
+				t.Fatal(err)
+			}
+			interrupted := writeMoves(t, moves, initial, 0, 20, 1, 0)
+			if err := moves.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if test.truncated {
+				file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				file.Write(binary.AppendUvarint([]byte{moveLogMove}, 21))
+				file.Close()
+			}
+
+			// the resumed run starts again from the checkpoint, taking a different path
+			moves, err = ResumeMoveLog(path, header, test.checkpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := moves.Keyframe(test.checkpoint, float64(test.checkpoint), interrupted[test.checkpoint]); err != nil {
+				t.Fatal(err)
+			}
+			resumed := writeMoves(t, moves, interrupted[test.checkpoint], test.checkpoint, test.checkpoint+5, 0, 1)
+			if err := moves.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the log holds the moves of the interrupted run up to the checkpoint, followed by the ones of the resumed run
+			for iteration := 0; iteration <= test.checkpoint+5; iteration++ {
+				reader, err := OpenMoveLog(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := replayUntil(reader, iteration); err != nil {
+					t.Fatal(err)
+				}
+				reader.Close()
+
+				expected := interrupted[iteration]
+				if iteration >= test.checkpoint {
+					expected = resumed[iteration]
+				}
+				if reader.Iteration != iteration {
+					t.Fatalf("replayed up to iteration %d, expected %d", reader.Iteration, iteration)
+				}
+				assertSameSeeds(t, reader.Seeds, expected)
+			}
+
+			// and nothing else
+			reader, err := OpenMoveLog(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			last := -1
+			for {
+				record, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.iteration < last {
+					t.Fatalf("iteration %d logged after iteration %d", record.iteration, last)
+				}
+				last = record.iteration
+			}
+			if last != test.checkpoint+5 {
+				t.Fatalf("the log ends at iteration %d, expected %d", last, test.checkpoint+5)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import "sync"
+
+// minChunkSize is the smallest number of items (e.g. pixels) worth handing to a worker:
+// smaller workloads are split among fewer workers, or processed right away
+const minChunkSize = 4096
+
+// forEachBand splits the rows of the canvas into (at most) as many horizontal bands as the workers,
+// and processes them concurrently, returning when all of them are done.
+//
+// Each band is identified by its first row (inclusive) and its last row (exclusive)
+func forEachBand(height int, workers int, process func(minY int, maxY int)) {
+	forEachChunk(height, workers, func(chunk int, start int, end int) {
+		process(start, end)
+	})
+}
+
+// forEachChunk splits the items from 0 to n (exclusive) into (at most) as many contiguous chunks as the workers,
+// and processes them concurrently, returning when all of them are done.
+//
+// Each chunk is identified by its index, in the order of the items, and by its first item (inclusive) and its last item (exclusive),
+// so that the results of the chunks can be merged in the same order as if the items were processed one after the other
+func forEachChunk(n int, workers int, process func(chunk int, start int, end int)) {
+	workers = chunksCount(n, workers)
+
+	// with a single worker there is no need to spawn any goroutine
+	if workers <= 1 {
+		process(0, 0, n)
+		return
+	}
+
+	var wg sync.WaitGroup
+	chunkSize := (n + workers - 1) / workers
+	for chunk, start := 0, 0; start < n; chunk, start = chunk+1, start+chunkSize {
+		end := start + chunkSize
+		if end > n {
+			end = n
+		}
+
+		wg.Add(1)
+		go func(chunk int, start int, end int) {
+			defer wg.Done()
+			process(chunk, start, end)
+		}(chunk, start, end)
+	}
+	wg.Wait()
+}
+
+// chunksCount returns the number of chunks the items from 0 to n are split into by forEachChunk, with the given workers
+func chunksCount(n int, workers int) int {
+	if workers > n {
+		workers = n
+	}
+	if workers < 1 {
+		return 1
+	}
+
+	// the chunks are as large as needed to cover the items with the workers, so the last ones may be left empty
+	chunkSize := (n + workers - 1) / workers
+	return (n + chunkSize - 1) / chunkSize
+}
+
+// parallelWorkers returns how many of the given workers are worth using on the given number of items,
+// so that each one gets at least minChunkSize of them
+func parallelWorkers(items int, workers int) int {
+	if workers > items/minChunkSize {
+		workers = items / minChunkSize
+	}
+	if workers < 1 {
+		return 1
+	}
+	return workers
+}
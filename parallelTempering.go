@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// TemperingConfig contains the parameters of the parallel tempering
+type TemperingConfig struct {
+	Replicas     int     // number of replicas of the annealing, each one at its own temperature (1 for a single annealing)
+	LadderRatio  float64 // ratio between the temperatures of two consecutive replicas of the ladder, in the interval (0,1)
+	SwapInterval int     // number of iterations of each replica between two rounds of exchanges
+}
+
+// TemperingState is the state of the parallel tempering saved in the checkpoints, besides the state of its hottest replica
+type TemperingState struct {
+	Replicas []AnnealingState `json:"replicas"` // states of the other replicas, from the second hottest to the coldest
+	Rounds   int              `json:"rounds"`   // number of rounds of exchanges performed so far
+	Random   RandomState      `json:"random"`   // state of the random numbers of the exchanges
+}
+
+// ParallelTempering runs several replicas of the annealing at once, on a ladder of temperatures, and exchanges their solutions.
+//
+// Each replica has its own diagram and cooling schedule, and the replicas iterate concurrently for a number of iterations,
+// after which the replicas at consecutive temperatures swap their solutions following the replica-exchange rule: a better solution
+// always moves to the colder replica, while a worse one moves there with a probability decreasing with the difference of the costs.
+// In this way the good solutions found by the hot replicas, free to explore the whole solution space, are refined by the cold ones,
+// and a cold replica stuck in a local minimum can escape it by climbing the ladder.
+//
+// The solutions are exchanged by swapping the cooling schedules of the replicas, which is equivalent and much cheaper
+// than swapping their diagrams. This only holds for the acceptance criteria driven by the temperature (metropolis and threshold),
+// which are also stateless, so the replicas don't have any other state tied to their level of the ladder.
+// The perturbations of all the replicas are scaled with respect to the temperature of the hottest one, so the colder replicas perform smaller moves
+type ParallelTempering struct {
+	mu           sync.RWMutex          // guards the ladder between the rounds and the renderings
+	replicas     []*SimulatedAnnealing // replicas of the annealing, ordered by their level in the ladder (hottest first)
+	swapInterval int                   // number of iterations of each replica between two rounds of exchanges
+	rounds       int                   // number of rounds of exchanges performed so far
+	source       *randomSource         // source of the random numbers of the exchanges, whose state is saved in the checkpoints
+	r            *rand.Rand            // generator for the random numbers of the exchanges
+	proposed     int                   // number of exchanges proposed so far
+	accepted     int                   // number of exchanges accepted so far
+}
+
+// NewParallelTempering creates the replicas of the parallel tempering, with the given function creating each replica of the annealing.
+//
+// The hottest replica gets the given cooling configuration (so its initial temperature is calibrated, if not provided),
+// and the temperatures of the other ones, initial and final, are lowered by the ratio of the ladder at each level.
+// The random numbers of the exchanges are generated from the given seed
+func NewParallelTempering(
+	config TemperingConfig,
+	coolingConfig CoolingConfig,
+	newReplica func(coolingConfig CoolingConfig, replica int) (*SimulatedAnnealing, error),
+	randomSeed int64,
+) (*ParallelTempering, error) {
+
+	if config.Replicas < 2 {
+		return nil, fmt.Errorf("Parallel tempering needs at least 2 replicas, got %d", config.Replicas)
+	}
+	if config.LadderRatio <= 0 || config.LadderRatio >= 1 {
+		return nil, fmt.Errorf("Ratio of the temperature ladder must be in the interval (0,1), got %g", config.LadderRatio)
+	}
+	if config.SwapInterval < 1 {
+		return nil, fmt.Errorf("Iterations between the exchanges must be positive, got %d", config.SwapInterval)
+	}
+
+	source := newRandomSource(randomSeed)
+	pt := &ParallelTempering{
+		swapInterval: config.SwapInterval,
+		source:       source,
+		r:            rand.New(source),
+	}
+
+	for level := 0; level < config.Replicas; level++ {
+		levelConfig := coolingConfig
+		if level > 0 {
+			levelConfig.InitialTemperature = pt.replicas[0].initialTemperature * math.Pow(config.LadderRatio, float64(level))
+			if coolingConfig.FinalTemperature > 0 {
+				levelConfig.FinalTemperature = coolingConfig.FinalTemperature * math.Pow(config.LadderRatio, float64(level))
+			}
+		}
+
+		replica, err := newReplica(levelConfig, level)
+		if err != nil {
+			return nil, err
+		}
+		replica.label = fmt.Sprintf("Replica %d", level)
+		if level > 0 {
+			replica.initialTemperature = pt.replicas[0].initialTemperature
+		}
+		pt.replicas = append(pt.replicas, replica)
+	}
+
+	return pt, nil
+}
+
+// Iterate runs a round of the parallel tempering: all the replicas iterate concurrently for the swap interval,
+// and then the replicas at consecutive levels of the ladder exchange their solutions
+func (pt *ParallelTempering) Iterate() error {
+	errs := make([]error, len(pt.replicas))
+	var wg sync.WaitGroup
+	for i, replica := range pt.replicas {
+		wg.Add(1)
+		go func(i int, replica *SimulatedAnnealing) {
+			defer wg.Done()
+			for j := 0; j < pt.swapInterval && errs[i] == nil && !replica.Completed(); j++ {
+				errs[i] = replica.Iterate()
+			}
+		}(i, replica)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	pt.exchange()
+	pt.rounds++
+	return nil
+}
+
+// exchange proposes the exchange of the solutions of the replicas at consecutive levels of the ladder.
+//
+// The pairs alternate between the rounds (the levels 0-1, 2-3... in the even rounds, and 1-2, 3-4... in the odd ones),
+// so that each replica takes part in at most one exchange per round. The exchange between a hotter and a colder replica
+// is accepted with probability min(1, exp((1/Th - 1/Tc) * (Eh - Ec))), given their temperatures and the costs of their solutions
+func (pt *ParallelTempering) exchange() {
+	for level := pt.rounds % 2; level+1 < len(pt.replicas); level += 2 {
+		hot, cold := pt.replicas[level], pt.replicas[level+1]
+		hotTemperature, coldTemperature := hot.cooling.Temperature(), cold.cooling.Temperature()
+		if hotTemperature <= 0 || coldTemperature <= 0 {
+			continue
+		}
+
+		pt.proposed++
+		exponent := (1/hotTemperature - 1/coldTemperature) * (hot.cost - cold.cost)
+		if exponent < 0 && pt.r.Float64() >= math.Exp(exponent) {
+			continue
+		}
+
+		pt.accepted++
+		hot.swapCooling(cold)
+		pt.replicas[level], pt.replicas[level+1] = cold, hot
+	}
+}
+
+// ToPixels returns the pixels of the current solution of the coldest replica
+func (pt *ParallelTempering) ToPixels() []byte {
+	return pt.coldest().ToPixels()
+}
+
+// GetSnapshot returns the image representation of the current solution of the coldest replica
+func (pt *ParallelTempering) GetSnapshot() image.Image {
+	return pt.coldest().GetSnapshot()
+}
+
+// GetBestSnapshot returns the image representation of the best solution found so far by any replica
+func (pt *ParallelTempering) GetBestSnapshot() (image.Image, error) {
+	return pt.best().GetBestSnapshot()
+}
+
+// GetBestSolution returns the best solution found so far by any replica
+func (pt *ParallelTempering) GetBestSolution() []Point {
+	return pt.best().GetBestSolution()
+}
+
+// coldest returns the replica at the lowest temperature of the ladder
+func (pt *ParallelTempering) coldest() *SimulatedAnnealing {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+
+	return pt.replicas[len(pt.replicas)-1]
+}
+
+// best returns the replica that found the best solution so far
+func (pt *ParallelTempering) best() *SimulatedAnnealing {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+
+	best := pt.replicas[0]
+	for _, replica := range pt.replicas[1:] {
+		if replica.BestCost() < best.BestCost() {
+			best = replica
+		}
+	}
+	return best
+}
+
+// GetState returns the state of the parallel tempering, from which the simulation can be resumed:
+// the state of the hottest replica, with the states of the other ones and of the exchanges
+func (pt *ParallelTempering) GetState() AnnealingState {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+
+	state := pt.replicas[0].GetState()
+	state.Tempering = &TemperingState{Rounds: pt.rounds, Random: pt.source.State()}
+	for _, replica := range pt.replicas[1:] {
+		state.Tempering.Replicas = append(state.Tempering.Replicas, replica.GetState())
+	}
+	return state
+}
+
+// Restore brings the parallel tempering back to a state saved in a checkpoint, so that the simulation continues from there.
+// The replicas must have been created with the same parameters of the checkpointed ones
+func (pt *ParallelTempering) Restore(state AnnealingState) error {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if state.Tempering == nil || len(state.Tempering.Replicas) != len(pt.replicas)-1 {
+		return fmt.Errorf("The state to restore doesn't have the %d replicas of the parallel tempering", len(pt.replicas))
+	}
+
+	states := append([]AnnealingState{state}, state.Tempering.Replicas...)
+	for level, replica := range pt.replicas {
+		if err := replica.Restore(states[level]); err != nil {
+			return err
+		}
+	}
+	pt.rounds = state.Tempering.Rounds
+	pt.source.Restore(state.Tempering.Random)
+
+	return nil
+}
+
+// Completed reports whether the replicas performed all of their iterations, if limited.
+// All the replicas iterate in lockstep, so they complete together
+func (pt *ParallelTempering) Completed() bool {
+	return pt.coldest().Completed()
+}
+
+// ExchangeRate returns the fraction of the proposed exchanges that has been accepted so far
+func (pt *ParallelTempering) ExchangeRate() float64 {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+
+	if pt.proposed == 0 {
+		return 0
+	}
+	return float64(pt.accepted) / float64(pt.proposed)
+}
@@ -0,0 +1,66 @@
+package main
+
+import "math"
+
+// PowerCells computes the exact cells of the power diagram of the seeds (see powerMetric), clipped to the image rectangle.
+//
+// Each cell is the image rectangle clipped by the power bisectors between its seed and all the other ones,
+// which are straight lines as in the euclidean case (but not necessarily lying between the two seeds).
+// The seeds lie at the center of their pixels, and overlapped seeds with the same weight follow the same rule of the tessellation:
+// the seed with the highest index owns the cell
+func PowerCells(seeds []Point, width int, height int) []Cell {
+	cells := make([]Cell, len(seeds))
+	for i := range seeds {
+		cells[i].Seed = i
+		polygon, labels := powerCell(seeds, i, width, height)
+		if len(polygon) < 3 {
+			continue
+		}
+
+		// the neighbours are the seeds whose bisectors survived the clipping
+		cells[i].Outlines = [][]Vertex{polygon}
+		found := map[int]bool{}
+		for k, label := range labels {
+			next := polygon[(k+1)%len(polygon)]
+			if label == -1 || found[label] || math.Hypot(next.X-polygon[k].X, next.Y-polygon[k].Y) < fortunePerturbation {
+				continue
+			}
+			found[label] = true
+			cells[i].Neighbours = append(cells[i].Neighbours, label)
+		}
+	}
+
+	return cells
+}
+
+// powerCell computes the polygon of the power cell of a seed, together with the labels of its edges (see clipToBisector)
+func powerCell(seeds []Point, seed int, width int, height int) ([]Vertex, []int) {
+	s := seeds[seed]
+	center := seedCenter(s)
+	polygon := []Vertex{{0, 0}, {float64(width), 0}, {float64(width), float64(height)}, {0, float64(height)}}
+	labels := []int{-1, -1, -1, -1}
+
+	for i, t := range seeds {
+		if i == seed {
+			continue
+		}
+		if t.X == s.X && t.Y == s.Y && t.Weight == s.Weight {
+			if i > seed {
+				return nil, nil
+			}
+			continue
+		}
+
+		// the points closer to the seed than to the other one, in the power distance, are the half-plane n·p <= c
+		other := seedCenter(t)
+		nx := other.X - center.X
+		ny := other.Y - center.Y
+		c := (other.X*other.X + other.Y*other.Y - center.X*center.X - center.Y*center.Y + s.Weight*s.Weight - t.Weight*t.Weight) / 2
+		polygon, labels = clipToHalfPlane(polygon, labels, nx, ny, c, i)
+		if len(polygon) == 0 {
+			return nil, nil
+		}
+	}
+
+	return polygon, labels
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+// PyramidConfig contains the parameters of the coarse-to-fine annealing
+type PyramidConfig struct {
+	Levels      int       // number of levels of the pyramid, each one half the size of the next one up to the native resolution (1 anneals at the native resolution only)
+	LevelShares []float64 // fraction of the simulation (its iterations, if limited, or else its duration) spent on each of the coarse levels, from the coarsest one (a single share applies to all of them)
+}
+
+// levelShare returns the fraction of the simulation spent on the given coarse level of the pyramid
+func (c PyramidConfig) levelShare(level int) float64 {
+	if len(c.LevelShares) == 1 {
+		return c.LevelShares[0]
+	}
+	return c.LevelShares[c.Levels-1-level]
+}
+
+// pyramidLevelSize returns the size of the target at the given level of the pyramid, halved at each level (0 is the native resolution)
+func pyramidLevelSize(width int, height int, level int) (int, int) {
+	scale := 1 << level
+	return (width + scale - 1) / scale, (height + scale - 1) / scale
+}
+
+// downscaleTarget returns the target image reduced to the given size, each of its pixels averaging the block of pixels it covers.
+// The weights of the pixels, if any, are averaged in the same way, as is the transparency
+func downscaleTarget(t TargetImage, width int, height int) TargetImage {
+	sums := make([]int, width*height*4)
+	counts := make([]int, width*height)
+	var weightSums []int
+	if t.Weights != nil {
+		weightSums = make([]int, width*height)
+	}
+
+	for y := 0; y < t.Height; y++ {
+		for x := 0; x < t.Width; x++ {
+			p := y*t.Width + x
+			q := (y*height/t.Height)*width + x*width/t.Width
+			for c := 0; c < 4; c++ {
+				sums[q*4+c] += int(t.Bytes[p*4+c])
+			}
+			if weightSums != nil {
+				weightSums[q] += int(t.Weights[p])
+			}
+			counts[q]++
+		}
+	}
+
+	downscaled := TargetImage{
+		Name:   t.Name,
+		Bytes:  make([]byte, width*height*4),
+		Width:  width,
+		Height: height,
+	}
+	for q, count := range counts {
+		for c := 0; c < 4; c++ {
+			downscaled.Bytes[q*4+c] = byte((sums[q*4+c] + count/2) / count)
+		}
+	}
+	if weightSums != nil {
+		downscaled.Weights = make([]byte, width*height)
+		for q, count := range counts {
+			downscaled.Weights[q] = byte((weightSums[q] + count/2) / count)
+		}
+	}
+
+	return downscaled
+}
+
+// scaleSeeds scales the seeds of a solution to a diagram of a different size.
+// Each seed is placed at the pixel under the center of its previous pixel, and its weight is scaled along with the distances,
+// up to the maximum weight of the new diagram
+func scaleSeeds(seeds []Point, fromWidth int, fromHeight int, toWidth int, toHeight int, maxWeight float64) []Point {
+	scaled := make([]Point, len(seeds))
+	for i, s := range seeds {
+		s.X = clamp((2*s.X+1)*toWidth/(2*fromWidth), 0, toWidth-1)
+		s.Y = clamp((2*s.Y+1)*toHeight/(2*fromHeight), 0, toHeight-1)
+		s.Weight = math.Min(s.Weight*float64(toWidth)/float64(fromWidth), maxWeight)
+		scaled[i] = s
+	}
+	return scaled
+}
+
+// annealPyramid anneals the coarse levels of the pyramid, from the coarsest one up to the one below the native resolution,
+// each one for its share of the iterations of the simulation, if limited, or else of its duration.
+//
+// The coarsest level starts from a random solution, calibrating the initial temperature if not provided, while each of the next levels
+// starts from the best solution of the previous one, scaled up to its size. The levels share the cooling and the clock of the simulation,
+// so the temperature keeps decreasing along the pyramid as in a single run, rescaled to the costs of each level. It returns the state
+// the last coarse level stopped at, with its best solution scaled to the native resolution, from which the annealing continues on the target itself.
+//
+// The coarse levels log their stats into the same file as the native one. If the context gets cancelled, the current level stops early,
+// and the state it stopped at is returned all the same, so that the work done so far is not lost
+func annealPyramid(
+	ctx context.Context,
+	targetImage TargetImage,
+	config RunConfig,
+	metricConfig MetricConfig,
+	statFile *os.File,
+	randomSeeds *randomSource,
+) (AnnealingState, []Point, error) {
+
+	if config.Pyramid.Levels < 2 {
+		return AnnealingState{}, nil, fmt.Errorf("The pyramid needs at least 2 levels, got %d", config.Pyramid.Levels)
+	}
+	if len(config.Pyramid.LevelShares) != 1 && len(config.Pyramid.LevelShares) != config.Pyramid.Levels-1 {
+		return AnnealingState{}, nil, fmt.Errorf(
+			"The pyramid needs a share of the simulation for each of its %d coarse levels, or a single one for all of them, got %d",
+			config.Pyramid.Levels-1,
+			len(config.Pyramid.LevelShares),
+		)
+	}
+	coarseShare := 0.0
+	for level := config.Pyramid.Levels - 1; level > 0; level-- {
+		share := config.Pyramid.levelShare(level)
+		if share <= 0 {
+			return AnnealingState{}, nil, fmt.Errorf("Share of the simulation of level %d of the pyramid must be positive, got %g", level, share)
+		}
+		coarseShare += share
+	}
+	if coarseShare >= 1 {
+		return AnnealingState{}, nil, fmt.Errorf("Shares of the simulation of the coarse levels of the pyramid must add up to less than 1, got %g", coarseShare)
+	}
+
+	coolingConfig := config.Cooling
+	var state AnnealingState
+	var seeds []Point
+	width, height := targetImage.Width, targetImage.Height
+	doneShare := 0.0
+	for level := config.Pyramid.Levels - 1; level > 0; level-- {
+		levelWidth, levelHeight := pyramidLevelSize(targetImage.Width, targetImage.Height, level)
+		levelTarget := downscaleTarget(targetImage, levelWidth, levelHeight)
+
+		// the weights of the seeds are in pixels, so their maximum shrinks with the level
+		levelMetricConfig := metricConfig
+		levelMetricConfig.MaxWeight = metricConfig.MaxWeight * float64(levelWidth) / float64(targetImage.Width)
+		metric, err := NewMetric(levelMetricConfig)
+		if err != nil {
+			return AnnealingState{}, nil, err
+		}
+		costFunction, err := NewCostFunction(config.CostFunction, levelTarget)
+		if err != nil {
+			return AnnealingState{}, nil, err
+		}
+		voronoi, err := NewVoronoi(levelWidth, levelHeight, config.NumSeeds, config.Tessellator, metric, randomSeeds.Int63())
+		if err != nil {
+			return AnnealingState{}, nil, fmt.Errorf("Invalid level %d of the pyramid (%dx%d): %w", level, levelWidth, levelHeight, err)
+		}
+		sa, err := NewSimulatedAnnealing(
+			voronoi,
+			levelTarget,
+			costFunction,
+			config.Structure,
+			statFile,
+			config.SimulationDuration,
+			coolingConfig,
+			config.Acceptance,
+			config.Colors,
+			config.DebugCostInterval,
+			randomSeeds.Int63(),
+			config.Workers,
+		)
+		if err != nil {
+			return AnnealingState{}, nil, err
+		}
+		sa.label = fmt.Sprintf("Level %d (%dx%d)", level, levelWidth, levelHeight)
+		sa.WithIterations(config.Iterations)
+		if seeds != nil {
+			if err := sa.Refine(state, scaleSeeds(seeds, width, height, levelWidth, levelHeight, levelMetricConfig.MaxWeight)); err != nil {
+				return AnnealingState{}, nil, err
+			}
+		}
+
+		// the next level starts from the temperatures of this one, rescaled to its own costs
+		coolingConfig.InitialTemperature = sa.initialTemperature
+		coolingConfig.FinalTemperature = sa.finalTemperature
+
+		// the iterations carry on from the previous levels, so each level ends when the iterations of all the levels so far are done
+		doneShare += config.Pyramid.levelShare(level)
+		levelIterations := int(doneShare * float64(config.Iterations))
+		levelDuration := time.Duration(config.Pyramid.levelShare(level) * float64(config.SimulationDuration))
+		levelStart := time.Now()
+		for ctx.Err() == nil {
+			if config.Iterations > 0 && sa.iterations >= levelIterations {
+				break
+			}
+			if config.Iterations <= 0 && time.Since(levelStart) > levelDuration {
+				break
+			}
+			if err := sa.Iterate(); err != nil {
+				return AnnealingState{}, nil, err
+			}
+		}
+
+		state = sa.GetState()
+		seeds = sa.GetBestSolution()
+		width, height = levelWidth, levelHeight
+		fmt.Printf("Annealed level %d of the pyramid (%dx%d), with best cost %.10f\n", level, levelWidth, levelHeight, sa.BestCost())
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return state, scaleSeeds(seeds, width, height, targetImage.Width, targetImage.Height, metricConfig.MaxWeight), nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"testing"
+)
+
+// assertScaled fails the test if a value is not the expected one times the ratio, up to the rounding errors
+func assertScaled(t *testing.T, name string, got float64, expected float64, ratio float64) {
+	t.Helper()
+
+	if math.Abs(got-expected*ratio) > 1e-12*math.Abs(expected*ratio) {
+		t.Fatalf("%s is %.17g, expected %.17g rescaled by %g to %.17g", name, got, expected, ratio, expected*ratio)
+	}
+}
+
+func TestRefine(t *testing.T) {
+	target := testTarget(96, 80, false)
+	config := testRunConfig()
+	config.Cooling.FinalTemperature = 1e-4
+	config.Acceptance = AcceptanceConfig{Criterion: "lateAcceptance", HistoryLength: 50}
+
+	coarse := newTestAnnealing(t, downscaleTarget(target, 48, 40), config)
+	iterate(t, coarse, 100)
+	state := coarse.GetState()
+
+	// the finer level starts from the temperatures of the coarser one, as the pyramid does
+	config.Cooling.InitialTemperature = state.InitialTemperature
+	config.Cooling.FinalTemperature = state.FinalTemperature
+	fine := newTestAnnealing(t, target, config)
+	if err := fine.Refine(state, scaleSeeds(coarse.GetBestSolution(), 48, 40, 96, 80, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	ratio := fine.cost / state.BestCost
+	if ratio <= 1 {
+		t.Fatalf("cost of the solution grows from %g to %g on the finer level, expected to grow", state.BestCost, fine.cost)
+	}
+	assertScaled(t, "initial temperature", fine.initialTemperature, state.InitialTemperature, ratio)
+	assertScaled(t, "final temperature", fine.finalTemperature, state.FinalTemperature, ratio)
+	assertScaled(t, "temperature", fine.cooling.Temperature(), coarse.cooling.Temperature(), ratio)
+	history := fine.acceptance.State().History
+	for i, cost := range state.Acceptance.History {
+		assertScaled(t, "cost in the history", history[i], cost, ratio)
+	}
+
+	// and keeps cooling along the same schedule, rescaled
+	iterate(t, coarse, 1)
+	iterate(t, fine, 1)
+	assertScaled(t, "temperature", fine.cooling.Temperature(), coarse.cooling.Temperature(), ratio)
+}
+
+func TestAnnealPyramid(t *testing.T) {
+	tests := []struct {
+		name        string
+		levelShares []float64
+		cancelled   bool
+		iterations  int // iterations expected at the end of the coarse levels
+	}{
+		{"same share for all the levels", []float64{0.1}, false, 80},
+		{"share of each level", []float64{0.05, 0.15}, false, 80},
+		{"interrupted", []float64{0.1}, true, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := testTarget(96, 80, false)
+			config := testRunConfig()
+			config.Pyramid = PyramidConfig{Levels: 3, LevelShares: test.levelShares}
+			statFile, err := os.CreateTemp(t.TempDir(), "stats-*.csv")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer statFile.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.cancelled {
+				cancel()
+			}
+			state, seeds, err := annealPyramid(ctx, target, config, config.Metric, statFile, newRandomSource(config.RandomSeed))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the solution of the coarse levels is carried over to the native resolution even if they get interrupted
+			if state.Iterations != test.iterations {
+				t.Fatalf("coarse levels stopped at iteration %d, expected %d", state.Iterations, test.iterations)
+			}
+			if len(seeds) != config.NumSeeds {
+				t.Fatalf("coarse levels returned %d seeds, expected %d", len(seeds), config.NumSeeds)
+			}
+			for i, s := range seeds {
+				if s.X < 0 || s.X >= target.Width || s.Y < 0 || s.Y >= target.Height {
+					t.Fatalf("seed %d lies outside of the target at %d,%d", i, s.X, s.Y)
+				}
+			}
+		})
+	}
+}
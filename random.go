@@ -0,0 +1,61 @@
+package main
+
+import "math/bits"
+
+// RandomState is the internal state of a random source, saved in the checkpoints to resume the same sequence of numbers
+type RandomState [4]uint64
+
+// randomSource is the xoshiro256** generator (https://prng.di.unimi.it), used in place of the sources of math/rand
+// since its state can be saved and restored
+type randomSource struct {
+	state RandomState
+}
+
+// newRandomSource creates a random source initialized from the given seed
+func newRandomSource(seed int64) *randomSource {
+	s := &randomSource{}
+	s.Seed(seed)
+	return s
+}
+
+// Seed initializes the state of the source from the given seed, expanded with splitmix64 as recommended by the authors of the generator
+func (s *randomSource) Seed(seed int64) {
+	x := uint64(seed)
+	for i := range s.state {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		s.state[i] = z ^ (z >> 31)
+	}
+}
+
+// Uint64 returns the next random number of the sequence
+func (s *randomSource) Uint64() uint64 {
+	result := bits.RotateLeft64(s.state[1]*5, 7) * 9
+	t := s.state[1] << 17
+
+	s.state[2] ^= s.state[0]
+	s.state[3] ^= s.state[1]
+	s.state[1] ^= s.state[2]
+	s.state[0] ^= s.state[3]
+	s.state[2] ^= t
+	s.state[3] = bits.RotateLeft64(s.state[3], 45)
+
+	return result
+}
+
+// Int63 returns the next random number of the sequence, as a non-negative integer
+func (s *randomSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// State returns the current state of the source
+func (s *randomSource) State() RandomState {
+	return s.state
+}
+
+// Restore brings the source back to a previously saved state
+func (s *randomSource) Restore(state RandomState) {
+	s.state = state
+}
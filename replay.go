@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// replayRenderer renders the solutions rebuilt from a move log, optionally tessellated at a higher resolution than the one of the run.
+//
+// The diagram is kept between the renderings, so the consecutive solutions of a replay are tessellated incrementally
+type replayRenderer struct {
+	voronoi *Voronoi
+	scale   int
+}
+
+// newReplayRenderer creates the renderer of the diagram described by the header of a move log, scaled by the given factor
+func newReplayRenderer(header Solution, numSeeds int, scale int) (*replayRenderer, error) {
+	if scale < 1 {
+		return nil, fmt.Errorf("Scale of the replay must be a positive integer, got %d", scale)
+	}
+
+	// the diagram is only used to render the solutions, with the metric they were computed with (so its random numbers are never used)
+	metric, err := NewMetric(header.MetricConfig())
+	if err != nil {
+		return nil, err
+	}
+	voronoi, err := NewVoronoi(header.Width*scale, header.Height*scale, numSeeds, defaultTessellator, metric, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// the solutions of transparent targets are rendered with the same transparency, each pixel of the target covering scale x scale pixels
+	alpha, err := header.Alpha()
+	if err != nil {
+		return nil, err
+	}
+	if alpha != nil {
+		scaled := make([]byte, header.Width*scale*header.Height*scale)
+		for p := range scaled {
+			x, y := p%(header.Width*scale), p/(header.Width*scale)
+			scaled[p] = alpha[(y/scale)*header.Width+x/scale]
+		}
+		voronoi.WithAlphaMask(scaled)
+	}
+
+	return &replayRenderer{voronoi: voronoi, scale: scale}, nil
+}
+
+// Render tessellates the given solution at the scale of the renderer, and returns its image.
+// Each seed is placed at the center of the block of pixels its pixel is scaled to, and its weight is scaled along with the distances
+func (r *replayRenderer) Render(seeds []Point) image.Image {
+	scaled := make([]Point, len(seeds))
+	for i, s := range seeds {
+		s.X = s.X*r.scale + r.scale/2
+		s.Y = s.Y*r.scale + r.scale/2
+		s.Weight *= float64(r.scale)
+		scaled[i] = s
+	}
+
+	r.voronoi.WithSeeds(scaled)
+	return r.voronoi.ToImage()
+}
+
+// replayUntil applies the records of the move log up to the given iteration (or all of them, if it's negative)
+func replayUntil(moves *MoveLogReader, iteration int) error {
+	for {
+		record, err := moves.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if iteration >= 0 && record.iteration > iteration {
+			return nil
+		}
+		if err := moves.Apply(record); err != nil {
+			return err
+		}
+	}
+}
+
+// runReplay rebuilds the solution accepted by a previous run up to the given iteration (or its final one, if negative)
+// from the log of its moves, and saves it as an image (png) or as a solution (json) that can be exported.
+// If no output path is given, the solution is saved next to the log, named after its iteration
+func runReplay(logPath string, iteration int, format string, scale int, outputPath string) error {
+	if format != "png" && format != "json" {
+		return fmt.Errorf("Unknown replay format '%s'", format)
+	}
+
+	moves, err := OpenMoveLog(logPath)
+	if err != nil {
+		return err
+	}
+	defer moves.Close()
+
+	if err := replayUntil(moves, iteration); err != nil {
+		return err
+	}
+	if moves.Seeds == nil {
+		return fmt.Errorf("The move log '%s' has no solutions up to iteration %d", logPath, iteration)
+	}
+	fmt.Printf("Rebuilt the solution of iteration %d, with cost %.10f\n", moves.Iteration, moves.Cost)
+
+	if outputPath == "" {
+		prefix := strings.TrimSuffix(strings.TrimSuffix(logPath, filepath.Ext(logPath)), "_moves")
+		outputPath = fmt.Sprintf("%s_iteration-%d.%s", prefix, moves.Iteration, format)
+	}
+
+	if format == "json" {
+		solution := moves.Header
+		solution.Seeds = solutionSeeds(moves.Seeds)
+		return saveSolution(outputPath, solution)
+	}
+
+	renderer, err := newReplayRenderer(moves.Header, len(moves.Seeds), scale)
+	if err != nil {
+		return err
+	}
+	return savePNG(outputPath, renderer.Render(moves.Seeds))
+}
+
+// runReplayAnimation renders the time-lapse of a previous run from the log of its moves, up to the given iteration (or to its end, if negative).
+//
+// A frame shows the solution reached every given number of iterations, and the final solution is held as the last frame.
+// Unlike the time-lapses built from the snapshots, the frames are evenly spaced in iterations rather than in time,
+// and they can be tessellated at a higher resolution than the one of the run
+func runReplayAnimation(logPath string, iteration int, iterationsPerFrame int, scale int, outputPath string, config AnimationConfig) error {
+	if iterationsPerFrame < 1 {
+		return fmt.Errorf("Iterations between the frames must be positive, got %d", iterationsPerFrame)
+	}
+
+	moves, err := OpenMoveLog(logPath)
+	if err != nil {
+		return err
+	}
+	defer moves.Close()
+
+	animation, err := NewAnimationWriter(outputPath, config)
+	if err != nil {
+		return err
+	}
+
+	// the renderer is created along with the first frame, once the number of seeds is known
+	var renderer *replayRenderer
+	frames := 0
+	addFrame := func(duration time.Duration) error {
+		if renderer == nil {
+			r, err := newReplayRenderer(moves.Header, len(moves.Seeds), scale)
+			if err != nil {
+				return err
+			}
+			renderer = r
+		}
+		frames++
+		return animation.AddFrame(renderer.Render(moves.Seeds), duration)
+	}
+
+	for {
+		record, err := moves.Next()
+		if err == io.EOF || (err == nil && iteration >= 0 && record.iteration > iteration) {
+			break
+		}
+		if err != nil {
+			animation.Close()
+			return err
+		}
+
+		// the solution reached at the end of each span of iterations is a frame, taken before moving past the span
+		if moves.Seeds != nil && record.iteration/iterationsPerFrame > moves.Iteration/iterationsPerFrame {
+			if err := addFrame(config.frameDuration()); err != nil {
+				animation.Close()
+				return err
+			}
+		}
+
+		if err := moves.Apply(record); err != nil {
+			animation.Close()
+			return err
+		}
+	}
+
+	if moves.Seeds == nil {
+		animation.Close()
+		return fmt.Errorf("The move log '%s' has no solutions up to iteration %d", logPath, iteration)
+	}
+	if err := addFrame(config.finalFrameDuration()); err != nil {
+		animation.Close()
+		return err
+	}
+	fmt.Printf("Rendered %d frames, up to iteration %d\n", frames, moves.Iteration)
+
+	return animation.Close()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// pausePollInterval is how often a paused simulation checks whether it has been resumed
+const pausePollInterval = 10 * time.Millisecond
+
+// runSimulation iterates the engine as fast as possible, until the simulation duration expires, the engine completes its iterations
+// or the context gets cancelled, taking the periodic snapshots along the way.
+//
+// While the (optional) paused flag is set, the iterations are suspended but the clock keeps running
+func runSimulation(
+	ctx context.Context,
+	simulatedAnnealing SimulatedAnnealingEngine,
+	simulationDuration time.Duration,
+	snapshots *Snapshotter,
+	paused *atomic.Bool,
+) error {
+
+	simulationStart := time.Now()
+	for time.Since(simulationStart) <= simulationDuration && !simulatedAnnealing.Completed() {
+
+		// stop the simulation if it has been cancelled
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		// wait for the simulation to be resumed
+		if paused != nil && paused.Load() {
+			time.Sleep(pausePollInterval)
+			continue
+		}
+
+		// take periodic snapshots of the solution
+		err := snapshots.SaveIfDue(simulatedAnnealing)
+		if err != nil {
+			return err
+		}
+
+		// compute the next simulated annealing iteration
+		err = simulatedAnnealing.Iterate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
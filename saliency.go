@@ -0,0 +1,204 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/cmplx"
+)
+
+const (
+	// saliencySize is the side of the downsampled image the saliency is computed on: the spectral residual
+	// captures the objects standing out from the whole image, not the fine details
+	saliencySize = 64
+
+	// saliencyBlur is the standard deviation of the gaussian blur smoothing the saliency, in pixels of the downsampled image
+	saliencyBlur = 2.5
+
+	// saliencyFloor is the weight of the least salient pixels, so that the background still counts in the cost
+	saliencyFloor = 32
+)
+
+// saliencyMap estimates the importance of each pixel of the target image with the spectral residual approach
+// (Hou and Zhang, "Saliency Detection: A Spectral Residual Approach", 2007), returning a weight map for the cost.
+//
+// The log amplitude spectrum of natural images is smooth, so what stands out of its local average (the spectral residual)
+// comes from the unexpected parts of the image: transforming the residual back to the image domain, with the original phase,
+// gives the salient regions
+func saliencyMap(target TargetImage) []byte {
+	n := saliencySize
+
+	// downsample the luma of the target, averaging the pixels of each cell
+	grid := make([]complex128, n*n)
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			// on images smaller than the grid, the cells still cover at least one pixel
+			minX, maxX := x*target.Width/n, clamp((x+1)*target.Width/n, x*target.Width/n+1, target.Width)
+			minY, maxY := y*target.Height/n, clamp((y+1)*target.Height/n, y*target.Height/n+1, target.Height)
+			sum := 0.0
+			for ty := minY; ty < maxY; ty++ {
+				for tx := minX; tx < maxX; tx++ {
+					p := (ty*target.Width + tx) * 4
+					sum += float64(luma(color.RGBA{R: target.Bytes[p], G: target.Bytes[p+1], B: target.Bytes[p+2]}))
+				}
+			}
+			grid[y*n+x] = complex(sum/float64((maxX-minX)*(maxY-minY)), 0)
+		}
+	}
+
+	// spectral residual: the log amplitude minus its local average, with the phase left unchanged
+	fft2(grid, n, false)
+	logAmplitude := make([]float64, n*n)
+	for i, f := range grid {
+		logAmplitude[i] = math.Log(cmplx.Abs(f) + 1e-9)
+	}
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			average := 0.0
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					// the spectrum is periodic
+					average += logAmplitude[((y+dy+n)%n)*n+(x+dx+n)%n] / 9
+				}
+			}
+			i := y*n + x
+			grid[i] = cmplx.Rect(math.Exp(logAmplitude[i]-average), cmplx.Phase(grid[i]))
+		}
+	}
+	fft2(grid, n, true)
+
+	saliency := make([]float64, n*n)
+	for i, f := range grid {
+		saliency[i] = real(f)*real(f) + imag(f)*imag(f)
+	}
+	saliency = gaussianBlur(saliency, n, saliencyBlur)
+
+	// normalize the saliency to the interval [0,1]
+	minSaliency, maxSaliency := math.Inf(1), math.Inf(-1)
+	for _, s := range saliency {
+		minSaliency = math.Min(minSaliency, s)
+		maxSaliency = math.Max(maxSaliency, s)
+	}
+	for i := range saliency {
+		saliency[i] = (saliency[i] - minSaliency) / math.Max(maxSaliency-minSaliency, 1e-12)
+	}
+
+	// upsample the saliency to the size of the target, interpolating the centers of the cells
+	weights := make([]byte, target.Width*target.Height)
+	at := func(x int, y int) float64 {
+		return saliency[clamp(y, 0, n-1)*n+clamp(x, 0, n-1)]
+	}
+	for y := 0; y < target.Height; y++ {
+		fy := (float64(y)+0.5)*float64(n)/float64(target.Height) - 0.5
+		y0, wy := int(math.Floor(fy)), fy-math.Floor(fy)
+		for x := 0; x < target.Width; x++ {
+			fx := (float64(x)+0.5)*float64(n)/float64(target.Width) - 0.5
+			x0, wx := int(math.Floor(fx)), fx-math.Floor(fx)
+
+			s := (at(x0, y0)*(1-wx)+at(x0+1, y0)*wx)*(1-wy) + (at(x0, y0+1)*(1-wx)+at(x0+1, y0+1)*wx)*wy
+			weights[y*target.Width+x] = uint8(math.Round(saliencyFloor + (255-saliencyFloor)*s))
+		}
+	}
+
+	return weights
+}
+
+// weightMapImage returns the grayscale image of a weight map, to inspect it
+func weightMapImage(weights []byte, width int, height int) image.Image {
+	i := image.NewGray(image.Rect(0, 0, width, height))
+	copy(i.Pix, weights)
+	return i
+}
+
+// gaussianBlur blurs a square grid of values with a gaussian kernel of the given standard deviation, clamping the borders
+func gaussianBlur(values []float64, n int, sigma float64) []float64 {
+	radius := int(math.Ceil(3 * sigma))
+	kernel := make([]float64, 2*radius+1)
+	sum := 0.0
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	// the kernel is separable: blur the rows, then the columns
+	rows := make([]float64, n*n)
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			for k, w := range kernel {
+				rows[y*n+x] += w * values[y*n+clamp(x+k-radius, 0, n-1)]
+			}
+		}
+	}
+	blurred := make([]float64, n*n)
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			for k, w := range kernel {
+				blurred[y*n+x] += w * rows[clamp(y+k-radius, 0, n-1)*n+x]
+			}
+		}
+	}
+
+	return blurred
+}
+
+// fft2 computes in place the 2D discrete Fourier transform (or its inverse) of a square grid, whose side is a power of 2
+func fft2(grid []complex128, n int, inverse bool) {
+	for y := 0; y < n; y++ {
+		fft(grid[y*n:(y+1)*n], inverse)
+	}
+	column := make([]complex128, n)
+	for x := 0; x < n; x++ {
+		for y := 0; y < n; y++ {
+			column[y] = grid[y*n+x]
+		}
+		fft(column, inverse)
+		for y := 0; y < n; y++ {
+			grid[y*n+x] = column[y]
+		}
+	}
+}
+
+// fft computes in place the discrete Fourier transform (or its inverse) of a sequence whose length is a power of 2,
+// with the iterative radix-2 Cooley-Tukey algorithm
+func fft(a []complex128, inverse bool) {
+	n := len(a)
+
+	// reorder the sequence by the bit reversal of the indexes
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+
+	// combine the transforms of the halves, doubling their size at each step
+	for size := 2; size <= n; size <<= 1 {
+		angle := -2 * math.Pi / float64(size)
+		if inverse {
+			angle = -angle
+		}
+		step := cmplx.Rect(1, angle)
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u, v := a[start+k], a[start+k+size/2]*w
+				a[start+k], a[start+k+size/2] = u+v, u-v
+				w *= step
+			}
+		}
+	}
+
+	if inverse {
+		for i := range a {
+			a[i] /= complex(float64(n), 0)
+		}
+	}
+}
@@ -3,82 +3,270 @@ package main
 import (
 	"fmt"
 	"image"
+	"image/color"
 	"math"
 	"math/rand"
 	"os"
+	"sync"
 	"time"
 )
 
 // SimulatedAnnealing is the engine driving the annealing.
-// At each iteration, it creates a new perturbation of the current solution, and evaluates its temperature.
-// The temperature of a solution is the distance of the solution from the target,
-// and the engine tries to reduce it by trial and error
+// At each iteration, it creates a new perturbation of the current solution, and evaluates its cost.
+// The cost of a solution is the distance of the solution from the target,
+// and the engine tries to reduce it by trial and error.
+//
+// Whether worse solutions are accepted is decided by the chosen acceptance criterion,
+// usually driven by the control temperature, that evolves along the simulation following the chosen cooling schedule.
+//
+// The rendering methods are safe to call while another goroutine is iterating the engine
 type SimulatedAnnealing struct {
-	voronoi         VoronoiDiagram // voronoi engine used to generate the images used for each annealing iteration
-	targetImage     TargetImage    // image to be used as target for the annealing algorithm
-	startingTime    time.Time      // time mark of the beginning of the simulation
-	statFile        *os.File       // csv file logging the temperature in function of time, for further analysis
-	r               *rand.Rand     // generator for random numbers used in the computations
-	temperature     float64        // temperature of the current solution of the annealing. It can assume values in the interval [0,1]
-	maxHeat         float64        // max temperature of the image (needed for normalization purposes)
-	bestTemperature float64        // tracker of the best temperature reached by the algorithm
-	bestSolution    []Point        // tracker of the solution associated with the best temperature. The algorithm is reset to this state when the temperature grows out of control
-}
-
-// NewSimulatedAnnealing initializes the simulated annealing engine
+	mu                 sync.RWMutex        // guards the state of the engine between the iterations and the renderings
+	voronoi            VoronoiDiagram      // voronoi engine used to generate the images used for each annealing iteration
+	targetImage        TargetImage         // image to be used as target for the annealing algorithm
+	costFunction       CostFunction        // distance of the pixels of the solution from the ones of the target image
+	structure          *structuralCost     // structural dissimilarity of the solution from the target image, if blended with the pixel cost
+	structureWeight    float64             // weight of the structural cost in the blend with the pixel cost
+	startingTime       time.Time           // time mark of the beginning of the simulation
+	simulationDuration time.Duration       // expected duration of the simulation, used to compute the progress of the cooling schedule
+	iterationBudget    int                 // number of iterations of the simulation, computing the progress instead of the duration (0 if unlimited)
+	statFile           *os.File            // csv file logging the cost and the temperature in function of time, for further analysis
+	source             *randomSource       // source of the random numbers, whose state is saved in the checkpoints
+	r                  *rand.Rand          // generator for random numbers used in the computations
+	cooling            CoolingSchedule     // schedule driving the control temperature
+	acceptance         AcceptanceCriterion // criterion deciding whether a perturbated solution is accepted
+	initialTemperature float64             // control temperature at the beginning of the simulation
+	finalTemperature   float64             // control temperature at the end of the simulation (0 if derived from the initial one)
+	cost               float64             // cost of the current solution of the annealing. It can assume values in the interval [0,1]
+	maxHeat            float64             // max cost of the image (needed for normalization purposes)
+	bestCost           float64             // tracker of the best cost reached by the algorithm
+	bestSolution       []Point             // tracker of the solution associated with the best cost. The algorithm is reset to this state when the cost grows out of control
+	recolorInterval    int                 // every how many iterations the cells get their optimal colors (0 if they are recolored by each tessellation, or never)
+	moves              *MoveLog            // log of the accepted moves, if recorded
+	label              string              // name printed along with the progress, to tell apart the replicas of the parallel tempering
+
+	// incremental cost evaluation
+	heat              int64             // total heat of the current diagram, kept in sync with the per-pixel heat buffer
+	pixelHeat         []int             // heat of each pixel of the current diagram (distance of its color from the target, given by the cost function, times its importance)
+	journal           []pixelHeatChange // changes applied to the per-pixel heat buffer by the last evaluation, to roll them back
+	journalHeat       int64             // total heat before the last evaluation
+	visited           []uint32          // generation stamp of the last evaluation that visited each pixel, to skip duplicates
+	generation        uint32            // generation of the current evaluation
+	iterations        int               // number of iterations performed so far
+	debugCostInterval int               // every how many iterations the incremental cost is cross-checked (0 disables the check)
+	workers           int               // number of goroutines sharing the evaluation of the cost (and the tessellations of the diagram)
+	pending           []int             // scratch list of the pixels to evaluate, without duplicates
+}
+
+// pixelHeatChange is an entry of the journal of the incremental cost evaluation
+type pixelHeatChange struct {
+	pixel   int
+	oldHeat int
+}
+
+// NewSimulatedAnnealing initializes the simulated annealing engine.
+//
+// The initial solution is evaluated right away and, if no initial temperature is provided,
+// the temperature is calibrated by sampling perturbations of the initial solution.
+// The random numbers of the annealing are generated from the given seed
 func NewSimulatedAnnealing(
 	voronoi VoronoiDiagram,
 	targetImage TargetImage,
+	costFunction CostFunction,
+	structureConfig StructureConfig,
 	statFile *os.File,
+	simulationDuration time.Duration,
+	coolingConfig CoolingConfig,
+	acceptanceConfig AcceptanceConfig,
+	colorConfig ColorConfig,
+	debugCostInterval int,
+	randomSeed int64,
+	workers int,
 ) (*SimulatedAnnealing, error) {
 
-	// initialize the csv file to track the progress of the algorithm
-	_, err := statFile.WriteString("elapsed_seconds,temperature\n")
+	// initialize the csv file to track the progress of the algorithm.
+	// The header is only written to new files, so a resumed run appends its stats to the ones of the original run
+	info, err := statFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		_, err = statFile.WriteString("elapsed_seconds,cost,temperature,schedule,acceptance,cost_function\n")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// compute the maximum heat of the image, as the total importance of the pixels in the image times the max distance for each pixel
+	maxHeat := float64(costFunction.MaxHeat()) * float64(targetImage.totalWeight())
+
+	source := newRandomSource(randomSeed)
+	sa := &SimulatedAnnealing{
+		voronoi:            voronoi,
+		targetImage:        targetImage,
+		costFunction:       costFunction,
+		maxHeat:            maxHeat,
+		simulationDuration: simulationDuration,
+		statFile:           statFile,
+		source:             source,
+		r:                  rand.New(source),
+		pixelHeat:          make([]int, targetImage.Width*targetImage.Height),
+		visited:            make([]uint32, targetImage.Width*targetImage.Height),
+		debugCostInterval:  debugCostInterval,
+		workers:            workers,
+	}
+	sa.voronoi.WithWorkers(workers)
+
+	sa.acceptance, err = NewAcceptanceCriterion(acceptanceConfig, sa.r)
+	if err != nil {
+		return nil, err
+	}
+
+	// blend the structural cost with the pixel cost, if requested
+	if structureConfig.Name != "none" {
+		if structureConfig.Weight < 0 || structureConfig.Weight > 1 {
+			return nil, fmt.Errorf("Structural cost weight must be in the interval [0,1], got %g", structureConfig.Weight)
+		}
+		sa.structure, err = newStructuralCost(structureConfig.Name, targetImage)
+		if err != nil {
+			return nil, err
+		}
+		sa.structureWeight = structureConfig.Weight
+	}
+
+	// the weight map shapes the search as well as the cost
+	if targetImage.Weights != nil {
+		sa.voronoi.WithWeightMap(targetImage.Weights)
+	}
+
+	// the transparent pixels of the target are left out of the search, and out of the images of the solutions
+	if alpha := targetImage.alphaMask(); alpha != nil {
+		sa.voronoi.WithAlphaMask(alpha)
+	}
+
+	// unless the colors are perturbated randomly, the cells get the colors estimated from the target
+	if colorConfig.Estimator != "random" {
+		estimator, err := NewColorEstimator(colorConfig.Estimator)
+		if err != nil {
+			return nil, err
+		}
+		sa.voronoi.WithCellColors(estimator, targetImage.Bytes, colorConfig.RecolorInterval <= 0)
+		if colorConfig.RecolorInterval > 0 {
+			sa.recolorInterval = colorConfig.RecolorInterval
+		}
+	}
+
+	// evaluate the initial solution, that is also the best one so far
+	vErr := sa.voronoi.Tessellate()
+	if vErr != nil {
+		return nil, vErr
+	}
+	sa.voronoi.Recolor()
+	sa.cost = sa.evaluateCost()
+	sa.bestCost = sa.cost
+	sa.bestSolution = sa.voronoi.GetSeeds()
+
+	// set up the control temperature
+	sa.initialTemperature = coolingConfig.InitialTemperature
+	if sa.initialTemperature <= 0 {
+		sa.initialTemperature, err = sa.calibrateTemperature(
+			coolingConfig.CalibrationSamples,
+			coolingConfig.InitialAcceptance,
+		)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Calibrated initial temperature: %.3e\n", sa.initialTemperature)
+	}
+	sa.finalTemperature = coolingConfig.FinalTemperature
+	sa.cooling, err = NewCoolingSchedule(
+		coolingConfig.Schedule,
+		sa.initialTemperature,
+		coolingConfig.FinalTemperature,
+		coolingConfig.TargetAcceptance,
+	)
 	if err != nil {
 		return nil, err
 	}
 
-	//compute the maximum head of the image, as number of pixels in the image times the max RGBA distance for each pixel
-	maxHeat := float64(4 * 255 * targetImage.Width * targetImage.Height)
+	sa.startingTime = time.Now()
+	return sa, nil
+}
+
+// calibrateTemperature computes an initial temperature such that an average uphill move
+// is accepted with the given probability.
+//
+// The average uphill cost difference is estimated by sampling perturbations of the current solution,
+// that is restored at the end of the calibration
+func (sa *SimulatedAnnealing) calibrateTemperature(samples int, initialAcceptance float64) (float64, error) {
+	if initialAcceptance <= 0 || initialAcceptance >= 1 {
+		return 0, fmt.Errorf("Initial acceptance probability must be in the interval (0,1), got %g", initialAcceptance)
+	}
+
+	uphillSum := 0.0
+	uphillMoves := 0
+
+	for i := 0; i < samples; i++ {
+
+		// sample the moves that the engine performs at the highest temperature
+		for j := 0; j < sa.perturbationsCount(1.0); j++ {
+			pErr := sa.voronoi.Perturbate()
+			if pErr != nil {
+				return 0, pErr
+			}
+		}
+		vErr := sa.voronoi.Tessellate()
+		if vErr != nil {
+			return 0, vErr
+		}
+
+		if delta := sa.evaluateCost() - sa.cost; delta > 0 {
+			uphillSum += delta
+			uphillMoves++
+		}
+		sa.rollback()
+	}
+
+	// without uphill samples, fall back to a temperature proportional to the current cost
+	if uphillMoves == 0 {
+		return sa.cost / 100, nil
+	}
 
-	return &SimulatedAnnealing{
-		voronoi:         voronoi,
-		targetImage:     targetImage,
-		maxHeat:         maxHeat,
-		bestTemperature: 1.0,
-		bestSolution:    nil,
-		temperature:     1.0,
-		startingTime:    time.Now(),
-		statFile:        statFile,
-		r:               rand.New(rand.NewSource(time.Now().UnixNano())),
-	}, nil
+	// exp(-avgDelta / T0) = initialAcceptance
+	avgDelta := uphillSum / float64(uphillMoves)
+	return -avgDelta / math.Log(initialAcceptance), nil
 }
 
 // Iterate is the core function of the engine.
 //
-// At each iteration, the engine perturbates the current solution and evaluates its temperature.
-// The new temperature is automatically accepted if is lower than the previous one, but it may also
-// be accepted if is higher, based on a probabilistic function.
+// At each iteration, the engine perturbates the current solution and evaluates its cost.
+// The new solution is automatically accepted if its cost is lower than the previous one, but it may also
+// be accepted if is higher, depending on the acceptance criterion and on the current control temperature.
 //
-// Since regressions are possible, even if the probability is low the temperature could grow indefinitely,
+// Since regressions are possible, even if the probability is low the cost could grow indefinitely,
 // so a reset mechanism is put in place to reset the state of the annealing if it grows too much out of control
 func (sa *SimulatedAnnealing) Iterate() error {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
 
-	// keep a copy of the current solution, so the system can be
-	// resetted to this state if the perturbation is not acceptable
-	currentSeeds := sa.voronoi.GetSeeds()
+	// periodically recolor the cells, if requested
+	if sa.recolorInterval > 0 && sa.iterations > 0 && sa.iterations%sa.recolorInterval == 0 {
+		if err := sa.recolor(); err != nil {
+			return err
+		}
+	}
+
+	// the current solution is kept to log the changes of the move, if it's accepted and the moves are recorded
+	var previous []Point
+	if sa.moves != nil {
+		previous = sa.voronoi.GetSeeds()
+	}
 
 	// compute the number of perturbations in function of the temperature.
 	// the higher the temperature, the more perturbations are performed:
 	// in this way, at highest temperatures furthest perturbations are evaluated,
 	// increasing the ability to explore the solution space.
-	//
-	// At max temperature (t = 1.0), the number of perturbations corresponds to a third of the seeds,
-	// and this number gets lower as the temperature lowers
-	perturbations := int(math.Floor(sa.temperature * float64(len(currentSeeds)) / 3))
-	if perturbations == 0 {
-		perturbations = 1
-	}
+	perturbations := sa.perturbationsCount(sa.cooling.Temperature() / sa.initialTemperature)
 
 	// perturbate the current solution as many times as computed in the previous step.
 	for j := 0; j < perturbations; j++ {
@@ -94,109 +282,482 @@ func (sa *SimulatedAnnealing) Iterate() error {
 		return vErr
 	}
 
-	// compute the temperature of the perturbated solution
-	newTemperature := sa.computeTemperature()
+	// compute the cost of the perturbated solution
+	sa.iterations++
+	newCost := sa.evaluateCost()
 
-	// evaluate the new temperature
-	if !sa.isAcceptableTemperature(newTemperature) {
-		// if the new temperature is not accepted, reset the algorightm to its previous state
-		sa.voronoi.WithSeeds(currentSeeds)
-		return nil
+	// evaluate the new cost, and advance the cooling schedule
+	accepted := sa.acceptance.Accept(sa.cost, newCost, sa.bestCost, sa.cooling.Temperature())
+	sa.cooling.Update(sa.progress(), accepted)
+	if !accepted {
+		// if the new cost is not accepted, roll the algorithm back to its previous state
+		sa.rollback()
+		sa.acceptance.Record(sa.cost)
+		return sa.checkCost()
 	}
 
-	// check if the new temperature is running out of control, and if so reset it to the best solution so far
-	if (newTemperature - sa.bestTemperature) > sa.bestTemperature/10 {
-		fmt.Printf("Current temperature exceeded 10 percent threshold, restarting from the best solution so far: %.10f\n", sa.bestTemperature)
+	// check if the new cost is running out of control, and if so reset it to the best solution so far
+	if (newCost - sa.bestCost) > sa.bestCost/10 {
+		fmt.Printf("Current cost exceeded 10 percent threshold, restarting from the best solution so far: %.10f\n", sa.bestCost)
 
 		sa.voronoi.WithSeeds(sa.bestSolution)
-		sa.temperature = sa.bestTemperature
-		return nil
+		sa.cost = sa.evaluateCost()
+		sa.acceptance.Record(sa.cost)
+		if err := sa.logMove(previous); err != nil {
+			return err
+		}
+		return sa.checkCost()
 	}
 
 	// update the simulated annealing state, and log the iteration
-	sa.temperature = newTemperature
+	sa.cost = newCost
+	sa.acceptance.Record(sa.cost)
 	err := sa.logIteration()
 	if err != nil {
 		return err
 	}
+	if err := sa.logMove(previous); err != nil {
+		return err
+	}
 
-	// update the best temperature hook
-	if sa.temperature < sa.bestTemperature {
-		sa.bestTemperature = sa.temperature
+	// update the best cost hook
+	if sa.cost < sa.bestCost {
+		sa.bestCost = sa.cost
 		sa.bestSolution = sa.voronoi.GetSeeds()
 	}
 
-	return nil
+	return sa.checkCost()
 }
 
-// computeTemperature computes the temperature of the current solution, intended as
-// the distance of the RGBA values of each pixel from the corresponding pixel of the target image
-func (sa *SimulatedAnnealing) computeTemperature() float64 {
+// recolor assigns to each cell its optimal color given the current positions of the seeds.
+// The recoloring is not a move of the annealing, so it is always kept
+func (sa *SimulatedAnnealing) recolor() error {
+	var previous []Point
+	if sa.moves != nil {
+		previous = sa.voronoi.GetSeeds()
+	}
+	sa.voronoi.Recolor()
+	sa.cost = sa.evaluateCost()
 
-	// get the pixels of the current solution
-	currentSolution := sa.voronoi.ToPixels()
-	heat := 0.0 // keep track of the total heat of the current solution
+	if sa.cost < sa.bestCost {
+		sa.bestCost = sa.cost
+		sa.bestSolution = sa.voronoi.GetSeeds()
+	}
 
-	// iterate each RGBA value of each pixel in the target image
-	for i, b := range sa.targetImage.Bytes {
+	return sa.logMove(previous)
+}
+
+// WithMoveLog records the moves accepted from now on into the given log, starting from a keyframe of the current solution
+func (sa *SimulatedAnnealing) WithMoveLog(moves *MoveLog) error {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+
+	sa.moves = moves
+	return sa.moves.Keyframe(sa.iterations, sa.cost, sa.voronoi.GetSeeds())
+}
+
+// logMove records the changes of the current solution from the previous one into the move log, if any
+func (sa *SimulatedAnnealing) logMove(previous []Point) error {
+	if sa.moves == nil {
+		return nil
+	}
+	return sa.moves.Move(sa.iterations, sa.cost, previous, sa.voronoi.GetSeeds())
+}
 
-		// compute the current and target values of the current color component
-		targetValue := int(b)
-		currentValue := int(currentSolution[i])
+// perturbationsCount computes the number of perturbations to apply at each iteration,
+// given the ratio between the current and the initial temperature.
+//
+// At the initial temperature, the number of perturbations corresponds to a third of the seeds,
+// and this number gets lower as the temperature lowers
+func (sa *SimulatedAnnealing) perturbationsCount(temperatureRatio float64) int {
+	temperatureRatio = math.Min(temperatureRatio, 1.0)
 
-		// add to the total heat the distance between the current value and the target value
-		heat += math.Abs(float64(targetValue - currentValue))
+	perturbations := int(math.Floor(temperatureRatio * float64(len(sa.voronoi.GetSeeds())) / 3))
+	if perturbations == 0 {
+		perturbations = 1
 	}
+	return perturbations
+}
 
-	// return the normalized heat (aka temperature)
-	return heat / sa.maxHeat
+// WithIterations limits the simulation to the given number of iterations (0 for no limit).
+// The progress of the cooling schedule then follows the iterations rather than the clock,
+// so the simulation is the same however fast the iterations run
+func (sa *SimulatedAnnealing) WithIterations(budget int) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+
+	sa.iterationBudget = budget
+}
+
+// Completed reports whether the simulation performed all of its iterations, if limited
+func (sa *SimulatedAnnealing) Completed() bool {
+	sa.mu.RLock()
+	defer sa.mu.RUnlock()
+
+	return sa.iterationBudget > 0 && sa.iterations >= sa.iterationBudget
+}
+
+// progress returns the fraction of the simulation elapsed so far, in the interval [0,1]:
+// the fraction of the iterations performed, if limited, or else of the simulation duration
+func (sa *SimulatedAnnealing) progress() float64 {
+	if sa.iterationBudget > 0 {
+		return math.Min(float64(sa.iterations)/float64(sa.iterationBudget), 1.0)
+	}
+	if sa.simulationDuration <= 0 {
+		return 1.0
+	}
+	return math.Min(float64(time.Since(sa.startingTime))/float64(sa.simulationDuration), 1.0)
 }
 
-// isAcceptableTemperature decides if the input temperature can be accepted compared
-// to the temperature of the previous state
-func (sa *SimulatedAnnealing) isAcceptableTemperature(temperature float64) bool {
+// evaluateCost updates the cost after the diagram changed, by recomputing the heat of the changed pixels only.
+// The previous heat of the changed pixels is recorded in the journal, so the evaluation can be rolled back
+func (sa *SimulatedAnnealing) evaluateCost() float64 {
+	sa.journal = sa.journal[:0]
+	sa.journalHeat = sa.heat
+	if sa.structure != nil {
+		sa.structure.beginEvaluation()
+	}
+
+	changed, allChanged := sa.voronoi.ChangedPixels()
+	if allChanged {
+		sa.updatePixelHeats(nil, len(sa.pixelHeat))
+	} else {
+		// the same pixel can be reported more than once, but it must be evaluated only once
+		sa.generation++
+		sa.pending = sa.pending[:0]
+		for _, p := range changed {
+			if sa.visited[p] == sa.generation {
+				continue
+			}
+			sa.visited[p] = sa.generation
+			sa.pending = append(sa.pending, p)
+		}
+		sa.updatePixelHeats(sa.pending, len(sa.pending))
+	}
 
-	// if the new temperature is lower than the previous one, always accept it.
-	// if we want to use a hill climbing approach, this check is all that we need
-	if temperature <= sa.temperature {
-		return true
+	// the windows of the structural cost are updated once all their pixels are
+	if sa.structure != nil {
+		sa.structure.updateWindows()
 	}
 
-	// if the new temperature is higher than the previous one, accept it using a probabilistic approach.
-	// First, a random number in the interval [0, 1] is generated.
-	// Then, the difference in temperatures (normalized in the [0, 1] interval) is calculated.
-	// The random number is compared to the normalized temperature, and if it's greater, the temperature is accepted.
-	//
-	// But there's a plot twist! The normalized temperature difference is passed to a
-	// sigmoid function (https://en.wikipedia.org/wiki/Sigmoid_function), that enhances the
-	// probability of accepting lower differences
-	rand := sa.r.Float64()
-	percDiff := (temperature - sa.temperature) * 100 / sa.temperature
-	sigmoid := (2 / (1 + math.Exp(-10*percDiff))) - 1 // sigmoid function variation
-	return rand > sigmoid
+	return sa.currentCost()
+}
+
+// updatePixelHeats recomputes the heat of the given pixels (of the first n pixels of the diagram, if nil), each one only once.
+//
+// With more workers the pixels are split into chunks evaluated concurrently, each one with a journal of its own:
+// the journals are then concatenated in the order of the chunks, and the heat is an integer sum,
+// so the result is exactly the same as the evaluation of the pixels one after the other
+func (sa *SimulatedAnnealing) updatePixelHeats(pixels []int, n int) {
+	pixel := func(i int) int {
+		if pixels == nil {
+			return i
+		}
+		return pixels[i]
+	}
+
+	workers := parallelWorkers(n, sa.workers)
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			sa.updatePixelHeat(pixel(i))
+		}
+		return
+	}
+
+	// the structural cost is updated pixel by pixel, outside of the workers
+	if sa.structure != nil {
+		for i := 0; i < n; i++ {
+			p := pixel(i)
+			sa.structure.updatePixel(p, sa.voronoi.PixelColor(p))
+		}
+	}
+
+	journals := make([][]pixelHeatChange, chunksCount(n, workers))
+	deltas := make([]int64, len(journals))
+	forEachChunk(n, workers, func(chunk int, start int, end int) {
+		for i := start; i < end; i++ {
+			p := pixel(i)
+			heat := sa.costFunction.Heat(p, sa.voronoi.PixelColor(p)) * sa.targetImage.pixelWeight(p)
+			if heat == sa.pixelHeat[p] {
+				continue
+			}
+
+			journals[chunk] = append(journals[chunk], pixelHeatChange{pixel: p, oldHeat: sa.pixelHeat[p]})
+			deltas[chunk] += int64(heat - sa.pixelHeat[p])
+			sa.pixelHeat[p] = heat
+		}
+	})
+	for chunk := range journals {
+		sa.journal = append(sa.journal, journals[chunk]...)
+		sa.heat += deltas[chunk]
+	}
+}
+
+// updatePixelHeat recomputes the heat of a pixel, journaling its previous value.
+// The pixel is updated in the structural cost too, if any
+func (sa *SimulatedAnnealing) updatePixelHeat(p int) {
+	c := sa.voronoi.PixelColor(p)
+	if sa.structure != nil {
+		sa.structure.updatePixel(p, c)
+	}
+
+	heat := sa.costFunction.Heat(p, c) * sa.targetImage.pixelWeight(p)
+	if heat == sa.pixelHeat[p] {
+		return
+	}
+
+	sa.journal = append(sa.journal, pixelHeatChange{pixel: p, oldHeat: sa.pixelHeat[p]})
+	sa.heat += int64(heat - sa.pixelHeat[p])
+	sa.pixelHeat[p] = heat
+}
+
+// rollback resets the diagram to its state before the last tessellation, and the cost to its value before the last evaluation.
+// The heat of the pixels is restored from the journal, so no evaluation is needed
+func (sa *SimulatedAnnealing) rollback() {
+	for i := len(sa.journal) - 1; i >= 0; i-- {
+		sa.pixelHeat[sa.journal[i].pixel] = sa.journal[i].oldHeat
+	}
+	sa.heat = sa.journalHeat
+	sa.journal = sa.journal[:0]
+	if sa.structure != nil {
+		sa.structure.rollback()
+	}
+
+	// the pixels changed by the restoration already have the right heat
+	sa.voronoi.Rollback()
+	sa.voronoi.ChangedPixels()
+}
+
+// currentCost returns the normalized heat (aka cost) of the current diagram, blended with the structural cost if any
+func (sa *SimulatedAnnealing) currentCost() float64 {
+	if sa.structure != nil {
+		return sa.blendCost(float64(sa.heat)/sa.maxHeat, sa.structure.cost())
+	}
+	return float64(sa.heat) / sa.maxHeat
+}
+
+// blendCost blends the pixel cost with the structural cost, with the chosen weight
+func (sa *SimulatedAnnealing) blendCost(pixelCost float64, structuralCost float64) float64 {
+	return (1-sa.structureWeight)*pixelCost + sa.structureWeight*structuralCost
+}
+
+// costName describes the cost of the solutions, with its pixel and structural components
+func (sa *SimulatedAnnealing) costName() string {
+	if sa.structure != nil {
+		return fmt.Sprintf("%g*%s+%g*%s", 1-sa.structureWeight, sa.costFunction.Name(), sa.structureWeight, sa.structure.Name())
+	}
+	return sa.costFunction.Name()
+}
+
+// checkCost cross-checks the incremental cost against a full recomputation, if the debug check is enabled
+// and it is the iteration for it
+func (sa *SimulatedAnnealing) checkCost() error {
+	if sa.debugCostInterval <= 0 || sa.iterations%sa.debugCostInterval != 0 {
+		return nil
+	}
+
+	if full, incremental := sa.computeCost(), sa.currentCost(); full != incremental {
+		return fmt.Errorf("Incremental cost %.10f differs from the full recomputation %.10f at iteration %d", incremental, full, sa.iterations)
+	}
+	return nil
+}
+
+// computeCost computes from scratch the cost of the current solution, intended as
+// the distance of the color of each pixel from the corresponding pixel of the target image
+func (sa *SimulatedAnnealing) computeCost() float64 {
+
+	// get the pixels of the current solution
+	currentSolution := sa.voronoi.ToPixels()
+	heat := int64(0) // keep track of the total heat of the current solution
+
+	// iterate each pixel in the target image, chunk by chunk
+	pixels := len(currentSolution) / 4
+	workers := parallelWorkers(pixels, sa.workers)
+	heats := make([]int64, chunksCount(pixels, workers))
+	forEachChunk(pixels, workers, func(chunk int, start int, end int) {
+		for p := start; p < end; p++ {
+			c := currentSolution[p*4 : p*4+4]
+
+			// add to the total heat the distance between the current color and the target one
+			heats[chunk] += int64(sa.costFunction.Heat(p, color.RGBA{R: c[0], G: c[1], B: c[2], A: c[3]}) * sa.targetImage.pixelWeight(p))
+		}
+	})
+	for _, h := range heats {
+		heat += h
+	}
+
+	// return the normalized heat (aka cost)
+	if sa.structure != nil {
+		return sa.blendCost(float64(heat)/sa.maxHeat, sa.structure.computeCost(currentSolution))
+	}
+	return float64(heat) / sa.maxHeat
 }
 
 func (sa *SimulatedAnnealing) logIteration() error {
+	if sa.label != "" {
+		fmt.Printf("%s - ", sa.label)
+	}
 	fmt.Printf(
-		"Current temperature: %.10f, time passed: %s\n",
-		sa.temperature,
+		"Current cost: %.10f, temperature: %.3e, time passed: %s\n",
+		sa.cost,
+		sa.cooling.Temperature(),
 		time.Since(sa.startingTime),
 	)
 
 	_, err := sa.statFile.WriteString(
-		fmt.Sprintf("%.0f,%.10f\n",
+		fmt.Sprintf("%.0f,%.10f,%.10e,%s,%s,%s\n",
 			time.Since(sa.startingTime).Seconds(),
-			sa.temperature),
+			sa.cost,
+			sa.cooling.Temperature(),
+			sa.cooling.Name(),
+			sa.acceptance.Name(),
+			sa.costName()),
 	)
 	return err
 }
 
 // ToPixels returns the pixels of the current solution
 func (sa *SimulatedAnnealing) ToPixels() []byte {
+	sa.mu.RLock()
+	defer sa.mu.RUnlock()
+
 	return sa.voronoi.ToPixels()
 }
 
 // GetSnapshot returns the image representation of the current solution
 func (sa *SimulatedAnnealing) GetSnapshot() image.Image {
+	sa.mu.RLock()
+	defer sa.mu.RUnlock()
+
 	return sa.voronoi.ToImage()
 }
+
+// GetBestSnapshot returns the image representation of the best solution found so far
+func (sa *SimulatedAnnealing) GetBestSnapshot() (image.Image, error) {
+	sa.mu.RLock()
+	defer sa.mu.RUnlock()
+
+	return sa.voronoi.SeedsToImage(sa.bestSolution)
+}
+
+// GetBestSolution returns the seeds of the best solution found so far
+func (sa *SimulatedAnnealing) GetBestSolution() []Point {
+	sa.mu.RLock()
+	defer sa.mu.RUnlock()
+
+	return sa.bestSolution
+}
+
+// BestCost returns the cost of the best solution found so far
+func (sa *SimulatedAnnealing) BestCost() float64 {
+	sa.mu.RLock()
+	defer sa.mu.RUnlock()
+
+	return sa.bestCost
+}
+
+// swapCooling exchanges the cooling schedules of two engines, and with them their control temperatures.
+// It is how the replicas of the parallel tempering exchange their solutions
+func (sa *SimulatedAnnealing) swapCooling(other *SimulatedAnnealing) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	other.mu.Lock()
+	defer other.mu.Unlock()
+
+	sa.cooling, other.cooling = other.cooling, sa.cooling
+}
+
+// GetState returns the state of the annealing, from which the simulation can be resumed
+func (sa *SimulatedAnnealing) GetState() AnnealingState {
+	sa.mu.RLock()
+	defer sa.mu.RUnlock()
+
+	return AnnealingState{
+		Elapsed:            time.Since(sa.startingTime),
+		Iterations:         sa.iterations,
+		InitialTemperature: sa.initialTemperature,
+		FinalTemperature:   sa.finalTemperature,
+		Seeds:              solutionSeeds(sa.voronoi.GetSeeds()),
+		Diagram:            sa.voronoi.GetDiagram(),
+		BestSeeds:          solutionSeeds(sa.bestSolution),
+		BestCost:           sa.bestCost,
+		Cooling:            sa.cooling.State(),
+		Acceptance:         sa.acceptance.State(),
+		Random:             sa.source.State(),
+		VoronoiRandom:      sa.voronoi.GetRandomState(),
+	}
+}
+
+// Restore brings the annealing back to a state saved in a checkpoint, so that the simulation continues from there.
+// The engine must have been created with the same parameters of the checkpointed one
+func (sa *SimulatedAnnealing) Restore(state AnnealingState) error {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+
+	numSeeds := len(sa.voronoi.GetSeeds())
+	if len(state.Seeds) != numSeeds || len(state.BestSeeds) != numSeeds {
+		return fmt.Errorf("The state to restore has %d seeds, expected %d", len(state.Seeds), numSeeds)
+	}
+	for _, seeds := range [][]SolutionSeed{state.Seeds, state.BestSeeds} {
+		for i, s := range seeds {
+			if s.X < 0 || s.X >= sa.targetImage.Width || s.Y < 0 || s.Y >= sa.targetImage.Height {
+				return fmt.Errorf("Seed %d of the state to restore lies outside of the diagram", i)
+			}
+		}
+	}
+
+	// the cost of the current solution is recomputed from its diagram, the best solution is taken as is
+	if err := sa.voronoi.WithDiagram(seedPoints(state.Seeds), state.Diagram); err != nil {
+		return err
+	}
+	sa.cost = sa.evaluateCost()
+	sa.bestCost = state.BestCost
+	sa.bestSolution = seedPoints(state.BestSeeds)
+
+	sa.iterations = state.Iterations
+	sa.cooling.Restore(state.Cooling)
+	sa.acceptance.Restore(state.Acceptance)
+	sa.source.Restore(state.Random)
+	sa.voronoi.WithRandomState(state.VoronoiRandom)
+
+	// the clock of the simulation starts from the time elapsed before the checkpoint
+	sa.startingTime = time.Now().Add(-state.Elapsed)
+
+	return nil
+}
+
+// Refine continues the annealing of a coarser level of the pyramid from its best solution, scaled to the diagram of the engine.
+// The solution becomes both the current and the best one, while the iterations, the cooling and the clock of the simulation
+// carry on from the state the coarser level stopped at. The engine must have been created with the same initial and final temperatures.
+//
+// The costs of the coarser level are lower, since its target is smoother, so the temperatures of the cooling schedule
+// and the costs held by the acceptance criterion are rescaled by the ratio between the costs of the solution on the two levels
+func (sa *SimulatedAnnealing) Refine(coarser AnnealingState, seeds []Point) error {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+
+	if len(seeds) != len(sa.voronoi.GetSeeds()) {
+		return fmt.Errorf("The solution to refine has %d seeds, expected %d", len(seeds), len(sa.voronoi.GetSeeds()))
+	}
+
+	sa.voronoi.WithSeeds(seeds)
+	sa.voronoi.Recolor()
+	sa.cost = sa.evaluateCost()
+	sa.bestCost = sa.cost
+	sa.bestSolution = sa.voronoi.GetSeeds()
+
+	ratio := 1.0
+	if coarser.BestCost > 0 {
+		ratio = sa.cost / coarser.BestCost
+	}
+
+	sa.iterations = coarser.Iterations
+	sa.cooling.Restore(coarser.Cooling)
+	sa.cooling.Scale(ratio)
+	sa.initialTemperature *= ratio
+	sa.finalTemperature *= ratio
+	sa.acceptance.Restore(coarser.Acceptance.scaled(ratio))
+	sa.startingTime = time.Now().Add(-coarser.Elapsed)
+
+	return nil
+}
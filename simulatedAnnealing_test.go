@@ -0,0 +1,270 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// testTarget returns a synthetic target image of the given size, with smooth gradients and sharp edges.
+// If transparent, its border is left transparent
+func testTarget(width int, height int, transparent bool) TargetImage {
+	target := TargetImage{Name: "test", Bytes: make([]byte, width*height*4), Width: width, Height: height}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := (y*width + x) * 4
+			target.Bytes[p] = byte(255 * x / width)
+			target.Bytes[p+1] = byte(255 * y / height)
+			target.Bytes[p+2] = 40
+			if (x/12+y/9)%2 == 0 {
+				target.Bytes[p+2] = 220
+			}
+			target.Bytes[p+3] = 255
+			if transparent && (x < 4 || y < 4 || x >= width-4 || y >= height-4) {
+				target.Bytes[p+3] = 0
+			}
+		}
+	}
+	return target
+}
+
+// withTestWeights adds to the target a weight map growing from its left edge to its right one
+func withTestWeights(target TargetImage) TargetImage {
+	target.Weights = make([]byte, target.Width*target.Height)
+	for p := range target.Weights {
+		target.Weights[p] = byte(1 + 254*(p%target.Width)/target.Width)
+	}
+	return target
+}
+
+// testRunConfig returns the configuration of a short seeded run, calibrating its initial temperature
+// so that about half of the uphill moves are accepted
+func testRunConfig() RunConfig {
+	return RunConfig{
+		NumSeeds:           60,
+		SimulationDuration: time.Hour,
+		Iterations:         400,
+		Cooling:            CoolingConfig{Schedule: "exponential", InitialAcceptance: 0.5, CalibrationSamples: 50},
+		Acceptance:         AcceptanceConfig{Criterion: "metropolis"},
+		Colors:             ColorConfig{Estimator: "random"},
+		Tessellator:        "ring",
+		Workers:            1,
+		Metric:             MetricConfig{Name: "euclidean"},
+		CostFunction:       "l2",
+		Structure:          StructureConfig{Name: "none"},
+		RandomSeed:         7,
+	}
+}
+
+// newTestAnnealing creates an annealing engine of the target with the given configuration, as the run would.
+// Its stats are logged into a file of the temporary directory of the test
+func newTestAnnealing(t *testing.T, target TargetImage, config RunConfig) *SimulatedAnnealing {
+	t.Helper()
+
+	metric, err := NewMetric(config.Metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	costFunction, err := NewCostFunction(config.CostFunction, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	randomSeeds := newRandomSource(config.RandomSeed)
+	voronoi, err := NewVoronoi(target.Width, target.Height, config.NumSeeds, config.Tessellator, metric, randomSeeds.Int63())
+	if err != nil {
+		t.Fatal(err)
+	}
+	statFile, err := os.CreateTemp(t.TempDir(), "stats-*.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { statFile.Close() })
+
+	sa, err := NewSimulatedAnnealing(
+		voronoi,
+		target,
+		costFunction,
+		config.Structure,
+		statFile,
+		config.SimulationDuration,
+		config.Cooling,
+		config.Acceptance,
+		config.Colors,
+		config.DebugCostInterval,
+		randomSeeds.Int63(),
+		config.Workers,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa.WithIterations(config.Iterations)
+	return sa
+}
+
+// iterate runs the given number of iterations of the annealing
+func iterate(t *testing.T, sa *SimulatedAnnealing, iterations int) {
+	t.Helper()
+
+	for i := 0; i < iterations; i++ {
+		if err := sa.Iterate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIncrementalCost(t *testing.T) {
+	tests := []struct {
+		name         string
+		numSeeds     int
+		metric       MetricConfig
+		costFunction string
+		structure    StructureConfig
+		acceptance   AcceptanceConfig
+		colors       ColorConfig
+		weighted     bool
+		transparent  bool
+	}{
+		{"l1", 60, MetricConfig{Name: "euclidean"}, "l1", StructureConfig{Name: "none"}, AcceptanceConfig{Criterion: "metropolis"}, ColorConfig{Estimator: "random"}, false, false},
+		{"l2, sigmoid", 60, MetricConfig{Name: "euclidean"}, "l2", StructureConfig{Name: "none"}, AcceptanceConfig{Criterion: "sigmoid", SigmoidSteepness: 10}, ColorConfig{Estimator: "random"}, false, false},
+		{"luma, late acceptance, mean colors, weighted", 60, MetricConfig{Name: "manhattan"}, "luma", StructureConfig{Name: "none"}, AcceptanceConfig{Criterion: "lateAcceptance", HistoryLength: 50}, ColorConfig{Estimator: "mean"}, true, false},
+		{"ciede2000, median colors, transparent", 60, MetricConfig{Name: "power", MaxWeight: 8}, "ciede2000", StructureConfig{Name: "none"}, AcceptanceConfig{Criterion: "metropolis"}, ColorConfig{Estimator: "median"}, false, true},
+		{"l2, few large cells", 4, MetricConfig{Name: "euclidean"}, "l2", StructureConfig{Name: "none"}, AcceptanceConfig{Criterion: "metropolis"}, ColorConfig{Estimator: "median"}, false, false},
+		{"l1, recolored, transparent", 60, MetricConfig{Name: "additive", MaxWeight: 8}, "l1", StructureConfig{Name: "none"}, AcceptanceConfig{Criterion: "metropolis"}, ColorConfig{Estimator: "mean", RecolorInterval: 7}, false, true},
+		{"l2, anisotropic", 60, MetricConfig{Name: "anisotropic", MaxStretch: 3}, "l2", StructureConfig{Name: "none"}, AcceptanceConfig{Criterion: "metropolis"}, ColorConfig{Estimator: "random"}, false, false},
+		{"l2+ssim", 60, MetricConfig{Name: "euclidean"}, "l2", StructureConfig{Name: "ssim", Weight: 0.5}, AcceptanceConfig{Criterion: "metropolis"}, ColorConfig{Estimator: "random"}, false, false},
+		{"l1+msssim, recolored, weighted", 60, MetricConfig{Name: "anisotropic", MaxStretch: 3}, "l1", StructureConfig{Name: "msssim", Weight: 0.5}, AcceptanceConfig{Criterion: "metropolis"}, ColorConfig{Estimator: "mean", RecolorInterval: 5}, true, false},
+		{"luma+msssim, only structure", 60, MetricConfig{Name: "euclidean"}, "luma", StructureConfig{Name: "msssim", Weight: 1}, AcceptanceConfig{Criterion: "metropolis"}, ColorConfig{Estimator: "random"}, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testRunConfig()
+			config.NumSeeds = test.numSeeds
+			config.Metric = test.metric
+			config.CostFunction = test.costFunction
+			config.Structure = test.structure
+			config.Acceptance = test.acceptance
+			config.Colors = test.colors
+			config.DebugCostInterval = 1 // each iteration cross-checks the incremental cost against a full recomputation
+			target := testTarget(96, 80, test.transparent)
+			if test.weighted {
+				target = withTestWeights(target)
+			}
+			sa := newTestAnnealing(t, target, config)
+
+			// the moves must be both accepted and rolled back for the cross-check to mean anything
+			accepted, rejected := 0, 0
+			for i := 0; i < config.Iterations; i++ {
+				cost := sa.cost
+				iterate(t, sa, 1)
+				if sa.cost != cost {
+					accepted++
+				} else {
+					rejected++
+				}
+			}
+			if accepted == 0 || rejected == 0 {
+				t.Fatalf("%d moves accepted and %d rejected, expected both", accepted, rejected)
+			}
+			if full := sa.computeCost(); full != sa.cost {
+				t.Fatalf("cost of the current solution is %.10f, recomputed as %.10f", sa.cost, full)
+			}
+		})
+	}
+}
+
+// assertSameAnnealing fails the test if two annealing engines differ in their current or best solutions,
+// in their diagrams, in their costs or in their images
+func assertSameAnnealing(t *testing.T, got *SimulatedAnnealing, expected *SimulatedAnnealing) {
+	t.Helper()
+
+	assertSameSeeds(t, got.voronoi.GetSeeds(), expected.voronoi.GetSeeds())
+	assertSameSeeds(t, got.GetBestSolution(), expected.GetBestSolution())
+	if got.cost != expected.cost || got.bestCost != expected.bestCost {
+		t.Fatalf("costs are %.17g (best %.17g), expected %.17g (best %.17g)", got.cost, got.bestCost, expected.cost, expected.bestCost)
+	}
+	if got.cooling.Temperature() != expected.cooling.Temperature() {
+		t.Fatalf("temperature is %.17g, expected %.17g", got.cooling.Temperature(), expected.cooling.Temperature())
+	}
+	gotDiagram, expectedDiagram := got.voronoi.GetDiagram(), expected.voronoi.GetDiagram()
+	for p := range gotDiagram.Owners {
+		if gotDiagram.Owners[p] != expectedDiagram.Owners[p] {
+			t.Fatalf("pixel %d is owned by seed %d, expected %d", p, gotDiagram.Owners[p], expectedDiagram.Owners[p])
+		}
+	}
+	gotPixels, expectedPixels := got.ToPixels(), expected.ToPixels()
+	for i := range gotPixels {
+		if gotPixels[i] != expectedPixels[i] {
+			t.Fatalf("channel %d of pixel %d is %d, expected %d", i%4, i/4, gotPixels[i], expectedPixels[i])
+		}
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	tests := []struct {
+		name        string
+		tessellator string
+		numSeeds    int
+		structure   StructureConfig
+		colors      ColorConfig
+		weighted    bool
+		transparent bool
+	}{
+		{"ring", "ring", 60, StructureConfig{Name: "none"}, ColorConfig{Estimator: "random"}, false, false},
+		{"ring, few large cells", "ring", 3, StructureConfig{Name: "none"}, ColorConfig{Estimator: "mean"}, false, false},
+		{"ring+ssim, transparent", "ring", 60, StructureConfig{Name: "ssim", Weight: 0.5}, ColorConfig{Estimator: "mean"}, false, true},
+		{"jfa", "jfa", 60, StructureConfig{Name: "none"}, ColorConfig{Estimator: "random"}, false, false},
+		{"jfa+msssim, recolored, weighted", "jfa", 40, StructureConfig{Name: "msssim", Weight: 0.5}, ColorConfig{Estimator: "median", RecolorInterval: 9}, true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			// the target is large enough for the pixels to be split among the workers
+			target := testTarget(160, 128, test.transparent)
+			if test.weighted {
+				target = withTestWeights(target)
+			}
+			config := testRunConfig()
+			config.Iterations = 150
+			config.Tessellator = test.tessellator
+			config.NumSeeds = test.numSeeds
+			config.Structure = test.structure
+			config.Colors = test.colors
+			config.DebugCostInterval = 10
+
+			config.Workers = 1
+			sequential := newTestAnnealing(t, target, config)
+			config.Workers = 4
+			parallel := newTestAnnealing(t, target, config)
+			assertSameAnnealing(t, parallel, sequential)
+
+			for i := 0; i < config.Iterations; i += 10 {
+				iterate(t, sequential, 10)
+				iterate(t, parallel, 10)
+				assertSameAnnealing(t, parallel, sequential)
+			}
+		})
+	}
+}
+
+func TestLateAcceptanceHistory(t *testing.T) {
+	config := testRunConfig()
+	config.Acceptance = AcceptanceConfig{Criterion: "lateAcceptance", HistoryLength: 7}
+	sa := newTestAnnealing(t, testTarget(64, 48, false), config)
+
+	for i := 0; i < 100; i++ {
+		// on every other iteration a best cost far below the current one makes any accepted candidate restart from the best solution
+		if i%2 == 1 {
+			sa.bestCost = sa.cost / 2
+			sa.bestSolution = sa.voronoi.GetSeeds()
+		}
+		iterate(t, sa, 1)
+
+		// the history holds the cost actually kept by the iteration, rather than the one of the candidate
+		state := sa.acceptance.State()
+		if cost := state.History[(state.Iteration-1)%len(state.History)]; cost != sa.cost {
+			t.Fatalf("history recorded the cost %.17g at iteration %d, expected the kept cost %.17g", cost, i, sa.cost)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"time"
+)
+
+// Snapshotter saves the PNG snapshots of the simulation, both the periodic ones and the final one
+type Snapshotter struct {
+	imageName    string
+	numSeeds     int
+	metricConfig MetricConfig // metric of the diagram, saved together with the best solution
+	alpha        []byte       // alpha of the pixels of the target, saved together with the best solution (nil if the target is opaque)
+
+	simulationStart time.Time // time mark of the beginning of the simulation, used to name the snapshots
+
+	// snapshots logic timers
+	lastSnapshot      time.Time
+	snapshotsInterval time.Duration
+
+	// time-lapse of the simulation (nil if it's not recorded)
+	animation       AnimationWriter
+	animationConfig AnimationConfig
+	lastFrame       time.Time
+	frameInterval   time.Duration
+
+	// checkpoints of the run (disabled if the path is empty)
+	checkpointPath     string
+	checkpointInterval time.Duration
+	lastCheckpoint     time.Time
+	runConfig          RunConfig // parameters of the run, saved in the checkpoints
+	targetHash         string    // hash of the target image, saved in the checkpoints
+}
+
+// NewSnapshotter creates a snapshotter whose interval timer starts now
+func NewSnapshotter(
+	imageName string,
+	numSeeds int,
+	snapshotsInterval time.Duration,
+	metricConfig MetricConfig,
+	alpha []byte,
+) *Snapshotter {
+
+	return &Snapshotter{
+		imageName:         imageName,
+		numSeeds:          numSeeds,
+		metricConfig:      metricConfig,
+		alpha:             alpha,
+		simulationStart:   time.Now(),
+		lastSnapshot:      time.Now(),
+		snapshotsInterval: snapshotsInterval,
+	}
+}
+
+// WithAnimation records a time-lapse of the simulation, adding a frame to the animation every frame interval.
+// The best solution is held as the final frame, and the animation is closed by SaveBest
+func (s *Snapshotter) WithAnimation(animation AnimationWriter, config AnimationConfig, frameInterval time.Duration) {
+	s.animation = animation
+	s.animationConfig = config
+	s.frameInterval = frameInterval
+}
+
+// WithCheckpoints saves a checkpoint of the run at the given path every checkpoint interval,
+// and once more when the best solution is saved, so an interrupted run can be resumed from where it stopped
+func (s *Snapshotter) WithCheckpoints(path string, interval time.Duration, config RunConfig, targetImage TargetImage) {
+	s.checkpointPath = path
+	s.checkpointInterval = interval
+	s.lastCheckpoint = time.Now()
+	s.runConfig = config
+	s.targetHash = targetHash(targetImage)
+}
+
+// Resume moves the beginning of the simulation back by the time elapsed before a checkpoint,
+// so the snapshots of a resumed run are named after the total time of the simulation
+func (s *Snapshotter) Resume(elapsed time.Duration) {
+	s.simulationStart = time.Now().Add(-elapsed)
+}
+
+// SaveIfDue saves a snapshot of the current solution of the engine,
+// but only if the last snapshot is older than the snapshots interval.
+// The frames of the time-lapse and the checkpoints, if enabled, are saved in the same way
+func (s *Snapshotter) SaveIfDue(engine SimulatedAnnealingEngine) error {
+
+	// the first frame is the initial solution
+	if s.animation != nil && (s.lastFrame.IsZero() || time.Since(s.lastFrame) > s.frameInterval) {
+		err := s.animation.AddFrame(engine.GetSnapshot(), s.animationConfig.frameDuration())
+		if err != nil {
+			return err
+		}
+		s.lastFrame = time.Now()
+	}
+
+	if s.checkpointPath != "" && time.Since(s.lastCheckpoint) > s.checkpointInterval {
+		if err := s.saveCheckpoint(engine); err != nil {
+			return err
+		}
+		s.lastCheckpoint = time.Now()
+	}
+
+	// skip the saving if the last snapshot is still too recent
+	if !(time.Since(s.lastSnapshot) > s.snapshotsInterval) {
+		return nil
+	}
+
+	err := savePNG(
+		fmt.Sprintf("./res/%s_%d-seeds_%d.png",
+			s.imageName,
+			s.numSeeds,
+			int(time.Since(s.simulationStart).Seconds()),
+		),
+		engine.GetSnapshot(),
+	)
+	if err != nil {
+		return err
+	}
+
+	// reset the snapshot interval timer
+	s.lastSnapshot = time.Now()
+
+	return nil
+}
+
+// SaveBest saves the best solution found by the engine so far,
+// both as a png image and as a json solution that can be exported later
+func (s *Snapshotter) SaveBest(engine SimulatedAnnealingEngine) error {
+	seeds := engine.GetBestSolution()
+	i, err := engine.GetBestSnapshot()
+	if err != nil {
+		return err
+	}
+
+	err = savePNG(
+		fmt.Sprintf("./res/%s_%d-seeds_best.png",
+			s.imageName,
+			s.numSeeds,
+		),
+		i,
+	)
+	if err != nil {
+		return err
+	}
+
+	// the best solution ends the time-lapse
+	if s.animation != nil {
+		if err := s.animation.AddFrame(i, s.animationConfig.finalFrameDuration()); err != nil {
+			return err
+		}
+		if err := s.animation.Close(); err != nil {
+			return err
+		}
+		s.animation = nil
+	}
+
+	// the last checkpoint is taken where the simulation stopped
+	if s.checkpointPath != "" {
+		if err := s.saveCheckpoint(engine); err != nil {
+			return err
+		}
+	}
+
+	solution, err := NewSolution(i.Bounds().Dx(), i.Bounds().Dy(), s.metricConfig, seeds, s.alpha)
+	if err != nil {
+		return err
+	}
+
+	return saveSolution(
+		fmt.Sprintf("./res/%s_%d-seeds_best.json",
+			s.imageName,
+			s.numSeeds,
+		),
+		solution,
+	)
+}
+
+// saveCheckpoint saves the current state of the engine, together with the parameters of the run
+func (s *Snapshotter) saveCheckpoint(engine SimulatedAnnealingEngine) error {
+	return saveCheckpoint(s.checkpointPath, Checkpoint{
+		Version:    checkpointVersion,
+		TargetHash: s.targetHash,
+		SavedAt:    time.Now(),
+		Config:     s.runConfig,
+		State:      engine.GetState(),
+	})
+}
+
+// savePNG encodes the image into a png file at the given path
+func savePNG(path string, i image.Image) error {
+
+	// create a png file for the snapshot
+	pngFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer pngFile.Close()
+
+	// save the data into the png file
+	return png.Encode(pngFile, i)
+}
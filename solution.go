@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"os"
+)
+
+// Solution is the persisted form of a set of seeds, together with the size and the metric of the diagram they tessellate.
+// It allows to export the result of a simulation once the simulation is over
+type Solution struct {
+	Width      int            `json:"width"`
+	Height     int            `json:"height"`
+	Metric     string         `json:"metric,omitempty"`
+	MinkowskiP float64        `json:"minkowskiP,omitempty"`
+	Seeds      []SolutionSeed `json:"seeds"`
+	AlphaMask  []byte         `json:"alphaMask,omitempty"` // alpha of the pixels of the target, as a grayscale png (omitted if the target is opaque)
+}
+
+// SolutionSeed is a seed of a persisted solution
+type SolutionSeed struct {
+	X       int     `json:"x"`
+	Y       int     `json:"y"`
+	R       uint8   `json:"r"`
+	G       uint8   `json:"g"`
+	B       uint8   `json:"b"`
+	A       *uint8  `json:"a,omitempty"` // alpha of the color, omitted if it's opaque
+	Angle   float64 `json:"angle,omitempty"`
+	Stretch float64 `json:"stretch,omitempty"`
+	Weight  float64 `json:"weight,omitempty"`
+}
+
+// NewSolution creates the persisted form of the given seeds, together with the alpha of the pixels of the target (nil if it's opaque)
+func NewSolution(width int, height int, metricConfig MetricConfig, seeds []Point, alpha []byte) (Solution, error) {
+	solution := Solution{
+		Width:  width,
+		Height: height,
+		Metric: metricConfig.Name,
+		Seeds:  solutionSeeds(seeds),
+	}
+	if metricConfig.Name == "minkowski" {
+		solution.MinkowskiP = metricConfig.P
+	}
+	if alpha != nil {
+		mask, err := encodeAlphaMask(alpha, width, height)
+		if err != nil {
+			return Solution{}, err
+		}
+		solution.AlphaMask = mask
+	}
+
+	return solution, nil
+}
+
+// Points returns the seeds of the solution, in the form used by the voronoi diagram
+func (s Solution) Points() []Point {
+	return seedPoints(s.Seeds)
+}
+
+// solutionSeeds converts the seeds of a diagram to their persisted form
+func solutionSeeds(points []Point) []SolutionSeed {
+	seeds := make([]SolutionSeed, len(points))
+	for i, p := range points {
+		seeds[i] = SolutionSeed{X: p.X, Y: p.Y, Angle: p.Angle, Stretch: p.Stretch, Weight: p.Weight}
+		if p.Color != nil {
+			seeds[i].R = p.Color.R
+			seeds[i].G = p.Color.G
+			seeds[i].B = p.Color.B
+			if p.Color.A != 255 {
+				alpha := p.Color.A
+				seeds[i].A = &alpha
+			}
+		}
+	}
+
+	return seeds
+}
+
+// seedPoints converts persisted seeds back to the form used by the voronoi diagram.
+// The seeds saved without their alpha are opaque
+func seedPoints(seeds []SolutionSeed) []Point {
+	points := make([]Point, len(seeds))
+	for i, seed := range seeds {
+		alpha := uint8(255)
+		if seed.A != nil {
+			alpha = *seed.A
+		}
+		points[i] = Point{
+			X:       seed.X,
+			Y:       seed.Y,
+			Color:   &color.RGBA{R: seed.R, G: seed.G, B: seed.B, A: alpha},
+			Angle:   seed.Angle,
+			Stretch: seed.Stretch,
+			Weight:  seed.Weight,
+		}
+	}
+
+	return points
+}
+
+// Alpha returns the alpha of the pixels of the diagram, or nil if the solution is opaque
+func (s Solution) Alpha() ([]byte, error) {
+	if s.AlphaMask == nil {
+		return nil, nil
+	}
+	return decodeAlphaMask(s.AlphaMask, s.Width, s.Height)
+}
+
+// MetricConfig returns the configuration of the metric of the solution.
+// The solutions saved before the metric was configurable are euclidean
+func (s Solution) MetricConfig() MetricConfig {
+	config := MetricConfig{Name: s.Metric, P: s.MinkowskiP, MaxStretch: 1}
+	if config.Name == "" {
+		config.Name = "euclidean"
+	}
+	return config
+}
+
+// saveSolution encodes the solution into a json file at the given path
+func saveSolution(path string, solution Solution) error {
+	data, err := json.Marshal(solution)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// loadSolution reads the solution stored in the json file at the given path, checking that its seeds lie within the diagram
+func loadSolution(path string) (Solution, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Solution{}, err
+	}
+
+	var solution Solution
+	if err := json.Unmarshal(data, &solution); err != nil {
+		return Solution{}, fmt.Errorf("Invalid solution file '%s': %w", path, err)
+	}
+	if solution.Width <= 0 || solution.Height <= 0 {
+		return Solution{}, fmt.Errorf("Invalid solution file '%s': the size of the diagram must be positive", path)
+	}
+	if len(solution.Seeds) == 0 {
+		return Solution{}, fmt.Errorf("Invalid solution file '%s': no seeds found", path)
+	}
+	for i, s := range solution.Seeds {
+		if s.X < 0 || s.X >= solution.Width || s.Y < 0 || s.Y >= solution.Height {
+			return Solution{}, fmt.Errorf("Invalid solution file '%s': seed %d lies outside of the diagram", path, i)
+		}
+	}
+	if _, err := solution.Alpha(); err != nil {
+		return Solution{}, fmt.Errorf("Invalid solution file '%s': %w", path, err)
+	}
+
+	return solution, nil
+}
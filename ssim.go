@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+)
+
+const (
+	// ssimWindowSize is the side of the windows of the SSIM, in cells of their scale
+	ssimWindowSize = 8
+
+	// ssimC1 and ssimC2 stabilize the divisions of the SSIM on flat windows
+	ssimC1 = (0.01 * 255) * (0.01 * 255)
+	ssimC2 = (0.03 * 255) * (0.03 * 255)
+)
+
+// msssimWeights are the exponents of the scales of the MS-SSIM, from the finest to the coarsest one (Wang, Simoncelli and Bovik, 2003)
+var msssimWeights = []float64{0.0448, 0.2856, 0.3001, 0.2363, 0.1333}
+
+// StructureConfig contains the parameters of the structural cost, blended with the pixel cost
+type StructureConfig struct {
+	Name   string  // structural similarity index: none, ssim or msssim
+	Weight float64 // weight of the structural cost in the blend with the pixel cost, in the interval [0,1]
+}
+
+// structuralCost measures the structural dissimilarity of the diagram from the target image, as 1 - SSIM
+// (https://en.wikipedia.org/wiki/Structural_similarity) computed on the luma of the pixels.
+//
+// The SSIM compares the mean, the variance and the covariance of the pixels in windows of the images, so it rewards
+// the edges and the textures in the right places rather than the exact colors. The windows slide over the image one cell at a time,
+// so a changed pixel affects the windows around it, whose similarity is recomputed once all the changed pixels are updated:
+// the cost is updated incrementally as the pixel cost. With a weight map, each window counts as much as the total importance of its pixels.
+//
+// The multi-scale variant (MS-SSIM) computes the SSIM on the image downsampled by 2, 4, 8 and 16 too, and combines the scales
+// with their standard weights: the coarser scales compare the larger structures of the image. As in the standard definition,
+// the luminance is only compared on the coarsest scale, the finer ones only comparing the contrast and the structure
+type structuralCost struct {
+	name    string
+	width   int
+	height  int
+	scales  []ssimScale
+	weights []float64 // exponent of each scale
+
+	// incremental evaluation
+	pixelJournal  []ssimPixelChange  // luma changes of the pixels in the last evaluation, to roll them back
+	windowJournal []ssimWindowChange // value changes of the windows in the last evaluation, to roll them back
+	generation    uint32             // generation of the current evaluation, to mark the dirty windows once
+}
+
+// ssimScale is a level of the pyramid of the structural cost, whose cells are squares of pixels of the same size
+type ssimScale struct {
+	size      int       // side of the cells, in pixels
+	cellsX    int       // number of columns of cells
+	cellsY    int       // number of rows of cells
+	sums      []int64   // total luma of the pixels of the diagram in each cell
+	counts    []int64   // number of pixels in each cell (fewer than size*size on the borders of the image)
+	target    []float64 // mean luma of the target image in each cell
+	windowsX  int       // number of columns of windows, each one starting at a column of cells
+	windowsY  int       // number of rows of windows, each one starting at a row of cells
+	values    []int64   // similarity of each window, in fixed point
+	weights   []int64   // importance of each window, as the total importance of its pixels
+	total     int64     // total similarity of the windows weighted by their importance, in fixed point
+	maxTotal  int64     // total similarity of identical images, in fixed point
+	stamps    []uint32  // generation of the last evaluation that marked each window as dirty
+	dirty     []int     // windows affected by the changes of the current evaluation
+	luminance bool      // whether the similarity of the windows includes the luminance term (only on the coarsest scale)
+}
+
+// ssimPixelChange is an entry of the journal of the pixels of the structural cost
+type ssimPixelChange struct {
+	pixel   int
+	oldLuma int64
+}
+
+// ssimWindowChange is an entry of the journal of the windows of the structural cost
+type ssimWindowChange struct {
+	scale    int
+	window   int
+	oldValue int64
+}
+
+// newStructuralCost creates the structural cost with the given name (ssim or msssim), measuring the dissimilarity from the target image.
+// The initial diagram is black, until the cost is updated with the pixels of the diagram
+func newStructuralCost(name string, target TargetImage) (*structuralCost, error) {
+	scales := 1
+	switch name {
+	case "ssim":
+	case "msssim":
+		// the coarser scales are only used if the image contains at least one whole window of theirs
+		for scales < len(msssimWeights) && ssimWindowSize<<scales <= target.Width && ssimWindowSize<<scales <= target.Height {
+			scales++
+		}
+	default:
+		return nil, fmt.Errorf("Unknown structural cost '%s'", name)
+	}
+
+	s := &structuralCost{
+		name:    name,
+		width:   target.Width,
+		height:  target.Height,
+		weights: []float64{1},
+	}
+	if name == "msssim" {
+		s.weights = normalizedWeights(msssimWeights[:scales])
+	}
+
+	for j := 0; j < scales; j++ {
+		size := 1 << j
+		sc := ssimScale{
+			size:      size,
+			cellsX:    (target.Width + size - 1) / size,
+			cellsY:    (target.Height + size - 1) / size,
+			luminance: j == scales-1,
+		}
+		sc.sums = make([]int64, sc.cellsX*sc.cellsY)
+		sc.counts = make([]int64, sc.cellsX*sc.cellsY)
+		sc.target = make([]float64, sc.cellsX*sc.cellsY)
+		sc.windowsX = windowsCount(sc.cellsX)
+		sc.windowsY = windowsCount(sc.cellsY)
+		sc.values = make([]int64, sc.windowsX*sc.windowsY)
+		sc.weights = make([]int64, sc.windowsX*sc.windowsY)
+		sc.stamps = make([]uint32, sc.windowsX*sc.windowsY)
+
+		cellWeights := make([]int64, sc.cellsX*sc.cellsY)
+		for p := 0; p < target.Width*target.Height; p++ {
+			c := sc.cell(p, target.Width)
+			t := target.Bytes[p*4 : p*4+3]
+			sc.counts[c]++
+			sc.target[c] += float64(luma(color.RGBA{R: t[0], G: t[1], B: t[2]}))
+			cellWeights[c] += int64(target.pixelWeight(p))
+		}
+		for c := range sc.target {
+			sc.target[c] /= float64(sc.counts[c])
+			sc.forEachWindow(c, func(w int) {
+				sc.weights[w] += cellWeights[c]
+			})
+		}
+		for w := range sc.values {
+			sc.values[w] = sc.windowValue(w)
+			sc.total += sc.values[w] * sc.weights[w]
+			sc.maxTotal += costScale * sc.weights[w]
+		}
+
+		s.scales = append(s.scales, sc)
+	}
+
+	return s, nil
+}
+
+// windowsCount returns the number of windows sliding along a side of the given number of cells.
+// A side shorter than a window gets a single window, covering all of its cells
+func windowsCount(cells int) int {
+	if cells < ssimWindowSize {
+		return 1
+	}
+	return cells - ssimWindowSize + 1
+}
+
+// normalizedWeights scales the weights so that their sum is 1
+func normalizedWeights(weights []float64) []float64 {
+	sum := 0.0
+	for _, w := range weights {
+		sum += w
+	}
+	normalized := make([]float64, len(weights))
+	for i, w := range weights {
+		normalized[i] = w / sum
+	}
+	return normalized
+}
+
+// luma returns the luma of a color, as in the YCbCr color space
+func luma(c color.RGBA) int64 {
+	y, _, _ := color.RGBToYCbCr(c.R, c.G, c.B)
+	return int64(y)
+}
+
+// Name returns the name of the structural cost
+func (s *structuralCost) Name() string {
+	return s.name
+}
+
+// beginEvaluation starts recording the changes of a new evaluation, forgetting the previous ones
+func (s *structuralCost) beginEvaluation() {
+	s.pixelJournal = s.pixelJournal[:0]
+	s.windowJournal = s.windowJournal[:0]
+	s.generation++
+}
+
+// updatePixel updates the cells containing a pixel with its new color, marking their windows as dirty.
+// The windows are only recomputed by updateWindows, once all the changed pixels are updated
+func (s *structuralCost) updatePixel(p int, c color.RGBA) {
+	finest := &s.scales[0]
+	delta := luma(c) - finest.sums[p]
+	if delta == 0 {
+		return
+	}
+
+	s.pixelJournal = append(s.pixelJournal, ssimPixelChange{pixel: p, oldLuma: finest.sums[p]})
+	for j := range s.scales {
+		sc := &s.scales[j]
+		cell := sc.cell(p, s.width)
+		sc.sums[cell] += delta
+
+		sc.forEachWindow(cell, func(w int) {
+			if sc.stamps[w] != s.generation {
+				sc.stamps[w] = s.generation
+				sc.dirty = append(sc.dirty, w)
+			}
+		})
+	}
+}
+
+// updateWindows recomputes the similarity of the windows affected by the updated pixels
+func (s *structuralCost) updateWindows() {
+	for j := range s.scales {
+		sc := &s.scales[j]
+		for _, w := range sc.dirty {
+			value := sc.windowValue(w)
+			if value == sc.values[w] {
+				continue
+			}
+			s.windowJournal = append(s.windowJournal, ssimWindowChange{scale: j, window: w, oldValue: sc.values[w]})
+			sc.total += (value - sc.values[w]) * sc.weights[w]
+			sc.values[w] = value
+		}
+		sc.dirty = sc.dirty[:0]
+	}
+}
+
+// rollback restores the state before the last evaluation, from the journals
+func (s *structuralCost) rollback() {
+	for i := len(s.pixelJournal) - 1; i >= 0; i-- {
+		change := s.pixelJournal[i]
+		delta := change.oldLuma - s.scales[0].sums[change.pixel]
+		for j := range s.scales {
+			s.scales[j].sums[s.scales[j].cell(change.pixel, s.width)] += delta
+		}
+	}
+	for i := len(s.windowJournal) - 1; i >= 0; i-- {
+		change := s.windowJournal[i]
+		sc := &s.scales[change.scale]
+		sc.total += (change.oldValue - sc.values[change.window]) * sc.weights[change.window]
+		sc.values[change.window] = change.oldValue
+	}
+
+	s.pixelJournal = s.pixelJournal[:0]
+	s.windowJournal = s.windowJournal[:0]
+}
+
+// cost returns the structural dissimilarity of the diagram, in the interval [0,1]
+func (s *structuralCost) cost() float64 {
+	similarity := 1.0
+	for j, sc := range s.scales {
+		mean := float64(sc.total) / float64(sc.maxTotal)
+		similarity *= math.Pow(mean, s.weights[j])
+	}
+	return 1 - similarity
+}
+
+// computeCost computes from scratch the structural dissimilarity of the given RGBA pixels, without altering the state of the cost
+func (s *structuralCost) computeCost(pixels []byte) float64 {
+	fresh := &structuralCost{name: s.name, width: s.width, height: s.height, weights: s.weights}
+	for _, sc := range s.scales {
+		sc.sums = make([]int64, len(sc.sums))
+		sc.values = make([]int64, len(sc.values))
+		sc.total = 0
+		for p := 0; p < s.width*s.height; p++ {
+			sc.sums[sc.cell(p, s.width)] += luma(color.RGBA{R: pixels[p*4], G: pixels[p*4+1], B: pixels[p*4+2]})
+		}
+		for w := range sc.values {
+			sc.values[w] = sc.windowValue(w)
+			sc.total += sc.values[w] * sc.weights[w]
+		}
+		fresh.scales = append(fresh.scales, sc)
+	}
+
+	return fresh.cost()
+}
+
+// cell returns the cell of the scale containing the given pixel
+func (sc *ssimScale) cell(p int, width int) int {
+	return (p/width)/sc.size*sc.cellsX + (p%width)/sc.size
+}
+
+// forEachWindow calls the given function with each window of the scale containing the given cell
+func (sc *ssimScale) forEachWindow(c int, f func(w int)) {
+	cx, cy := c%sc.cellsX, c/sc.cellsX
+	for wy := clamp(cy-ssimWindowSize+1, 0, sc.windowsY-1); wy <= cy && wy < sc.windowsY; wy++ {
+		for wx := clamp(cx-ssimWindowSize+1, 0, sc.windowsX-1); wx <= cx && wx < sc.windowsX; wx++ {
+			f(wy*sc.windowsX + wx)
+		}
+	}
+}
+
+// windowValue computes the similarity of a window, comparing the mean luma of its cells with the target.
+// The similarity is the product of the contrast-structure and (on the coarsest scale only) luminance terms of the SSIM,
+// clamped to 0 and returned in fixed point
+func (sc *ssimScale) windowValue(w int) int64 {
+	minX := w % sc.windowsX
+	minY := w / sc.windowsX
+
+	var n, sumX, sumY, sumXX, sumYY, sumXY float64
+	for cy := minY; cy < minY+ssimWindowSize && cy < sc.cellsY; cy++ {
+		for cx := minX; cx < minX+ssimWindowSize && cx < sc.cellsX; cx++ {
+			c := cy*sc.cellsX + cx
+			x := float64(sc.sums[c]) / float64(sc.counts[c])
+			y := sc.target[c]
+			n++
+			sumX += x
+			sumY += y
+			sumXX += x * x
+			sumYY += y * y
+			sumXY += x * y
+		}
+	}
+
+	meanX, meanY := sumX/n, sumY/n
+	varX := sumXX/n - meanX*meanX
+	varY := sumYY/n - meanY*meanY
+	covariance := sumXY/n - meanX*meanY
+
+	similarity := (2*covariance + ssimC2) / (varX + varY + ssimC2)
+	if sc.luminance {
+		similarity *= (2*meanX*meanY + ssimC1) / (meanX*meanX + meanY*meanY + ssimC1)
+	}
+
+	return int64(math.Round(math.Max(similarity, 0) * costScale))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// SVGOptions contains the styling of the SVG export of a solution
+type SVGOptions struct {
+	StrokeColor string  // color of the borders of the cells
+	StrokeWidth float64 // width of the borders of the cells, in pixels of the target image. If not positive, the borders are not drawn
+	SeedDots    bool    // whether to draw a dot on each seed
+	SeedRadius  float64 // radius of the seed dots, in pixels of the target image
+	SeedColor   string  // color of the seed dots
+}
+
+// writeSVG writes the cells of a solution as an SVG document, with each cell drawn as a filled polygon.
+//
+// The viewBox matches the size of the target image, so the document can be scaled to any size without losing quality.
+// Cells and seed dots are written in two separate groups, that vector editors (e.g. Inkscape) show as layers.
+// The alpha mask of transparent targets (a grayscale png, or nil) is embedded in the document, and it masks the cells
+func writeSVG(w io.Writer, width int, height int, seeds []Point, cells []Cell, alphaMask []byte, options SVGOptions) error {
+	out := bufio.NewWriter(w)
+
+	fmt.Fprintf(out, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	fmt.Fprintf(out,
+		"<svg xmlns=\"http://www.w3.org/2000/svg\" xmlns:xlink=\"http://www.w3.org/1999/xlink\" xmlns:inkscape=\"http://www.inkscape.org/namespaces/inkscape\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n",
+		width, height, width, height,
+	)
+
+	// the luminance of the mask image is the alpha of the pixels, so the cells fade out exactly as the target
+	mask := ""
+	if alphaMask != nil {
+		fmt.Fprintf(out, "<defs>\n<mask id=\"alpha\" maskUnits=\"userSpaceOnUse\" x=\"0\" y=\"0\" width=\"%d\" height=\"%d\">\n", width, height)
+		fmt.Fprintf(out,
+			"<image width=\"%d\" height=\"%d\" preserveAspectRatio=\"none\" style=\"image-rendering:pixelated\" xlink:href=\"data:image/png;base64,%s\"/>\n",
+			width, height, base64.StdEncoding.EncodeToString(alphaMask),
+		)
+		fmt.Fprintf(out, "</mask>\n</defs>\n")
+		mask = " mask=\"url(#alpha)\""
+	}
+
+	// cells layer
+	if options.StrokeWidth > 0 {
+		fmt.Fprintf(out,
+			"<g id=\"cells\" inkscape:groupmode=\"layer\" inkscape:label=\"cells\"%s stroke=\"%s\" stroke-width=\"%s\" stroke-linejoin=\"round\">\n",
+			mask, html.EscapeString(options.StrokeColor), svgNumber(options.StrokeWidth),
+		)
+	} else {
+		fmt.Fprintf(out, "<g id=\"cells\" inkscape:groupmode=\"layer\" inkscape:label=\"cells\"%s>\n", mask)
+	}
+	for _, cell := range cells {
+		if len(cell.Outlines) == 0 {
+			continue
+		}
+
+		// adjacent shapes are antialiased separately, leaving faint seams between them:
+		// without borders, each cell gets a thin outline of its own color to cover them
+		fill := svgColor(seeds[cell.Seed])
+		style := fmt.Sprintf("fill=\"%s\"", fill)
+		if options.StrokeWidth <= 0 {
+			style += fmt.Sprintf(" stroke=\"%s\" stroke-width=\"0.5\"", fill)
+		}
+
+		// the cells made of a single outline are plain polygons, the others need a path
+		if len(cell.Outlines) == 1 {
+			fmt.Fprintf(out, "<polygon points=\"%s\" %s/>\n", svgPoints(cell.Outlines[0]), style)
+			continue
+		}
+		subpaths := make([]string, len(cell.Outlines))
+		for i, outline := range cell.Outlines {
+			subpaths[i] = "M" + svgPoints(outline) + "Z"
+		}
+		fmt.Fprintf(out, "<path d=\"%s\" fill-rule=\"evenodd\" %s/>\n", strings.Join(subpaths, " "), style)
+	}
+	fmt.Fprintf(out, "</g>\n")
+
+	// seeds layer
+	if options.SeedDots {
+		fmt.Fprintf(out,
+			"<g id=\"seeds\" inkscape:groupmode=\"layer\" inkscape:label=\"seeds\" fill=\"%s\">\n",
+			html.EscapeString(options.SeedColor),
+		)
+		for _, cell := range cells {
+			if len(cell.Outlines) == 0 {
+				continue
+			}
+			center := seedCenter(seeds[cell.Seed])
+			fmt.Fprintf(out, "<circle cx=\"%s\" cy=\"%s\" r=\"%s\"/>\n", svgNumber(center.X), svgNumber(center.Y), svgNumber(options.SeedRadius))
+		}
+		fmt.Fprintf(out, "</g>\n")
+	}
+
+	fmt.Fprintf(out, "</svg>\n")
+
+	return out.Flush()
+}
+
+// svgPoints formats the vertices of an outline as a list of points
+func svgPoints(outline []Vertex) string {
+	points := make([]string, len(outline))
+	for i, v := range outline {
+		points[i] = svgNumber(v.X) + "," + svgNumber(v.Y)
+	}
+	return strings.Join(points, " ")
+}
+
+// svgNumber formats a coordinate with a precision far below the size of a pixel, without trailing zeros
+func svgNumber(f float64) string {
+	s := strconv.FormatFloat(f, 'f', 3, 64)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+// svgColor returns the color of a seed in the hex notation
+func svgColor(p Point) string {
+	if p.Color == nil {
+		return "#000000"
+	}
+	return fmt.Sprintf("#%02x%02x%02x", p.Color.R, p.Color.G, p.Color.B)
+}
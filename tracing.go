@@ -0,0 +1,131 @@
+package main
+
+import "sort"
+
+// pixelEdge is a side of a pixel, going between two corners of the pixel grid
+type pixelEdge struct {
+	fromX int
+	fromY int
+	toX   int
+	toY   int
+}
+
+// traceCells computes the outlines of the cells of the current diagram, following the boundaries of their pixels.
+//
+// Each side of a pixel lying on the boundary of its cell becomes an edge, oriented clockwise around the pixel,
+// so the edges of each cell can be chained into closed outlines: clockwise around the cell, and counterclockwise around its holes
+func (v *Voronoi) traceCells() []Cell {
+	cells := make([]Cell, len(v.seeds))
+	edges := make([][]pixelEdge, len(v.seeds))
+	neighbours := make([]map[int]bool, len(v.seeds))
+	for i := range cells {
+		cells[i].Seed = i
+		neighbours[i] = map[int]bool{}
+	}
+
+	ownerAt := func(x int, y int) int {
+		if x < 0 || x >= v.width || y < 0 || y >= v.height {
+			return -1
+		}
+		return v.owners[y*v.width+x]
+	}
+
+	for y := 0; y < v.height; y++ {
+		for x := 0; x < v.width; x++ {
+			owner := v.owners[y*v.width+x]
+			if owner == -1 {
+				continue
+			}
+
+			// top, right, bottom and left sides of the pixel, with the pixels beyond them
+			sides := [4]struct {
+				beyond int
+				edge   pixelEdge
+			}{
+				{ownerAt(x, y-1), pixelEdge{x, y, x + 1, y}},
+				{ownerAt(x+1, y), pixelEdge{x + 1, y, x + 1, y + 1}},
+				{ownerAt(x, y+1), pixelEdge{x + 1, y + 1, x, y + 1}},
+				{ownerAt(x-1, y), pixelEdge{x, y + 1, x, y}},
+			}
+			for _, side := range sides {
+				if side.beyond == owner {
+					continue
+				}
+				edges[owner] = append(edges[owner], side.edge)
+				if side.beyond != -1 {
+					neighbours[owner][side.beyond] = true
+				}
+			}
+		}
+	}
+
+	for i := range cells {
+		cells[i].Outlines = chainOutlines(edges[i], v.width)
+		for n := range neighbours[i] {
+			cells[i].Neighbours = append(cells[i].Neighbours, n)
+		}
+		sort.Ints(cells[i].Neighbours)
+	}
+
+	return cells
+}
+
+// chainOutlines chains the boundary edges of a cell into closed outlines.
+//
+// Where the cell touches itself at a corner, two outlines meet: the chaining turns right,
+// so that each outline keeps following the same pixels
+func chainOutlines(edges []pixelEdge, width int) [][]Vertex {
+	corner := func(x int, y int) int { return y*(width+1) + x }
+
+	outgoing := map[int][]int{}
+	for i, e := range edges {
+		outgoing[corner(e.fromX, e.fromY)] = append(outgoing[corner(e.fromX, e.fromY)], i)
+	}
+
+	used := make([]bool, len(edges))
+	outlines := [][]Vertex{}
+	for start := range edges {
+		if used[start] {
+			continue
+		}
+
+		outline := []Vertex{}
+		for e := start; e != -1; {
+			used[e] = true
+			edge := edges[e]
+			outline = append(outline, Vertex{X: float64(edge.fromX), Y: float64(edge.fromY)})
+
+			// the right turn of the direction (dx,dy) is (-dy,dx), with the y axis pointing down
+			dx, dy := edge.toX-edge.fromX, edge.toY-edge.fromY
+			e = -1
+			for _, candidate := range outgoing[corner(edge.toX, edge.toY)] {
+				if used[candidate] {
+					continue
+				}
+				c := edges[candidate]
+				if e == -1 || (c.toX-c.fromX == -dy && c.toY-c.fromY == dx) {
+					e = candidate
+				}
+			}
+		}
+
+		outlines = append(outlines, simplifyOutline(outline))
+	}
+
+	return outlines
+}
+
+// simplifyOutline removes the vertices lying on a straight line between their neighbours
+func simplifyOutline(outline []Vertex) []Vertex {
+	simplified := []Vertex{}
+	for i, p := range outline {
+		prev := outline[(i+len(outline)-1)%len(outline)]
+		next := outline[(i+1)%len(outline)]
+		if (p.X-prev.X)*(next.Y-p.Y) == (p.Y-prev.Y)*(next.X-p.X) {
+			continue
+		}
+		simplified = append(simplified, p)
+	}
+
+	return simplified
+}
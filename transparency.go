@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+)
+
+// opaqueAlpha is the minimum alpha of the pixels of the target to be fitted: the more transparent ones don't count in the cost,
+// and the seeds are kept away from them
+const opaqueAlpha = 128
+
+// alphaMask returns the alpha of each pixel of the target image, or nil if the image is fully opaque
+func (t TargetImage) alphaMask() []byte {
+	alpha := make([]byte, t.Width*t.Height)
+	opaque := true
+	for p := range alpha {
+		alpha[p] = t.Bytes[p*4+3]
+		opaque = opaque && alpha[p] == 255
+	}
+	if opaque {
+		return nil
+	}
+	return alpha
+}
+
+// maskTransparentPixels returns the weights of the pixels of the target in the cost, where the transparent pixels weigh nothing.
+// The opaque pixels keep the weight of the weight map, if any, or the maximum one
+func (t TargetImage) maskTransparentPixels() ([]byte, error) {
+	weights := make([]byte, t.Width*t.Height)
+	total := 0
+	for p := range weights {
+		if t.Bytes[p*4+3] < opaqueAlpha {
+			continue
+		}
+		weights[p] = 255
+		if t.Weights != nil {
+			weights[p] = t.Weights[p]
+		}
+		total += int(weights[p])
+	}
+	if total == 0 {
+		return nil, errors.New("The target image has no opaque pixels to fit (or all of them have weight 0)")
+	}
+
+	return weights, nil
+}
+
+// encodeAlphaMask encodes the alpha of the pixels of a diagram as a grayscale png, to be stored along with it
+func encodeAlphaMask(alpha []byte, width int, height int) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, weightMapImage(alpha, width, height)); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// decodeAlphaMask decodes the alpha of the pixels of a diagram of the given size, from the grayscale png encoded by encodeAlphaMask
+func decodeAlphaMask(data []byte, width int, height int) ([]byte, error) {
+	i, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	gray, ok := i.(*image.Gray)
+	if !ok || gray.Rect.Dx() != width || gray.Rect.Dy() != height {
+		return nil, fmt.Errorf("the alpha mask is not a %dx%d grayscale image", width, height)
+	}
+	return gray.Pix, nil
+}
@@ -2,13 +2,20 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"image"
 	"image/color"
+	"math"
 	"math/rand"
-	"time"
 )
 
-// Voronoi is the engine used to generate a voronoi diagram on a canvas, starting from auto-generated seed points
+// maxPositionAttempts is how many random positions are tried when moving a seed, before giving up on finding an opaque one
+const maxPositionAttempts = 8
+
+// Voronoi is the engine used to generate a voronoi diagram on a canvas, starting from auto-generated seed points.
+//
+// The diagram is stored as an owner map, assigning each pixel to the seed of its cell.
+// When only a few seeds change between two tessellations, only the cells affected by the changes are recomputed
 type Voronoi struct {
 
 	// diagram size (in pixels)
@@ -16,39 +23,151 @@ type Voronoi struct {
 	height int
 
 	// seed configuration of the diagram
-	numSeeds int     // number of seeds for the diagram
-	seeds    []Point // list of seeds for the diagram
+	numSeeds    int     // number of seeds for the diagram
+	seeds       []Point // list of seeds for the diagram
+	tessellated []Point // list of seeds the current diagram has been computed from (nil if the diagram has not been computed yet)
+
+	radius      int   // current radius of the computation
+	activeSeeds []int // indexes of the active seeds to take into account for the computation
+
+	metric       Metric        // metric measuring the distance of the pixels from the seeds
+	jumpFlooding *JumpFlooding // tessellator used to compute the whole diagram, if the jump flooding has been chosen instead of the ring growth
+	rings        [][]Point     // cache of the incremental vectors for each radius
+	source       *randomSource // source of the random numbers, whose state is saved in the checkpoints
+	r            *rand.Rand
+	workers      int // number of goroutines sharing the tessellations and the renderings
+
+	// resulting diagram (initially empty, to be computed), with one entry for each pixel in row-major order
+	owners        []int        // index of the seed owning each pixel, or -1 if the pixel is not assigned yet
+	ownerDistance []float64    // distance of each pixel from the seed owning it
+	cellBounds    []cellBounds // bounding box of the cell of each seed (it may be larger than the cell, but never smaller)
+
+	// tracking of the pixels whose rendering may have changed since the last call to ChangedPixels
+	changed    []int // indexes of the changed pixels (possibly with duplicates)
+	allChanged bool  // set when the whole diagram has been recomputed
+
+	// journal of the last tessellation, to roll it back
+	journal         []ownerChange // previous owners of the pixels changed by an incremental tessellation
+	journalSeeds    []Point       // seeds the diagram was computed from before the last tessellation (nil if there is nothing to roll back)
+	journalBounds   []cellBounds  // cell bounds before the last tessellation
+	journalFull     bool          // set when the last tessellation recomputed the whole diagram, so the full backup must be used
+	backupOwners    []int         // full backup of the owners, taken before recomputing the whole diagram
+	backupDistances []float64     // full backup of the owner distances, taken before recomputing the whole diagram
+
+	// optimal coloring of the cells (disabled if there is no estimator, so the colors are perturbated as the positions)
+	colors       ColorEstimator // estimator of the color of each cell from the target pixels it covers
+	colorTarget  []byte         // RGBA values of the target pixels
+	autoRecolor  bool           // set when the cells touched by a tessellation must be recolored right away
+	touched      []bool         // cells whose pixels changed since the beginning of the tessellation
+	touchedCells []int          // indexes of the touched cells
+	histogram    colorHistogram // scratch histogram used to estimate the colors
+
+	// importance of each pixel, from 0 to 255 (nil if all the pixels are equally important)
+	weights []byte
+
+	// transparency of the target, whose transparent pixels are left out of the images and never host a seed
+	alpha  []byte // alpha of each pixel, rendered in the images (nil if the target is opaque)
+	opaque []int  // indexes of the pixels opaque enough to host a seed
+}
+
+// ownerChange is an entry of the journal of the tessellation
+type ownerChange struct {
+	pixel    int
+	owner    int
+	distance float64
+}
 
-	radius      int     // current radius of the computation
-	activeSeeds []Point // list of active seeds to take into account for the computation
+// cellBounds is the bounding box of a cell of the diagram, with inclusive coordinates
+type cellBounds struct {
+	minX int
+	minY int
+	maxX int
+	maxY int
+}
+
+// emptyCellBounds returns a bounding box containing no pixels
+func emptyCellBounds() cellBounds {
+	return cellBounds{minX: math.MaxInt, minY: math.MaxInt, maxX: -1, maxY: -1}
+}
+
+// merge extends the bounding box to contain another one
+func (b *cellBounds) merge(other cellBounds) {
+	if other.maxX >= 0 {
+		b.include(other.minX, other.minY)
+		b.include(other.maxX, other.maxY)
+	}
+}
 
-	distances [][]int // precomputed distances matrix (for efficiency reasons)
-	r         *rand.Rand
+// include extends the bounding box to contain the given pixel
+func (b *cellBounds) include(x int, y int) {
+	if x < b.minX {
+		b.minX = x
+	}
+	if y < b.minY {
+		b.minY = y
+	}
+	if x > b.maxX {
+		b.maxX = x
+	}
+	if y > b.maxY {
+		b.maxY = y
+	}
+}
 
-	diagram [][]*Point // resulting diagram (initially empty, to be computed)
+// distance returns the chebyshev distance of a pixel from the bounding box, or 0 if the pixel lies within it
+func (b cellBounds) distance(x int, y int) int {
+	dx := 0
+	if x < b.minX {
+		dx = b.minX - x
+	} else if x > b.maxX {
+		dx = x - b.maxX
+	}
+	dy := 0
+	if y < b.minY {
+		dy = b.minY - y
+	} else if y > b.maxY {
+		dy = y - b.maxY
+	}
+	if dx > dy {
+		return dx
+	}
+	return dy
 }
 
-// NewVoronoi creates a new diagram struct
+// NewVoronoi creates a new diagram struct, whose random numbers (initial seeds and perturbations) are generated from the given seed
 func NewVoronoi(
 	width int,
 	height int,
 	numSeeds int,
+	tessellator string,
+	metric Metric,
+	randomSeed int64,
 ) (*Voronoi, error) {
 
 	if numSeeds > width*height {
 		return nil, errors.New("Number of seeds cannot be more than the pixels in the canvas")
 	}
+	if tessellator != "ring" && tessellator != "jfa" {
+		return nil, fmt.Errorf("Unknown tessellator '%s'", tessellator)
+	}
 
+	source := newRandomSource(randomSeed)
 	v := Voronoi{
-		width:       width,
-		height:      height,
-		numSeeds:    numSeeds,
-		seeds:       []Point{},
-		radius:      0,
-		activeSeeds: []Point{},
-		distances:   make([][]int, 3*width+height),
-		r:           rand.New(rand.NewSource(time.Now().UnixNano())),
-		diagram:     make([][]*Point, width),
+		width:         width,
+		height:        height,
+		numSeeds:      numSeeds,
+		seeds:         []Point{},
+		radius:        0,
+		activeSeeds:   []int{},
+		metric:        metric,
+		source:        source,
+		r:             rand.New(source),
+		workers:       1,
+		owners:        make([]int, width*height),
+		ownerDistance: make([]float64, width*height),
+	}
+	if tessellator == "jfa" {
+		v.jumpFlooding = NewJumpFlooding(width, height, v.workers, metric)
 	}
 	v.Init()
 
@@ -57,55 +176,36 @@ func NewVoronoi(
 
 // Init initializes the Voronoi diagram and generates a new set of seeds
 func (v *Voronoi) Init() {
-	v.initDistances()
-	v.initDiagram()
 	v.initSeeds()
+	v.initDiagram()
 	v.initTessellation()
 }
 
-// initDistances populates the precomputed distances matrix,
-// to avoid recomputing the same distance values over and over
-func (v *Voronoi) initDistances() {
-
-	// the distance vectors needed by the engine can assume values up to twice their dimension  (2*width or 2*height)
-	for i := 0; i < 3*v.width+v.height; i++ {
-
-		column := make([]int, 3*v.width+v.height)
-		v.distances[i] = column
-
-		for j := 0; j < 3*v.width+v.height; j++ {
-			v.distances[i][j] = i*i + j*j
-		}
-	}
-}
-
-// initDiagram populates the diagram with empty points
+// initDiagram resets the diagram, leaving all the pixels unassigned
 func (v *Voronoi) initDiagram() {
 
-	for i := 0; i < v.width; i++ {
-
-		column := make([]*Point, v.height)
-		v.diagram[i] = column
+	for i := range v.owners {
+		v.owners[i] = -1
+		v.ownerDistance[i] = math.Inf(1)
+	}
 
-		for j := 0; j < v.height; j++ {
-			v.diagram[i][j] = nil
-		}
+	v.cellBounds = make([]cellBounds, len(v.seeds))
+	for i := range v.cellBounds {
+		v.cellBounds[i] = emptyCellBounds()
 	}
+	v.tessellated = nil
 }
 
-// initSeeds generates a random set of seeds with random colors and stores them in the diagram
+// initSeeds generates a random set of seeds with random colors
 func (v *Voronoi) initSeeds() {
 
 	v.seeds = []Point{}
 
 	for i := 0; i < v.numSeeds; i++ {
-		x := int(v.r.Intn(v.width))
-		y := int(v.r.Intn(v.height))
-		d := 0
+		x, y := v.randomPosition()
 		seed := Point{
-			X:        x,
-			Y:        y,
-			Distance: &d,
+			X: x,
+			Y: y,
 			Color: &color.RGBA{
 				R: 0,
 				G: 0,
@@ -113,39 +213,165 @@ func (v *Voronoi) initSeeds() {
 				A: 255,
 			},
 		}
+		if metric, ok := v.metric.(perSeedMetric); ok {
+			metric.randomAttributes(&seed, v.r)
+		}
 
 		v.seeds = append(v.seeds, seed)
-		v.diagram[seed.X][seed.Y] = &seed
 	}
 }
 
-// initTessellation starts the tessellation of the existing set of seeds
+// initTessellation starts the tessellation of the existing set of seeds,
+// assigning to each seed the pixel it lies on
 func (v *Voronoi) initTessellation() {
 
 	v.radius = 0
-	v.activeSeeds = v.seeds
+	v.activeSeeds = []int{}
+	for i := range v.seeds {
+		v.assignPointToSeed(i, 0, 0)
+		v.activeSeeds = append(v.activeSeeds, i)
+	}
+}
 
-	// fmt.Println("#######################################")
-	// fmt.Println("#### Voronoi tessellation starting ####")
-	// fmt.Println("#######################################")
+// Tessellate brings the voronoi diagram up to date with the current set of seeds.
+//
+// If the diagram has never been computed, or if too many seeds have moved since the last tessellation,
+// the whole diagram is computed from scratch with the chosen tessellator (ring growth or jump flooding). Otherwise, only the cells affected by the moved seeds are updated.
+// Changes of color only don't require any computation, since the color of each pixel is taken from the seed owning it
+func (v *Voronoi) Tessellate() error {
+	v.beginJournal()
+
+	if v.tessellated == nil || len(v.tessellated) != len(v.seeds) {
+		v.tessellateAll()
+		return nil
+	}
+
+	// find the seeds that moved since the last tessellation (a change of the attributes used by the metric counts as a move)
+	moved := []int{}
+	for i, s := range v.seeds {
+		if !s.SameSite(v.tessellated[i]) {
+			moved = append(moved, i)
+		}
+	}
+
+	// when most of the seeds moved, it's cheaper to start from scratch
+	if len(moved) > len(v.seeds)/2 {
+		v.tessellateAll()
+		return nil
+	}
+
+	for _, i := range moved {
+		v.moveSeed(i)
+	}
+	if v.autoRecolor {
+		// a moved seed may keep the same pixels, but the pixel it lies on (left out of its color) changed
+		for _, i := range moved {
+			v.touchCell(i)
+		}
+		v.recolorCells(v.touchedCells)
+	}
+
+	// the pixels of the recolored cells are rendered differently, even if their owners didn't change
+	v.markRecoloredCells(v.tessellated)
+
+	v.tessellated = append([]Point{}, v.seeds...)
+
+	return nil
 }
 
-// Tessellate computes the voronoi diagram
+// beginJournal starts recording the changes of a new tessellation, discarding the previous journal
+func (v *Voronoi) beginJournal() {
+	v.journal = v.journal[:0]
+	v.journalSeeds = v.tessellated
+	v.journalBounds = append(v.journalBounds[:0], v.cellBounds...)
+	v.journalFull = false
+
+	for _, seed := range v.touchedCells {
+		v.touched[seed] = false
+	}
+	v.touchedCells = v.touchedCells[:0]
+}
+
+// Rollback restores the diagram and the seeds to their state before the last tessellation.
+// The restored pixels are reported as changed, as any other change of the diagram
+func (v *Voronoi) Rollback() {
+	if v.journalSeeds == nil {
+		return
+	}
+
+	if v.journalFull {
+		copy(v.owners, v.backupOwners)
+		copy(v.ownerDistance, v.backupDistances)
+		v.allChanged = true
+	} else {
+		for i := len(v.journal) - 1; i >= 0; i-- {
+			c := v.journal[i]
+			v.owners[c.pixel] = c.owner
+			v.ownerDistance[c.pixel] = c.distance
+			v.markChanged(c.pixel)
+		}
+	}
+	v.cellBounds = append(v.cellBounds[:0], v.journalBounds...)
+
+	// the seeds get their previous colors back as well
+	rolledBack := v.tessellated
+	v.seeds = append([]Point{}, v.journalSeeds...)
+	v.tessellated = v.journalSeeds
+	v.markRecoloredCells(rolledBack)
+
+	v.journal = v.journal[:0]
+	v.journalSeeds = nil
+}
+
+// tessellateAll computes the whole voronoi diagram from scratch, using the chosen tessellator
+func (v *Voronoi) tessellateAll() {
+	v.allChanged = true
+	v.changed = v.changed[:0]
+
+	// back up the whole diagram, since every pixel is going to be rewritten
+	v.journalFull = true
+	v.backupOwners = append(v.backupOwners[:0], v.owners...)
+	v.backupDistances = append(v.backupDistances[:0], v.ownerDistance...)
+
+	if v.jumpFlooding != nil {
+		v.initDiagram()
+		v.jumpFlooding.Tessellate(v.seeds, v.owners, v.ownerDistance)
+		for p, owner := range v.owners {
+			v.cellBounds[owner].include(p%v.width, p/v.width)
+		}
+	} else {
+		v.growAll()
+		v.settleAll()
+	}
+	if v.autoRecolor {
+		v.recolorCells(v.allCells())
+	}
+
+	v.tessellated = append([]Point{}, v.seeds...)
+}
+
+// growAll computes the whole voronoi diagram by growing all the cells together, ring by ring
 //
 // It works on a list of 'active' seeds, where 'active' means that the seed can still extend its area.
 // At each iteration, the area of the cell corresponding to each seed gets extended by 1 pixel,
 // and each of these pixels gets assigned to that cell (unless it already belongs to a nearest seed)
-func (v *Voronoi) Tessellate() error {
+func (v *Voronoi) growAll() {
+	v.initDiagram()
+	v.initTessellation()
+	if parallelWorkers(len(v.owners), v.workers) > 1 {
+		v.growAllInBands()
+		return
+	}
 
 	// the tessellation goes on until all the seeds have extended their area as much as possible
 	for len(v.activeSeeds) > 0 {
 
-		stillActiveSeeds := []Point{}
-		incrementalVectors := v.getIncrementalVectors()
+		stillActiveSeeds := []int{}
+		v.radius++ // increment the radius of the cells
+		incrementalVectors := v.getIncrementalVectors(v.radius)
 
 		// extend the area of each active seed
 		for _, seed := range v.activeSeeds {
-			// fmt.Println("Iteration starting. Active seeds: ", len(v.activeSeeds))
 
 			// stillActive monitors if the current seed is still able to extend its area
 			stillActive := false
@@ -154,7 +380,6 @@ func (v *Voronoi) Tessellate() error {
 			for _, incrementalVector := range incrementalVectors {
 				stillActive = v.assignPointToSeed(
 					seed,
-					v.distances[abs(incrementalVector.X)][abs(incrementalVector.Y)],
 					incrementalVector.X,
 					incrementalVector.Y,
 				) || stillActive
@@ -168,57 +393,529 @@ func (v *Voronoi) Tessellate() error {
 
 		v.activeSeeds = stillActiveSeeds
 	}
+}
 
-	return nil
+// growAllInBands grows all the cells together as growAll, with the canvas split into horizontal bands grown concurrently.
+//
+// Each pixel belongs to a single band, where it's contended by the seeds in the same order as in growAll,
+// so the resulting diagram is exactly the same. A seed is still active if it extended its area in any of the bands,
+// and the bounds of the cells are collected by each band and merged at the end
+func (v *Voronoi) growAllInBands() {
+	workers := parallelWorkers(len(v.owners), v.workers)
+	bands := chunksCount(v.height, workers)
+	bounds := make([][]cellBounds, bands)
+	active := make([][]bool, bands)
+	for band := range bounds {
+		bounds[band] = make([]cellBounds, len(v.seeds))
+		for i := range bounds[band] {
+			bounds[band][i] = emptyCellBounds()
+		}
+		active[band] = make([]bool, len(v.seeds))
+	}
+
+	for len(v.activeSeeds) > 0 {
+		v.radius++
+		incrementalVectors := v.getIncrementalVectors(v.radius)
+
+		forEachChunk(v.height, workers, func(band int, minY int, maxY int) {
+			for _, seed := range v.activeSeeds {
+				active[band][seed] = false
+
+				// the rings are diamonds, so the ones far from the band don't reach it
+				sy := v.seeds[seed].Y
+				if sy+v.radius < minY || sy-v.radius >= maxY {
+					continue
+				}
+
+				for _, incrementalVector := range incrementalVectors {
+					if y := sy + incrementalVector.Y; y < minY || y >= maxY {
+						continue
+					}
+					p, distance, claimed, stillActive := v.contendPoint(seed, incrementalVector.X, incrementalVector.Y)
+					if claimed {
+						// the whole diagram is being recomputed, so the changes are neither journaled nor tracked
+						v.owners[p] = seed
+						v.ownerDistance[p] = distance
+						bounds[band][seed].include(p%v.width, p/v.width)
+					}
+					active[band][seed] = stillActive || active[band][seed]
+				}
+			}
+		})
+
+		stillActiveSeeds := []int{}
+		for _, seed := range v.activeSeeds {
+			for band := range active {
+				if active[band][seed] {
+					stillActiveSeeds = append(stillActiveSeeds, seed)
+					break
+				}
+			}
+		}
+		v.activeSeeds = stillActiveSeeds
+	}
+
+	for band := range bounds {
+		for seed := range v.cellBounds {
+			v.cellBounds[seed].merge(bounds[band][seed])
+		}
+	}
+}
+
+// settleAll makes the diagram grown by growAll exact. A cell stops growing at the first ring it gets no pixels of,
+// so the growth misses the parts of the cells that are not star-shaped around their seed (or that lie away from it, with the weighted metrics).
+// The pixels left unassigned go to their closest seed, then each seed claims the pixels closer to it than to their current seed
+func (v *Voronoi) settleAll() {
+	for p, owner := range v.owners {
+		if owner != -1 {
+			continue
+		}
+		x, y := p%v.width, p/v.width
+		distance := math.Inf(1)
+		for i, s := range v.seeds {
+			if d := v.distance(i, x-s.X, y-s.Y); d <= distance {
+				owner, distance = i, d
+			}
+		}
+		v.setOwner(p, owner, distance)
+	}
+
+	for seed := range v.seeds {
+		v.claimCloserPixels(seed)
+	}
+}
+
+// moveSeed updates the diagram after the given seed moved from its tessellated position to its current one.
+//
+// The pixels of the old cell are released, and reassigned to their closest seed among the ones that can inherit them.
+// Then the moved seed claims the pixels that are closer to it than to their current seed
+func (v *Voronoi) moveSeed(seed int) {
+
+	// collect the pixels of the old cell, and the seeds of the cells around it
+	freed := []int{}
+	neighbours := map[int]bool{}
+	b := v.cellBounds[seed]
+	for y := b.minY; y <= b.maxY; y++ {
+		for x := b.minX; x <= b.maxX; x++ {
+			p := y*v.width + x
+			if v.owners[p] != seed {
+				continue
+			}
+			freed = append(freed, p)
+			v.markChanged(p)
+
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					if x+dx < 0 || x+dx >= v.width || y+dy < 0 || y+dy >= v.height {
+						continue
+					}
+					if n := v.owners[p+dy*v.width+dx]; n != seed && n != -1 {
+						neighbours[n] = true
+					}
+				}
+			}
+		}
+	}
+
+	// reassign the released pixels to the closest candidate seed (the one with the highest index on ties, as in assignPointToSeed).
+	// The closest candidates are searched concurrently, but the pixels are assigned in order, so the journal is the same
+	v.cellBounds[seed] = emptyCellBounds()
+	owners := make([]int, len(freed))
+	distances := make([]float64, len(freed))
+	for i := range freed {
+		owners[i] = -1
+		distances[i] = math.Inf(1)
+	}
+	inherit := func(candidates []int) {
+		forEachChunk(len(freed), parallelWorkers(len(freed), v.workers), func(chunk int, start int, end int) {
+			for i := start; i < end; i++ {
+				x := freed[i] % v.width
+				y := freed[i] / v.width
+				for _, c := range candidates {
+					d := v.distance(c, x-v.seeds[c].X, y-v.seeds[c].Y)
+					if d < distances[i] || (d == distances[i] && c > owners[i]) {
+						owners[i] = c
+						distances[i] = d
+					}
+				}
+			}
+		})
+	}
+
+	// the moved seed and the seeds of the neighbouring cells are the natural heirs of the released pixels.
+	// Any other seed whose smallest distance from the old cell does not exceed the farthest inherited pixel may be closer to some of them
+	// (its cell may not be star-shaped around it, or even lie away from it with the weighted metrics), so it's a candidate as well
+	candidates := []int{seed}
+	isCandidate := map[int]bool{seed: true}
+	for n := range neighbours {
+		candidates = append(candidates, n)
+		isCandidate[n] = true
+	}
+	for len(freed) > 0 && len(candidates) > 0 {
+		inherit(candidates)
+
+		farthest := math.Inf(-1)
+		for _, d := range distances {
+			farthest = math.Max(farthest, d)
+		}
+		candidates = candidates[:0]
+		for i, s := range v.seeds {
+			if !isCandidate[i] && v.metric.MinDistance(s, b.distance(s.X, s.Y)) <= farthest {
+				candidates = append(candidates, i)
+				isCandidate[i] = true
+			}
+		}
+	}
+	for i, p := range freed {
+		v.setOwner(p, owners[i], distances[i])
+	}
+
+	// the moved seed claims its new cell
+	v.claimCloserPixels(seed)
+}
+
+// claimCloserPixels assigns to a seed the pixels closer to it than to their current seed (or as close, if it wins the tie).
+//
+// The metrics are convex, so the pixels of a cell are at most as far from its seed as the farthest corner of its bounds,
+// while they are at least as far from the claiming seed as its smallest distance at the chebyshev distance of the bounds:
+// only the cells where the latter does not exceed the former can lose pixels, and only their bounds are scanned
+func (v *Voronoi) claimCloserPixels(seed int) {
+	s := v.seeds[seed]
+	for owner, b := range v.cellBounds {
+		if owner == seed || b.maxX < 0 {
+			continue
+		}
+		if v.metric.MinDistance(s, b.distance(s.X, s.Y)) > v.cellReach(owner) {
+			continue
+		}
+		for y := b.minY; y <= b.maxY; y++ {
+			for x := b.minX; x <= b.maxX; x++ {
+				if v.owners[y*v.width+x] == owner {
+					v.assignPointToSeed(seed, x-s.X, y-s.Y)
+				}
+			}
+		}
+	}
+}
+
+// cellReach returns the largest distance of the pixels of a cell from its seed, bounded by the distance of the farthest corner of the cell bounds
+func (v *Voronoi) cellReach(seed int) float64 {
+	b := v.cellBounds[seed]
+	s := v.seeds[seed]
+	reach := math.Inf(-1)
+	for _, corner := range [4][2]int{{b.minX, b.minY}, {b.maxX, b.minY}, {b.minX, b.maxY}, {b.maxX, b.maxY}} {
+		reach = math.Max(reach, v.distance(seed, corner[0]-s.X, corner[1]-s.Y))
+	}
+	return reach
 }
 
 // assignPointToSeed tries to assign a point to a seed given its relative coordinates
-func (v *Voronoi) assignPointToSeed(seed Point, distance int, dx int, dy int) bool {
+func (v *Voronoi) assignPointToSeed(seed int, dx int, dy int) bool {
+	p, distance, claimed, stillActive := v.contendPoint(seed, dx, dy)
 
-	// if the point is outside the diagram, ignore it
-	if seed.X+dx < 0 ||
-		seed.X+dx >= v.width ||
-		seed.Y+dy < 0 ||
-		seed.Y+dy >= v.height {
-		// fmt.Println(fmt.Sprintf("Point (%d,%d) out of canvas, discarded", seed.X+dx, seed.Y+dy))
-		return false
+	// the point can be assigned to the seed and stored in the resulting diagram representation
+	if claimed {
+		v.setOwner(p, seed, distance)
 	}
 
-	// get the point from the struct containing the resulting diagram representation
-	p := v.pointFromDiagram(seed.X+dx, seed.Y+dy)
+	return stillActive
+}
+
+// contendPoint checks whether a seed can claim a point given its relative coordinates, without assigning it.
+// It returns the point and its distance from the seed, whether the seed claims it,
+// and whether the seed can still extend its area through it
+func (v *Voronoi) contendPoint(seed int, dx int, dy int) (int, float64, bool, bool) {
+	x := v.seeds[seed].X + dx
+	y := v.seeds[seed].Y + dy
+
+	// if the point is outside the diagram, ignore it
+	if x < 0 ||
+		x >= v.width ||
+		y < 0 ||
+		y >= v.height {
+		return 0, 0, false, false
+	}
 
 	// if the point is already assigned to a cell whose seed is closer, ignore it
-	if p.Distance != nil && *p.Distance < distance {
-		// fmt.Println(fmt.Sprintf("Point (%d,%d) has already a smaller distance (%d < %d), discarded", seed.X+dx, seed.Y+dy, *p.Distance, distance))
-		return false
+	p := y*v.width + x
+	distance := v.distance(seed, dx, dy)
+	if v.ownerDistance[p] < distance {
+		return p, distance, false, false
 	}
 
-	// the point can be assigned to the seed and stored in the resulting diagram representation
-	// fmt.Println(fmt.Sprintf("Assigning point (%d,%d) to cell with seed (%d, %d). Distance: %d", p.X, p.Y, seed.X, seed.Y, distance))
-	p.Color = seed.Color
-	p.Distance = &distance
-	v.diagram[p.X][p.Y] = &p
+	// on ties the point stays to the seed with the highest index, so that the diagram
+	// does not depend on the order of the computation (but the seed can still extend its area)
+	if v.ownerDistance[p] == distance && v.owners[p] > seed {
+		return p, distance, false, true
+	}
 
-	return true
+	return p, distance, true, true
+}
+
+// setOwner assigns a pixel to a seed, recording the change in the journal
+func (v *Voronoi) setOwner(p int, owner int, distance float64) {
+	if v.owners[p] != owner {
+		v.markChanged(p)
+		if v.autoRecolor && !v.journalFull {
+			v.touchCell(v.owners[p])
+			v.touchCell(owner)
+		}
+	}
+	if !v.journalFull && (v.owners[p] != owner || v.ownerDistance[p] != distance) {
+		v.journal = append(v.journal, ownerChange{pixel: p, owner: v.owners[p], distance: v.ownerDistance[p]})
+	}
+
+	v.owners[p] = owner
+	v.ownerDistance[p] = distance
+	v.cellBounds[owner].include(p%v.width, p/v.width)
+}
+
+// markChanged records that the rendering of a pixel may have changed
+func (v *Voronoi) markChanged(p int) {
+	if !v.allChanged {
+		v.changed = append(v.changed, p)
+	}
+}
+
+// markCellChanged records that the rendering of all the pixels of a cell may have changed
+func (v *Voronoi) markCellChanged(seed int) {
+	b := v.cellBounds[seed]
+	for y := b.minY; y <= b.maxY; y++ {
+		for x := b.minX; x <= b.maxX; x++ {
+			if p := y*v.width + x; v.owners[p] == seed {
+				v.markChanged(p)
+			}
+		}
+	}
+}
+
+// markRecoloredCells records as changed the cells whose seed has a different color than in the given set of seeds
+func (v *Voronoi) markRecoloredCells(seeds []Point) {
+	for i, s := range v.seeds {
+		if i < len(seeds) && s.Color != seeds[i].Color {
+			v.markCellChanged(i)
+		}
+	}
+}
+
+// touchCell records that the pixels of a cell changed during the current tessellation
+func (v *Voronoi) touchCell(seed int) {
+	if seed != -1 && !v.touched[seed] {
+		v.touched[seed] = true
+		v.touchedCells = append(v.touchedCells, seed)
+	}
+}
+
+// allCells returns the indexes of all the cells of the diagram
+func (v *Voronoi) allCells() []int {
+	cells := make([]int, len(v.seeds))
+	for i := range cells {
+		cells[i] = i
+	}
+	return cells
+}
+
+// WithCellColors enables the optimal coloring of the cells: the color of each cell is computed by the estimator
+// from the target pixels it covers, and the perturbations only move the seeds.
+//
+// If auto is set, the cells are recolored by each tessellation as soon as their pixels change,
+// otherwise they are only recolored by Recolor
+func (v *Voronoi) WithCellColors(estimator ColorEstimator, target []byte, auto bool) {
+	v.colors = estimator
+	v.colorTarget = target
+	v.autoRecolor = auto
+	v.touched = make([]bool, v.numSeeds)
+}
+
+// Recolor assigns to every cell its optimal color, given the current diagram.
+// Unlike the recoloring performed by the tessellation, it cannot be rolled back
+func (v *Voronoi) Recolor() {
+	if v.colors == nil || v.tessellated == nil {
+		return
+	}
+
+	previous := v.seeds
+	v.recolorCells(v.allCells())
+	v.markRecoloredCells(previous)
+
+	// the diagram is still computed from the same positions, only the colors changed
+	tessellated := append([]Point{}, v.tessellated...)
+	for i := range tessellated {
+		tessellated[i].Color = v.seeds[i].Color
+	}
+	v.tessellated = tessellated
+	v.journal = v.journal[:0]
+	v.journalSeeds = nil
+}
+
+// recolorCells assigns to the given cells their optimal color.
+// The seeds are replaced rather than modified, since the previous set may still be referenced (e.g. by the journal)
+func (v *Voronoi) recolorCells(cells []int) {
+	replaced := false
+	for _, seed := range cells {
+		c, ok := v.cellColor(seed)
+		if !ok || (v.seeds[seed].Color != nil && *v.seeds[seed].Color == c) {
+			continue
+		}
+		if !replaced {
+			v.seeds = append([]Point{}, v.seeds...)
+			replaced = true
+		}
+		v.seeds[seed].Color = &c
+	}
+}
+
+// cellColor estimates the optimal color of a cell from the target pixels it covers, weighted by their importance.
+// The pixel of the seed is left out, since it's always rendered black
+func (v *Voronoi) cellColor(seed int) (color.RGBA, bool) {
+	return v.estimateCellColor(seed, true)
+}
+
+// estimateCellColor estimates the color of a cell from the target pixels it covers, optionally weighted by their importance
+func (v *Voronoi) estimateCellColor(seed int, weighted bool) (color.RGBA, bool) {
+	v.histogram.reset()
+
+	s := v.seeds[seed]
+	b := v.cellBounds[seed]
+	for y := b.minY; y <= b.maxY; y++ {
+		for x := b.minX; x <= b.maxX; x++ {
+			if p := y*v.width + x; v.owners[p] == seed && p != s.Y*v.width+s.X {
+				v.histogram.add(v.colorTarget[p*4:p*4+4], v.pixelWeight(p, weighted))
+			}
+		}
+	}
+	if v.histogram.count == 0 {
+		// the cells lying on pixels of no importance get the color they would have without the weight map
+		if weighted && v.weights != nil {
+			return v.estimateCellColor(seed, false)
+		}
+		return color.RGBA{}, false
+	}
+
+	return v.colors.Estimate(&v.histogram), true
+}
+
+// pixelWeight returns the importance of a pixel (1 for all the pixels if there is no weight map, or if the weights are ignored)
+func (v *Voronoi) pixelWeight(p int, weighted bool) int {
+	if !weighted || v.weights == nil {
+		return 1
+	}
+	return int(v.weights[p])
+}
+
+// WithWeightMap sets the importance of each pixel, from 0 to 255: the colors of the cells are estimated
+// from the pixels weighted by their importance, and the seeds lying on the important pixels are perturbated more often
+func (v *Voronoi) WithWeightMap(weights []byte) {
+	v.weights = weights
+}
+
+// WithWorkers sets the number of goroutines sharing the tessellations and the renderings of the diagram.
+// The diagram is exactly the same with any number of workers
+func (v *Voronoi) WithWorkers(workers int) {
+	v.workers = workers
+	if v.jumpFlooding != nil {
+		v.jumpFlooding.workers = workers
+	}
+}
+
+// pickSeed chooses the seed to perturbate, with a probability proportional to the importance of its pixel.
+// Every seed keeps a chance to be chosen, so the seeds lying on pixels of no importance can still move away
+func (v *Voronoi) pickSeed() int {
+	if v.weights == nil {
+		return v.r.Intn(len(v.seeds))
+	}
+
+	total := 0
+	for _, s := range v.seeds {
+		total += int(v.weights[s.Y*v.width+s.X]) + 1
+	}
+	pick := v.r.Intn(total)
+	for i, s := range v.seeds {
+		pick -= int(v.weights[s.Y*v.width+s.X]) + 1
+		if pick < 0 {
+			return i
+		}
+	}
+	return len(v.seeds) - 1
+}
+
+// WithAlphaMask sets the transparency of the target, from the alpha of each pixel: the images of the diagram get the same alpha,
+// and the seeds are kept on the pixels opaque enough to be fitted. The seeds lying on the transparent pixels are moved to random opaque ones,
+// and the diagram is computed from scratch at the next tessellation
+func (v *Voronoi) WithAlphaMask(alpha []byte) {
+	v.alpha = alpha
+	v.opaque = v.opaque[:0]
+	for p, a := range alpha {
+		if a >= opaqueAlpha {
+			v.opaque = append(v.opaque, p)
+		}
+	}
+
+	seeds := append([]Point{}, v.seeds...)
+	for i, s := range seeds {
+		if !v.isOpaque(s.Y*v.width + s.X) {
+			seeds[i].X, seeds[i].Y = v.randomPosition()
+		}
+	}
+	v.seeds = seeds
+	v.initDiagram()
+	v.initTessellation()
+}
+
+// isOpaque reports whether a pixel is opaque enough to host a seed
+func (v *Voronoi) isOpaque(p int) bool {
+	return v.alpha == nil || v.alpha[p] >= opaqueAlpha
+}
+
+// randomPosition returns a random position for a seed, among the opaque pixels of the target
+func (v *Voronoi) randomPosition() (int, int) {
+	if v.alpha == nil || len(v.opaque) == 0 {
+		return v.r.Intn(v.width), v.r.Intn(v.height)
+	}
+	p := v.opaque[v.r.Intn(len(v.opaque))]
+	return p % v.width, p / v.width
+}
+
+// ChangedPixels returns the pixels whose rendering may have changed since the last call,
+// or true if the whole diagram may have changed
+func (v *Voronoi) ChangedPixels() ([]int, bool) {
+	changed, allChanged := v.changed, v.allChanged
+
+	// the returned slice is only valid until the next tessellation
+	v.changed = v.changed[:0]
+	v.allChanged = false
+
+	return changed, allChanged
+}
+
+// distance returns the distance of a point from a seed, given its relative coordinates
+func (v *Voronoi) distance(seed int, dx int, dy int) float64 {
+	return v.metric.Distance(v.seeds[seed], dx, dy)
 }
 
 // getIncrementalVectors
 
 // It returns a list of points, intended as coordinates relative to the seed,
-// that represents the new layer of pixels of the expanding cell.
+// that represents the layer of pixels of the expanding cell at the given radius.
 
 // It works by computing a 45° diagonal that has an horizontal (so not orthogonal!)
 // distance from the seed equal to the radius.
 // This diagonal is one segment (out of 8) of the diamond surrounding the seed: to compute all
 // the other segments and get the complete diamond, the algorithm generates all the possible
-// combinations of the relative coordinates
-func (v *Voronoi) getIncrementalVectors() []Point {
-	combinations := []Point{}
+// combinations of the relative coordinates.
+// Since the same rings are needed over and over, they are cached
+func (v *Voronoi) getIncrementalVectors(radius int) []Point {
+	for len(v.rings) <= radius {
+		v.rings = append(v.rings, nil)
+	}
+	if v.rings[radius] != nil {
+		return v.rings[radius]
+	}
 
-	v.radius++ // increment the radius of the cell
+	combinations := []Point{}
 
 	// initialize the relative coordinates that will be the first edge of the segment
-	dx := v.radius
+	dx := radius
 	dy := 0
 
 	// go on until the other edge of the segment is reached
@@ -237,24 +934,15 @@ func (v *Voronoi) getIncrementalVectors() []Point {
 		dy++
 	}
 
+	v.rings[radius] = combinations
 	return combinations
 }
 
-// pointFromDiagram gets the point of the diagram corresponding to the given coordinates
-func (v *Voronoi) pointFromDiagram(x int, y int) Point {
-	if v.diagram[x][y] == nil {
-		v.diagram[x][y] = &Point{
-			X: x,
-			Y: y,
-		}
-	}
-
-	return *v.diagram[x][y]
-}
-
-// WithSeeds resets the set of seeds of the voronoi diagram to the one passed in input
+// WithSeeds resets the set of seeds of the voronoi diagram to the one passed in input,
+// and brings the diagram up to date with it
 func (v *Voronoi) WithSeeds(seeds []Point) {
 	v.seeds = seeds
+	v.Tessellate()
 }
 
 // GetSeeds returns the current set of seeds of the voronoi diagram
@@ -262,12 +950,65 @@ func (v *Voronoi) GetSeeds() []Point {
 	return v.seeds
 }
 
+// GetDiagram returns the current diagram, with the owner of each pixel and the bounds of each cell
+func (v *Voronoi) GetDiagram() DiagramState {
+	return DiagramState{
+		Owners: append([]int{}, v.owners...),
+		Bounds: append([]cellBounds{}, v.cellBounds...),
+	}
+}
+
+// WithDiagram resets the set of seeds of the voronoi diagram, together with the diagram computed from them.
+// The diagram is taken as is, so it must have been computed from the same seeds (e.g. when restoring a checkpoint)
+func (v *Voronoi) WithDiagram(seeds []Point, diagram DiagramState) error {
+	if len(seeds) != v.numSeeds || len(diagram.Owners) != len(v.owners) || len(diagram.Bounds) != len(seeds) {
+		return errors.New("The diagram does not match the size and the number of seeds of the voronoi diagram")
+	}
+	for _, owner := range diagram.Owners {
+		if owner < -1 || owner >= len(seeds) {
+			return fmt.Errorf("The diagram has a pixel owned by the unknown seed %d", owner)
+		}
+	}
+
+	// the distances of the pixels from their owners are recomputed, since they only depend on the seeds
+	v.seeds = seeds
+	for p, owner := range diagram.Owners {
+		v.owners[p] = owner
+		v.ownerDistance[p] = math.Inf(1)
+		if owner >= 0 {
+			v.ownerDistance[p] = v.distance(owner, p%v.width-seeds[owner].X, p/v.width-seeds[owner].Y)
+		}
+	}
+	v.cellBounds = append([]cellBounds{}, diagram.Bounds...)
+	v.tessellated = append([]Point{}, seeds...)
+
+	// nothing to roll back, and every pixel may be rendered differently
+	v.journal = v.journal[:0]
+	v.journalSeeds = nil
+	v.changed = v.changed[:0]
+	v.allChanged = true
+
+	return nil
+}
+
+// GetRandomState returns the state of the random numbers used by the perturbations
+func (v *Voronoi) GetRandomState() RandomState {
+	return v.source.State()
+}
+
+// WithRandomState restores the state of the random numbers used by the perturbations, as saved by a checkpoint
+func (v *Voronoi) WithRandomState(state RandomState) {
+	v.source.Restore(state)
+}
+
 // Perturbate creates a random variation of the current set of seeds,
-// by changing the properties of a random seed
+// by changing the properties of a random seed.
+//
+// The diagram is not updated until the next tessellation
 func (v *Voronoi) Perturbate() error {
 
 	// choose a random seed
-	seedIndex := v.r.Intn(len(v.seeds))
+	seedIndex := v.pickSeed()
 	toPerturbate := v.seeds[seedIndex]
 
 	// choose which properties of the seed will be altered:
@@ -280,15 +1021,24 @@ func (v *Voronoi) Perturbate() error {
 		willPerturbateColor = true
 	}
 
+	// the metrics depending on the seeds (e.g. on their weight) add those attributes to the properties of the seed
+	metric, willPerturbateAttributes := v.metric.(perSeedMetric)
+	willPerturbateAttributes = willPerturbateAttributes && choice == 0
+
+	// when the colors are estimated from the target, only the geometry of the seeds is searched
+	if v.colors != nil && !willPerturbateAttributes {
+		willPerturbateCoords = true
+		willPerturbateColor = false
+	}
+
 	// alter the chosen properties
-	newX := toPerturbate.X
-	newY := toPerturbate.Y
-	newColor := toPerturbate.Color
-	if willPerturbateCoords {
-		newX = v.perturbateCoordinate(toPerturbate.X, v.width)
-		newY = v.perturbateCoordinate(toPerturbate.Y, v.height)
+	newSeed := toPerturbate
+	if willPerturbateAttributes {
+		metric.perturbateAttributes(&newSeed, v.r)
+	} else if willPerturbateCoords {
+		newSeed.X, newSeed.Y = v.perturbatePosition(toPerturbate)
 	} else if willPerturbateColor {
-		newColor = &color.RGBA{
+		newSeed.Color = &color.RGBA{
 			A: 255,
 			R: v.perturbateTint(toPerturbate.Color.R, 256),
 			G: v.perturbateTint(toPerturbate.Color.G, 256),
@@ -297,23 +1047,27 @@ func (v *Voronoi) Perturbate() error {
 	}
 
 	// replace the chosen seed with its variation
-	newSeed := Point{
-		X:     newX,
-		Y:     newY,
-		Color: newColor,
-	}
 	newSeeds := []Point{}
 	newSeeds = append(newSeeds, v.seeds...)
 	newSeeds[seedIndex] = newSeed
 	v.seeds = newSeeds
 
-	// re-tessellate the diagram using the altered set of seeds
-	v.initDiagram()
-	v.initTessellation()
-
 	return nil
 }
 
+// perturbatePosition computes a variation of the position of a seed, keeping it on the opaque pixels of the target.
+// If no opaque position is found within a few attempts, the seed stays where it is
+func (v *Voronoi) perturbatePosition(seed Point) (int, int) {
+	for attempt := 0; attempt < maxPositionAttempts; attempt++ {
+		x := v.perturbateCoordinate(seed.X, v.width)
+		y := v.perturbateCoordinate(seed.Y, v.height)
+		if v.isOpaque(y*v.width + x) {
+			return x, y
+		}
+	}
+	return seed.X, seed.Y
+}
+
 // perturbateCoordinate computes a variation of the input coordinate
 //
 // The perturbation is performed as a random movement of the coordinate, spanning across the whole dimension.
@@ -362,6 +1116,21 @@ func (v *Voronoi) perturbateTint(currentTint byte, maxValue int) uint8 {
 	return uint8(newTint)
 }
 
+// PixelColor returns the color the given pixel (in row-major order) is rendered with, consistently with ToPixels
+func (v *Voronoi) PixelColor(p int) color.RGBA {
+	owner := v.owners[p]
+
+	// the unassigned points and the seeds are rendered as black
+	if owner == -1 || v.seeds[owner].Color == nil {
+		return color.RGBA{}
+	}
+	if s := v.seeds[owner]; s.Y*v.width+s.X == p {
+		return color.RGBA{}
+	}
+
+	return *v.seeds[owner].Color
+}
+
 // ToPixels generates the byte array containing the information to render the diagram.
 // Each row of the canvas is concatenated to obtain a one-dimensional array.
 // Each pixel is represented by 4 bytes, representing the Red, Green, Blue and Alpha info.
@@ -369,29 +1138,31 @@ func (v *Voronoi) ToPixels() []byte {
 
 	pixels := make([]byte, v.width*v.height*4)
 
-	// iterate through each pixel
-	for i := 0; i < v.width; i++ {
-		for j := 0; j < v.height; j++ {
-			pos := (j*v.width + i) * 4
-
-			if v.diagram[i][j] != nil && v.diagram[i][j].Color != nil {
-				pixels[pos] = v.diagram[i][j].Color.R
-				pixels[pos+1] = v.diagram[i][j].Color.G
-				pixels[pos+2] = v.diagram[i][j].Color.B
-				pixels[pos+3] = v.diagram[i][j].Color.A
-
-			} else {
-				// if the point has not assigned any color yet, show it as black
-				pixels[pos] = 0
-				pixels[pos+1] = 0
-				pixels[pos+2] = 0
-				pixels[pos+3] = 0
+	// iterate through each pixel, band by band
+	forEachBand(v.height, parallelWorkers(len(v.owners), v.workers), func(minY int, maxY int) {
+		for p := minY * v.width; p < maxY*v.width; p++ {
+			owner := v.owners[p]
+			pos := p * 4
+
+			// if the point has not assigned any color yet, leave it black
+			if owner == -1 || v.seeds[owner].Color == nil {
+				continue
 			}
+
+			c := v.seeds[owner].Color
+			pixels[pos] = c.R
+			pixels[pos+1] = c.G
+			pixels[pos+2] = c.B
+			pixels[pos+3] = c.A
 		}
-	}
+	})
 
-	// iterate through the seeds to render them as black points
-	for _, s := range v.seeds {
+	// iterate through the seeds to render them as black points (only on their own cells, since with
+	// the weighted metrics a seed may lie in the cell of another one)
+	for i, s := range v.seeds {
+		if v.owners[s.Y*v.width+s.X] != i {
+			continue
+		}
 		pos := (s.Y*v.width + s.X) * 4
 		pixels[pos] = 0
 		pixels[pos+1] = 0
@@ -402,26 +1173,85 @@ func (v *Voronoi) ToPixels() []byte {
 	return pixels
 }
 
-// ToImage generates an image representation of the current voronoi diagram
+// ToImage generates an image representation of the current voronoi diagram, with the transparency of the target if any
 func (v *Voronoi) ToImage() image.Image {
-	res := image.NewRGBA(image.Rect(0, 0, v.width, v.height))
+	res := image.NewNRGBA(image.Rect(0, 0, v.width, v.height))
 
 	// iterate through each pixel
-	for i := 0; i < v.width; i++ {
-		for j := 0; j < v.height; j++ {
+	for p, owner := range v.owners {
 
-			c := color.RGBA{
-				R: 0,
-				G: 0,
-				B: 0,
-				A: 255,
-			}
-			if v.diagram[i][j] != nil && v.diagram[i][j].Color != nil {
-				c = *v.diagram[i][j].Color
-			}
-			res.Set(i, j, c)
+		c := color.RGBA{
+			R: 0,
+			G: 0,
+			B: 0,
+			A: 255,
+		}
+		if owner != -1 && v.seeds[owner].Color != nil {
+			c = *v.seeds[owner].Color
 		}
+		if v.alpha != nil {
+			c.A = v.alpha[p]
+		}
+		res.SetNRGBA(p%v.width, p/v.width, color.NRGBA(c))
 	}
 
 	return res
 }
+
+// SeedsToImage generates an image representation of the voronoi diagram obtained from the given set of seeds.
+// The diagram is computed on a scratch copy, so the current state of the engine is left untouched
+func (v *Voronoi) SeedsToImage(seeds []Point) (image.Image, error) {
+	scratch, err := v.scratchDiagram(seeds)
+	if err != nil {
+		return nil, err
+	}
+
+	return scratch.ToImage(), nil
+}
+
+// SeedsToCells computes the geometry of the cells of the voronoi diagram obtained from the given set of seeds.
+//
+// The euclidean and power cells are computed exactly, while the cells of the other metrics follow the boundaries of their pixels,
+// exactly as they are rendered
+func (v *Voronoi) SeedsToCells(seeds []Point) ([]Cell, error) {
+	switch v.metric.(type) {
+	case *euclideanMetric:
+		return FortuneCells(seeds, v.width, v.height), nil
+	case *powerMetric:
+		return PowerCells(seeds, v.width, v.height), nil
+	}
+
+	scratch, err := v.scratchDiagram(seeds)
+	if err != nil {
+		return nil, err
+	}
+
+	return scratch.traceCells(), nil
+}
+
+// scratchDiagram computes the voronoi diagram obtained from the given set of seeds on a scratch copy of the engine
+func (v *Voronoi) scratchDiagram(seeds []Point) (*Voronoi, error) {
+	scratch := &Voronoi{
+		width:         v.width,
+		height:        v.height,
+		numSeeds:      len(seeds),
+		seeds:         seeds,
+		metric:        v.metric,
+		r:             v.r,
+		owners:        make([]int, v.width*v.height),
+		ownerDistance: make([]float64, v.width*v.height),
+		workers:       v.workers,
+		alpha:         v.alpha,
+		opaque:        v.opaque,
+	}
+	if v.jumpFlooding != nil {
+		scratch.jumpFlooding = NewJumpFlooding(v.width, v.height, v.workers, v.metric)
+	}
+
+	err := scratch.Tessellate()
+	if err != nil {
+		return nil, err
+	}
+
+	return scratch, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testMetrics are the metrics the diagrams are tested with
+var testMetrics = []MetricConfig{
+	{Name: "euclidean"},
+	{Name: "manhattan"},
+	{Name: "chebyshev"},
+	{Name: "minkowski", P: 3},
+	{Name: "anisotropic", MaxStretch: 3},
+	{Name: "power", MaxWeight: 8},
+	{Name: "additive", MaxWeight: 8},
+}
+
+// newTestDiagram creates a diagram of the given target with the given tessellator and metric and a fixed random seed, and tessellates it
+func newTestDiagram(t *testing.T, target TargetImage, numSeeds int, tessellator string, metricConfig MetricConfig) *Voronoi {
+	t.Helper()
+
+	metric, err := NewMetric(metricConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVoronoi(target.Width, target.Height, numSeeds, tessellator, metric, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alpha := target.alphaMask(); alpha != nil {
+		v.WithAlphaMask(alpha)
+	}
+	if err := v.Tessellate(); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// perturbate moves the given number of seeds of the diagram, and tessellates it again
+func perturbate(t *testing.T, v *Voronoi, perturbations int) {
+	t.Helper()
+
+	for j := 0; j < perturbations; j++ {
+		if err := v.Perturbate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := v.Tessellate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sameSeed tells whether two seeds are the same in all their properties, color included
+func sameSeed(a Point, b Point) bool {
+	ca, cb := *a.Color, *b.Color
+	a.Color, b.Color = nil, nil
+	return a == b && ca == cb
+}
+
+// assertRebuiltDiagram fails the test if the diagram is inconsistent with its seeds,
+// or if any of its pixels is owned differently than in the diagram rebuilt from scratch from the same seeds
+func assertRebuiltDiagram(t *testing.T, v *Voronoi, iteration int) {
+	t.Helper()
+
+	scratch, err := v.scratchDiagram(append([]Point{}, v.seeds...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := range v.owners {
+		owner := v.owners[p]
+		if owner != scratch.owners[p] || v.ownerDistance[p] != scratch.ownerDistance[p] {
+			t.Fatalf(
+				"iteration %d: pixel %d is owned by seed %d at distance %g, rebuilt as seed %d at distance %g",
+				iteration, p, owner, v.ownerDistance[p], scratch.owners[p], scratch.ownerDistance[p],
+			)
+		}
+		x, y := p%v.width, p/v.width
+		if d := v.distance(owner, x-v.seeds[owner].X, y-v.seeds[owner].Y); d != v.ownerDistance[p] {
+			t.Fatalf("iteration %d: pixel %d is at distance %g from its seed %d, recorded as %g", iteration, p, d, owner, v.ownerDistance[p])
+		}
+		if b := v.cellBounds[owner]; x < b.minX || x > b.maxX || y < b.minY || y > b.maxY {
+			t.Fatalf("iteration %d: pixel %d lies outside of the bounds %+v of its seed %d", iteration, p, b, owner)
+		}
+	}
+}
+
+// assertClosestSeeds fails the test if any pixel of the diagram is farther from its seed than from another one,
+// or as far as from another seed with a higher index
+func assertClosestSeeds(t *testing.T, v *Voronoi) {
+	t.Helper()
+
+	for p, owner := range v.owners {
+		x, y := p%v.width, p/v.width
+		for i, s := range v.seeds {
+			if d := v.distance(i, x-s.X, y-s.Y); d < v.ownerDistance[p] || (d == v.ownerDistance[p] && i > owner) {
+				t.Fatalf("pixel %d is owned by seed %d at distance %g, but seed %d is at distance %g", p, owner, v.ownerDistance[p], i, d)
+			}
+		}
+	}
+}
+
+func TestTessellation(t *testing.T) {
+	for _, metricConfig := range testMetrics {
+		for _, numSeeds := range []int{3, 40} {
+			t.Run(fmt.Sprintf("%s/%d seeds", metricConfig.Name, numSeeds), func(t *testing.T) {
+				assertClosestSeeds(t, newTestDiagram(t, testTarget(64, 48, false), numSeeds, "ring", metricConfig))
+			})
+		}
+	}
+}
+
+func TestIncrementalTessellation(t *testing.T) {
+	tests := []struct {
+		name          string
+		numSeeds      int
+		perturbations int // number of seeds moved by each iteration (more than half of them recomputes the whole diagram)
+	}{
+		{"a seed at a time", 40, 1},
+		{"a few seeds at a time", 40, 4},
+		{"large cells", 5, 1},
+		{"whole diagram", 4, 3},
+	}
+
+	for _, test := range tests {
+		for _, metricConfig := range testMetrics {
+			for _, transparent := range []bool{false, true} {
+				name := test.name + "/" + metricConfig.Name
+				if transparent {
+					name += "/transparent"
+				}
+				t.Run(name, func(t *testing.T) {
+					v := newTestDiagram(t, testTarget(64, 48, transparent), test.numSeeds, "ring", metricConfig)
+
+					// some of the moves are rolled back, as the rejected ones
+					for i := 0; i < 150; i++ {
+						perturbate(t, v, test.perturbations)
+						if i%3 == 0 {
+							v.Rollback()
+						}
+						assertRebuiltDiagram(t, v, i)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestTessellationRollback(t *testing.T) {
+	tests := []struct {
+		name          string
+		tessellator   string
+		perturbations int // number of seeds moved by each iteration (more than half of them recomputes the whole diagram)
+	}{
+		{"ring, incremental", "ring", 3},
+		{"ring, whole diagram", "ring", 30},
+		{"jfa, incremental", "jfa", 3},
+		{"jfa, whole diagram", "jfa", 30},
+	}
+
+	for _, test := range tests {
+		for _, metricConfig := range testMetrics {
+			t.Run(test.name+"/"+metricConfig.Name, func(t *testing.T) {
+				v := newTestDiagram(t, testTarget(64, 48, false), 40, test.tessellator, metricConfig)
+
+				for i := 0; i < 50; i++ {
+					seeds := append([]Point{}, v.seeds...)
+					owners := append([]int{}, v.owners...)
+					bounds := append([]cellBounds{}, v.cellBounds...)
+
+					perturbate(t, v, test.perturbations)
+					v.Rollback()
+
+					for s := range seeds {
+						if !sameSeed(v.seeds[s], seeds[s]) {
+							t.Fatalf("iteration %d: seed %d rolled back to %+v, expected %+v", i, s, v.seeds[s], seeds[s])
+						}
+						if v.cellBounds[s] != bounds[s] {
+							t.Fatalf("iteration %d: bounds of seed %d rolled back to %+v, expected %+v", i, s, v.cellBounds[s], bounds[s])
+						}
+					}
+					for p := range v.owners {
+						if v.owners[p] != owners[p] {
+							t.Fatalf("iteration %d: pixel %d rolled back to seed %d, expected %d", i, p, v.owners[p], owners[p])
+						}
+					}
+
+					// the next iteration starts from an accepted move
+					perturbate(t, v, test.perturbations)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+)
+
+// loadWeightMap reads the importance of each pixel of the target image from a grayscale image of the same size:
+// the brighter the pixel of the map, the more the corresponding pixel of the target counts in the cost
+func loadWeightMap(path string, width int, height int) ([]byte, error) {
+	weightMap, err := decodeImage(path)
+	if err != nil {
+		return nil, err
+	}
+	bounds := weightMap.Bounds()
+	if bounds.Dx() != width || bounds.Dy() != height {
+		return nil, fmt.Errorf("Invalid weight map '%s': its size is %dx%d, but the target image is %dx%d", path, bounds.Dx(), bounds.Dy(), width, height)
+	}
+
+	// colored maps are converted to their gray levels
+	weights := make([]byte, 0, width*height)
+	total := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			w := color.GrayModel.Convert(weightMap.At(x, y)).(color.Gray).Y
+			weights = append(weights, w)
+			total += int(w)
+		}
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("Invalid weight map '%s': all the pixels have weight 0", path)
+	}
+
+	return weights, nil
+}